@@ -0,0 +1,362 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"net/http"
+	"net/url"
+	"path/filepath"
+	"sort"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// The JSON API served by Server under APIPrefix:
+//
+// - GET projects: every project with builds, and its latest build
+// - GET projects/{project}/builds?tag=&status=&limit=: a project's builds,
+//   newest first (limit defaults to APIDefaultLimit; 0 means no limit)
+// - GET builds/{project}/{tag}/{datetag}: one build
+// - GET builds/{project}/{tag}/{datetag}/logs?stream=&follow=: the build's
+//   logs as server-sent events, one per line, with the stream (see
+//   FollowBuildLogs) as the event type.  Unless follow=false, keeps sending
+//   until the build is no longer RUNNING.  Finishes with an "end" event whose
+//   data is the build's status.
+//
+// datetag is the build's start time as it appears in its build dir (see
+// DateTagFormat), e.g. 2006_01_02_15_04_05.
+
+const (
+	APIPrefix       = "/api/v1/"
+	APIDefaultLimit = 100
+)
+
+type apiProject struct {
+	Name        string   `json:"name"`
+	LatestBuild apiBuild `json:"latest_build"`
+}
+
+type apiBuild struct {
+	Project      string       `json:"project"`
+	Tag          string       `json:"tag"`
+	DateTime     string       `json:"datetime"`
+	DateTag      string       `json:"datetag"`
+	StartedAt    time.Time    `json:"started_at"`
+	FinishedAt   *time.Time   `json:"finished_at"`
+	DurationSecs float64      `json:"duration_secs"`
+	Status       BuildStatus  `json:"status"`
+	Usage        *apiUsage    `json:"usage"`
+	ParentTag    string       `json:"parent_tag,omitempty"`
+	MatrixKey    string       `json:"matrix_key,omitempty"`
+	RerunOf      string       `json:"rerun_of,omitempty"`
+	SupersededBy string       `json:"superseded_by,omitempty"`
+	ConfigHash   string       `json:"config_hash,omitempty"`
+	Steps        []apiStep    `json:"steps"`
+	URLs         apiBuildURLs `json:"urls"`
+}
+
+// Empty for builds without Steps.  StartedAt and FinishedAt, the step's
+// place in the build's schedule, are null until the step starts and finishes.
+type apiStep struct {
+	Name         string      `json:"name"`
+	Status       BuildStatus `json:"status"`
+	StartedAt    *time.Time  `json:"started_at"`
+	FinishedAt   *time.Time  `json:"finished_at"`
+	DurationSecs float64     `json:"duration_secs"`
+	Usage        *apiUsage   `json:"usage"`
+	URLs         apiStepURLs `json:"urls"`
+}
+
+type apiUsage struct {
+	ExitCode       int     `json:"exit_code"`
+	Signal         int     `json:"signal"`
+	UserTimeSecs   float64 `json:"user_time_secs"`
+	SystemTimeSecs float64 `json:"system_time_secs"`
+	MaxRSSKB       int64   `json:"max_rss_kb"`
+}
+
+type apiBuildURLs struct {
+	Self       string `json:"self"`
+	Stdout     string `json:"stdout"`
+	Stderr     string `json:"stderr"`
+	KerouacLog string `json:"kerouac_log"`
+	Combined   string `json:"combined"`
+	Tarball    string `json:"tarball"`
+	Config     string `json:"config,omitempty"`
+}
+
+type apiStepURLs struct {
+	Stdout   string `json:"stdout"`
+	Stderr   string `json:"stderr"`
+	Combined string `json:"combined"`
+}
+
+type apiError struct {
+	Error string `json:"error"`
+}
+
+func (s *Server) serveAPI(w http.ResponseWriter, r *http.Request) {
+	if r.Method != "GET" && r.Method != "HEAD" {
+		writeAPIError(w, http.StatusMethodNotAllowed, "Only GET is supported")
+		return
+	}
+
+	segments := strings.Split(strings.Trim(strings.TrimPrefix(r.URL.Path, APIPrefix), "/"), "/")
+
+	switch {
+	case len(segments) == 1 && segments[0] == "projects":
+		s.serveAPIProjects(w, r)
+	case len(segments) == 3 && segments[0] == "projects" && segments[2] == "builds":
+		s.serveAPIProjectBuilds(w, r, segments[1])
+	case len(segments) == 4 && segments[0] == "builds":
+		s.serveAPIBuild(w, r, segments[1], segments[2], segments[3])
+	case len(segments) == 5 && segments[0] == "builds" && segments[4] == "logs":
+		s.serveAPIBuildLogs(w, r, segments[1], segments[2], segments[3])
+	default:
+		writeAPIError(w, http.StatusNotFound, "No such API endpoint")
+	}
+}
+
+func (s *Server) serveAPIProjects(w http.ResponseWriter, r *http.Request) {
+	builds, err := s.store.FindMatchingBuilds("", "", "")
+	if err != nil {
+		s.apiServerError(w, r, err)
+		return
+	}
+
+	// Builds come newest first, so the first we see of a project is its
+	// latest.
+	projects := make([]apiProject, 0)
+	seen := make(map[string]bool)
+	for _, build := range builds {
+		if !seen[build.Project] {
+			seen[build.Project] = true
+			projects = append(projects, apiProject{Name: build.Project, LatestBuild: s.toAPIBuild(build)})
+		}
+	}
+
+	sort.Slice(projects, func(i, j int) bool {
+		return projects[i].Name < projects[j].Name
+	})
+
+	writeAPIResponse(w, map[string]interface{}{"projects": projects})
+}
+
+func (s *Server) serveAPIProjectBuilds(w http.ResponseWriter, r *http.Request, project string) {
+	query := r.URL.Query()
+
+	limit := APIDefaultLimit
+	if limitParam := query.Get("limit"); limitParam != "" {
+		var err error
+		if limit, err = strconv.Atoi(limitParam); err != nil || limit < 0 {
+			writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Bad limit: %s", limitParam))
+			return
+		}
+	}
+
+	status := BuildStatus(query.Get("status"))
+
+	builds, err := s.store.FindMatchingBuilds(project, query.Get("tag"), "")
+	if err != nil {
+		s.apiServerError(w, r, err)
+		return
+	}
+
+	apiBuilds := make([]apiBuild, 0)
+	for _, build := range builds {
+		if limit > 0 && len(apiBuilds) == limit {
+			break
+		}
+		if status == "" || build.Status == status {
+			apiBuilds = append(apiBuilds, s.toAPIBuild(build))
+		}
+	}
+
+	writeAPIResponse(w, map[string]interface{}{"builds": apiBuilds})
+}
+
+func (s *Server) serveAPIBuild(w http.ResponseWriter, r *http.Request, project string, tag string, dateTag string) {
+	if build := s.findAPIBuild(w, r, project, tag, dateTag); build != nil {
+		writeAPIResponse(w, map[string]interface{}{"build": s.toAPIBuild(*build)})
+	}
+}
+
+func (s *Server) serveAPIBuildLogs(w http.ResponseWriter, r *http.Request, project string, tag string, dateTag string) {
+	build := s.findAPIBuild(w, r, project, tag, dateTag)
+	if build == nil {
+		return
+	}
+
+	stream := r.URL.Query().Get("stream")
+	if stream == "" {
+		stream = AllStreams
+	}
+	if _, err := logTailsForStream(*build.BuildId, stream); err != nil {
+		writeAPIError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	follow := r.URL.Query().Get("follow") != "false"
+
+	flusher, ok := w.(http.Flusher)
+	if !ok {
+		s.apiServerError(w, r, fmt.Errorf("ResponseWriter can't flush"))
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/event-stream")
+	w.Header().Set("Cache-Control", "no-cache")
+
+	sendEvent := func(event string, data string) error {
+		// data can't contain newlines; a stray \r would end it early too.
+		if _, err := fmt.Fprintf(w, "event: %s\ndata: %s\n\n", event, strings.Replace(data, "\r", "", -1)); err != nil {
+			return err
+		}
+		flusher.Flush()
+		return nil
+	}
+
+	if err := FollowBuildLogs(s.store, *build.BuildId, stream, follow, r.Context().Done(), sendEvent); err != nil {
+		s.logError(r, err)
+		return
+	}
+
+	if build, err := FindLatestBuild(s.store, build.Project, build.Tag, build.DateTime.Format(DateFormat)); err == nil && build != nil {
+		sendEvent("end", string(build.Status))
+	}
+}
+
+// Find the build, or write an error response and return nil.
+func (s *Server) findAPIBuild(w http.ResponseWriter, r *http.Request, project string, tag string, dateTag string) *RecordedBuild {
+	dateTime, err := time.Parse(DateTagFormat, dateTag)
+	if err != nil {
+		writeAPIError(w, http.StatusBadRequest, fmt.Sprintf("Bad datetag: %s", dateTag))
+		return nil
+	}
+
+	build, err := FindLatestBuild(s.store, project, tag, dateTime.Format(DateFormat))
+	if err != nil {
+		s.apiServerError(w, r, err)
+		return nil
+	}
+	if build == nil {
+		writeAPIError(w, http.StatusNotFound, "No such build")
+		return nil
+	}
+
+	return build
+}
+
+func apiBuildURL(buildId BuildId) string {
+	return (&url.URL{Path: APIPrefix + "builds/" + buildId.Project + "/" + buildId.Tag + "/" + buildId.DateTime.Format(DateTagFormat)}).String()
+}
+
+func (s *Server) toAPIBuild(build RecordedBuild) apiBuild {
+	dateTag := build.DateTime.Format(DateTagFormat)
+
+	converted := apiBuild{
+		Project:      build.Project,
+		Tag:          build.Tag,
+		DateTime:     build.DateTime.Format(DateFormat),
+		DateTag:      dateTag,
+		StartedAt:    build.DateTime,
+		DurationSecs: build.Duration().Seconds(),
+		Status:       build.Status,
+		Usage:        toAPIUsage(build.Usage),
+		Steps:        make([]apiStep, 0, len(build.Steps)),
+		URLs: apiBuildURLs{
+			Self:       apiBuildURL(*build.BuildId),
+			Stdout:     s.fileURL(build.FmtStdoutLogPath()),
+			Stderr:     s.fileURL(build.FmtStderrLogPath()),
+			KerouacLog: s.fileURL(build.FmtKerouacLogPath()),
+			Combined:   s.fileURL(build.FmtCombinedLogPath()),
+			Tarball:    s.fileURL(build.FmtTarballPath()),
+		},
+	}
+
+	if build.ConfigHash != "" {
+		converted.ConfigHash = build.ConfigHash
+		converted.URLs.Config = s.fileURL(build.FmtConfigSnapshotPath())
+	}
+
+	if build.RerunOf != nil {
+		converted.RerunOf = apiBuildURL(*build.RerunOf)
+	}
+
+	if build.SupersededBy != nil {
+		converted.SupersededBy = apiBuildURL(*build.SupersededBy)
+	}
+
+	if build.Parent != nil {
+		converted.ParentTag = build.Parent.Tag
+		converted.MatrixKey = build.MatrixKey
+	}
+
+	if !build.EndTime.IsZero() {
+		endTime := build.EndTime
+		converted.FinishedAt = &endTime
+	}
+
+	for _, step := range build.Steps {
+		convertedStep := apiStep{
+			Name:         step.Name,
+			Status:       step.Status,
+			DurationSecs: step.Duration.Seconds(),
+			Usage:        toAPIUsage(step.Usage),
+			URLs: apiStepURLs{
+				Stdout:   s.fileURL(build.FmtStepStdoutLogPath(step.Name)),
+				Stderr:   s.fileURL(build.FmtStepStderrLogPath(step.Name)),
+				Combined: s.fileURL(build.FmtStepCombinedLogPath(step.Name)),
+			},
+		}
+		if !step.StartTime.IsZero() {
+			startTime := step.StartTime
+			convertedStep.StartedAt = &startTime
+		}
+		if endTime := step.EndTime(); !endTime.IsZero() {
+			convertedStep.FinishedAt = &endTime
+		}
+		converted.Steps = append(converted.Steps, convertedStep)
+	}
+
+	return converted
+}
+
+func toAPIUsage(usage *ProcessUsage) *apiUsage {
+	if usage == nil {
+		return nil
+	}
+	return &apiUsage{
+		ExitCode:       usage.ExitCode,
+		Signal:         int(usage.Signal),
+		UserTimeSecs:   usage.UserTime.Seconds(),
+		SystemTimeSecs: usage.SystemTime.Seconds(),
+		MaxRSSKB:       usage.MaxRSSKB,
+	}
+}
+
+// The URL Server serves filePath (under the kerouac root) at.
+func (s *Server) fileURL(filePath string) string {
+	rel, err := filepath.Rel(s.rootDir, filePath)
+	if err != nil {
+		return ""
+	}
+	return (&url.URL{Path: "/" + filepath.ToSlash(rel)}).String()
+}
+
+func (s *Server) apiServerError(w http.ResponseWriter, r *http.Request, err error) {
+	s.logError(r, err)
+	writeAPIError(w, http.StatusInternalServerError, "Internal server error")
+}
+
+func writeAPIResponse(w http.ResponseWriter, response interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	json.NewEncoder(w).Encode(response)
+}
+
+func writeAPIError(w http.ResponseWriter, code int, msg string) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(code)
+	json.NewEncoder(w).Encode(apiError{Error: msg})
+}
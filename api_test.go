@@ -0,0 +1,177 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIProjects(t *testing.T) {
+	server, _, rootDir := makeTestServer(t)
+	defer os.RemoveAll(rootDir)
+
+	var response struct {
+		Projects []apiProject
+	}
+	getAPI(t, server, APIPrefix+"projects", http.StatusOK, &response)
+
+	if len(response.Projects) != 1 || response.Projects[0].Name != KnownProject {
+		t.Errorf("Projects returned %+v", response.Projects)
+	}
+}
+
+func TestAPIProjectBuilds(t *testing.T) {
+	server, buildId, rootDir := makeTestServer(t)
+	defer os.RemoveAll(rootDir)
+
+	if err := MarkBuildFailed(server.store, buildId); err != nil {
+		t.Fatal(err)
+	}
+
+	var response struct {
+		Builds []apiBuild
+	}
+
+	getAPI(t, server, APIPrefix+"projects/"+KnownProject+"/builds?status=FAILED", http.StatusOK, &response)
+	if len(response.Builds) != 1 {
+		t.Fatalf("FAILED builds returned %+v", response.Builds)
+	}
+
+	build := response.Builds[0]
+	if build.Tag != KnownTag || build.DateTag != KnownDateTimeSU || build.FinishedAt == nil {
+		t.Errorf("Build returned as %+v", build)
+	}
+	if build.URLs.Stdout != "/builds/"+KnownProject+"/"+KnownTag+"/"+KnownDateTimeSU+"/logs/stdout" {
+		t.Errorf("Build stdout URL is %s", build.URLs.Stdout)
+	}
+
+	getAPI(t, server, APIPrefix+"projects/"+KnownProject+"/builds?status=SUCCEEDED", http.StatusOK, &response)
+	if len(response.Builds) != 0 {
+		t.Errorf("SUCCEEDED builds returned %+v", response.Builds)
+	}
+
+	getAPI(t, server, APIPrefix+"projects/"+KnownProject+"/builds?limit=x", http.StatusBadRequest, nil)
+}
+
+func TestAPIBuild(t *testing.T) {
+	server, buildId, rootDir := makeTestServer(t)
+	defer os.RemoveAll(rootDir)
+
+	var response struct {
+		Build apiBuild
+	}
+	getAPI(t, server, APIPrefix+"builds/"+KnownProject+"/"+KnownTag+"/"+KnownDateTimeSU, http.StatusOK, &response)
+
+	if response.Build.Status != RUNNING || response.Build.DateTime != KnownDateTimeS {
+		t.Errorf("Build returned as %+v", response.Build)
+	}
+	if response.Build.ConfigHash != "" || response.Build.URLs.Config != "" {
+		t.Errorf("Build without a config snapshot returned as %+v", response.Build)
+	}
+
+	if err := server.store.RecordConfigHash(buildId, "abc123"); err != nil {
+		t.Fatal(err)
+	}
+	getAPI(t, server, APIPrefix+"builds/"+KnownProject+"/"+KnownTag+"/"+KnownDateTimeSU, http.StatusOK, &response)
+	if response.Build.ConfigHash != "abc123" || response.Build.URLs.Config != "/builds/"+KnownProject+"/"+KnownTag+"/"+KnownDateTimeSU+"/config.json" {
+		t.Errorf("Build with a config snapshot returned as %+v", response.Build)
+	}
+
+	getAPI(t, server, APIPrefix+"builds/"+KnownProject+"/"+KnownTag+"/2001_01_01_00_00_00", http.StatusNotFound, nil)
+	getAPI(t, server, APIPrefix+"builds/"+KnownProject+"/"+KnownTag+"/yesterday", http.StatusBadRequest, nil)
+	getAPI(t, server, APIPrefix+"nonsense", http.StatusNotFound, nil)
+}
+
+func TestAPIBuildSteps(t *testing.T) {
+	server, buildId, rootDir := makeTestServer(t)
+	defer os.RemoveAll(rootDir)
+
+	buildPath := APIPrefix + "builds/" + KnownProject + "/" + KnownTag + "/" + KnownDateTimeSU
+	var response struct {
+		Build apiBuild
+	}
+	getAPI(t, server, buildPath, http.StatusOK, &response)
+	if response.Build.Steps == nil || len(response.Build.Steps) != 0 {
+		t.Errorf("Build without steps returned steps %+v", response.Build.Steps)
+	}
+
+	stepStart := KnownDateTime.Add(time.Second)
+	for _, step := range []RecordedStep{
+		{Position: 0, Name: "test", Status: FAILED, StartTime: stepStart, Duration: 1500 * time.Millisecond, Usage: &ProcessUsage{ExitCode: 1, UserTime: time.Second}},
+		{Position: 1, Name: "package", Status: SKIPPED},
+	} {
+		if err := server.store.RecordBuildStep(buildId, step); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	getAPI(t, server, buildPath, http.StatusOK, &response)
+	steps := response.Build.Steps
+	if len(steps) != 2 {
+		t.Fatalf("Build returned steps %+v", steps)
+	}
+
+	test := steps[0]
+	if test.Name != "test" || test.Status != FAILED || test.StartedAt == nil || !test.StartedAt.Equal(stepStart) || test.DurationSecs != 1.5 {
+		t.Errorf("Run step returned as %+v", test)
+	}
+	if test.FinishedAt == nil || !test.FinishedAt.Equal(stepStart.Add(1500*time.Millisecond)) {
+		t.Errorf("Run step finished at %v", test.FinishedAt)
+	}
+	if test.Usage == nil || test.Usage.ExitCode != 1 || test.Usage.UserTimeSecs != 1 {
+		t.Errorf("Run step usage returned as %+v", test.Usage)
+	}
+	stepLogsURL := "/builds/" + KnownProject + "/" + KnownTag + "/" + KnownDateTimeSU + "/logs/steps/test/"
+	if test.URLs.Stdout != stepLogsURL+StdoutLogName || test.URLs.Stderr != stepLogsURL+StderrLogName || test.URLs.Combined != stepLogsURL+CombinedLogName {
+		t.Errorf("Run step URLs returned as %+v", test.URLs)
+	}
+
+	if skipped := steps[1]; skipped.Name != "package" || skipped.Status != SKIPPED || skipped.StartedAt != nil || skipped.FinishedAt != nil || skipped.Usage != nil {
+		t.Errorf("Skipped step returned as %+v", skipped)
+	}
+}
+
+func TestAPIBuildLogs(t *testing.T) {
+	server, buildId, rootDir := makeTestServer(t)
+	defer os.RemoveAll(rootDir)
+
+	if err := MarkBuildSucceeded(server.store, buildId); err != nil {
+		t.Fatal(err)
+	}
+
+	logsPath := APIPrefix + "builds/" + KnownProject + "/" + KnownTag + "/" + KnownDateTimeSU + "/logs"
+
+	recorder := serveTestRequest(server, logsPath+"?stream=stdout")
+	if recorder.Code != http.StatusOK || recorder.Header().Get("Content-Type") != "text/event-stream" {
+		t.Fatalf("Logs returned %d %s", recorder.Code, recorder.Header().Get("Content-Type"))
+	}
+
+	expected := "event: stdout\ndata: build output\n\nevent: end\ndata: SUCCEEDED\n\n"
+	if body := recorder.Body.String(); body != expected {
+		t.Errorf("Logs returned %q, expected %q", body, expected)
+	}
+
+	recorder = serveTestRequest(server, logsPath+"?stream=stdin")
+	if recorder.Code != http.StatusBadRequest || !strings.Contains(recorder.Body.String(), "stdin") {
+		t.Errorf("Unknown stream returned %d: %s", recorder.Code, recorder.Body.String())
+	}
+}
+
+// GET urlPath from server, check the status code, and decode the response
+// into response (if non-nil).
+func getAPI(t *testing.T, server *Server, urlPath string, expectedCode int, response interface{}) {
+	recorder := serveTestRequest(server, urlPath)
+
+	if recorder.Code != expectedCode {
+		t.Fatalf("%s returned %d not %d: %s", urlPath, recorder.Code, expectedCode, recorder.Body.String())
+	}
+
+	if response != nil {
+		if err := json.Unmarshal(recorder.Body.Bytes(), response); err != nil {
+			t.Fatalf("%s returned bad json %s: %s", urlPath, err, recorder.Body.String())
+		}
+	}
+}
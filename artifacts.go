@@ -0,0 +1,193 @@
+package main
+
+import (
+	"crypto/sha256"
+	"encoding/hex"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+)
+
+// A file kept from a build, in its artifacts dir (see FmtArtifactsDir).
+type Artifact struct {
+	// Relative to the artifacts dir, with / separators.
+	Path   string `json:"path"`
+	Size   int64  `json:"size"`
+	SHA256 string `json:"sha256"`
+}
+
+// What's in a build's artifacts dir, written to FmtArtifactsManifestPath.
+type ArtifactManifest struct {
+	Artifacts []Artifact `json:"artifacts"`
+}
+
+// Copy the files and dirs in srcDir matching patterns (as for filepath.Match,
+// relative to srcDir) into buildId's artifacts dir, keeping their paths
+// relative to srcDir, and write its manifest.
+//
+// The manifest also has anything the build put in the artifacts dir itself.
+// Patterns that match nothing are logged, and symlinks are skipped.
+func CollectArtifacts(srcDir string, patterns []string, buildId BuildId) (*ArtifactManifest, error) {
+	artifactsDir := buildId.FmtArtifactsDir()
+	if err := os.MkdirAll(artifactsDir, 0700); err != nil {
+		return nil, err
+	}
+
+	for _, pattern := range patterns {
+		matches, err := filepath.Glob(filepath.Join(srcDir, pattern))
+		if err != nil {
+			return nil, err
+		}
+		if len(matches) == 0 {
+			log.Printf("Warning, no artifacts match %s", pattern)
+		}
+
+		for _, match := range matches {
+			rel, err := filepath.Rel(srcDir, match)
+			if err != nil {
+				return nil, err
+			}
+			log.Printf("Collecting artifact %s", rel)
+			if err = copyArtifact(match, filepath.Join(artifactsDir, rel)); err != nil {
+				return nil, fmt.Errorf("Could not collect artifact %s: %s", rel, err)
+			}
+		}
+	}
+
+	manifest, err := manifestArtifactsDir(artifactsDir)
+	if err != nil {
+		return nil, err
+	}
+
+	return manifest, writeArtifactManifest(buildId.FmtArtifactsManifestPath(), manifest)
+}
+
+// Copy the file or dir at srcPath to dstPath, leaving out symlinks.
+func copyArtifact(srcPath string, dstPath string) error {
+	return filepath.Walk(srcPath, func(path string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(srcPath, path)
+		if err != nil {
+			return err
+		}
+		dst := filepath.Join(dstPath, rel)
+
+		switch {
+		case info.IsDir():
+			return os.MkdirAll(dst, 0700)
+		case info.Mode().IsRegular():
+			if err := os.MkdirAll(filepath.Dir(dst), 0700); err != nil {
+				return err
+			}
+			return copyFile(path, dst, info.Mode().Perm())
+		default:
+			log.Printf("Warning, not collecting artifact %s, it is not a regular file", path)
+			return nil
+		}
+	})
+}
+
+func copyFile(srcPath string, dstPath string, perm os.FileMode) error {
+	src, err := os.Open(srcPath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(dstPath, os.O_WRONLY|os.O_CREATE|os.O_TRUNC, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	return dst.Close()
+}
+
+// List and hash the regular files under artifactsDir, sorted by path.
+func manifestArtifactsDir(artifactsDir string) (*ArtifactManifest, error) {
+	manifest := &ArtifactManifest{Artifacts: []Artifact{}}
+
+	err := filepath.Walk(artifactsDir, func(path string, info os.FileInfo, err error) error {
+		if err != nil || !info.Mode().IsRegular() {
+			return err
+		}
+
+		rel, err := filepath.Rel(artifactsDir, path)
+		if err != nil {
+			return err
+		}
+
+		hash, err := hashFile(path)
+		if err != nil {
+			return err
+		}
+
+		manifest.Artifacts = append(manifest.Artifacts, Artifact{Path: filepath.ToSlash(rel), Size: info.Size(), SHA256: hash})
+		return nil
+	})
+	if err != nil {
+		return nil, err
+	}
+
+	sort.Slice(manifest.Artifacts, func(i, j int) bool {
+		return manifest.Artifacts[i].Path < manifest.Artifacts[j].Path
+	})
+	return manifest, nil
+}
+
+func hashFile(path string) (string, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return "", err
+	}
+	defer file.Close()
+
+	hash := sha256.New()
+	if _, err = io.Copy(hash, file); err != nil {
+		return "", err
+	}
+	return hex.EncodeToString(hash.Sum(nil)), nil
+}
+
+func writeArtifactManifest(path string, manifest *ArtifactManifest) error {
+	file, err := os.Create(path)
+	if err != nil {
+		return err
+	}
+
+	encoder := json.NewEncoder(file)
+	encoder.SetIndent("", "  ")
+	if err = encoder.Encode(manifest); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Read buildId's artifact manifest.  Builds without one (e.g. from before
+// artifacts were collected) have no artifacts.
+func ReadArtifactManifest(buildId BuildId) (*ArtifactManifest, error) {
+	file, err := os.Open(buildId.FmtArtifactsManifestPath())
+	if os.IsNotExist(err) {
+		return &ArtifactManifest{Artifacts: []Artifact{}}, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var manifest ArtifactManifest
+	if err = json.NewDecoder(file).Decode(&manifest); err != nil {
+		return nil, fmt.Errorf("Error parsing artifact manifest: %s", err)
+	}
+	return &manifest, nil
+}
@@ -0,0 +1,86 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestCollectArtifacts(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "kerouac_artifacts_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	srcDir := filepath.Join(tmpDir, "src")
+	for path, contents := range map[string]string{
+		"dist/app.deb":           "package",
+		"dist/app.tar":           "not wanted",
+		"coverage/index.html":    "coverage",
+		"coverage/sub/more.html": "more",
+		"node_modules/big.js":    "not wanted",
+	} {
+		path = filepath.Join(srcDir, path)
+		os.MkdirAll(filepath.Dir(path), 0700)
+		if err = ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.Symlink("/etc/passwd", filepath.Join(srcDir, "coverage", "link")); err != nil {
+		t.Fatal(err)
+	}
+
+	buildId := BuildIdAt(filepath.Join(tmpDir, "root"), KnownProject, KnownTag, KnownDateTime)
+
+	// The build can also put artifacts straight into the artifacts dir.
+	os.MkdirAll(buildId.FmtArtifactsDir(), 0700)
+	if err = ioutil.WriteFile(buildId.FmtArtifactPath("notes.txt"), []byte(""), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	manifest, err := CollectArtifacts(srcDir, []string{"dist/*.deb", "coverage", "nothing/*"}, buildId)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []Artifact{
+		{Path: "coverage/index.html", Size: 8},
+		{Path: "coverage/sub/more.html", Size: 4},
+		{Path: "dist/app.deb", Size: 7},
+		{Path: "notes.txt", Size: 0, SHA256: "e3b0c44298fc1c149afbf4c8996fb92427ae41e4649b934ca495991b7852b855"},
+	}
+	if len(manifest.Artifacts) != len(expected) {
+		t.Fatalf("Collected %+v not %+v", manifest.Artifacts, expected)
+	}
+	for i, artifact := range manifest.Artifacts {
+		if artifact.Path != expected[i].Path || artifact.Size != expected[i].Size || len(artifact.SHA256) != 64 {
+			t.Errorf("Artifact %d was %+v not like %+v", i, artifact, expected[i])
+		}
+	}
+	if empty := manifest.Artifacts[3].SHA256; empty != expected[3].SHA256 {
+		t.Errorf("Hash of empty artifact was %s", empty)
+	}
+
+	contents, err := ioutil.ReadFile(buildId.FmtArtifactPath("dist/app.deb"))
+	if err != nil || string(contents) != "package" {
+		t.Errorf("Artifact copied as %q, %v", contents, err)
+	}
+
+	read, err := ReadArtifactManifest(buildId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(read, manifest) {
+		t.Errorf("Read manifest %+v not %+v", read, manifest)
+	}
+}
+
+func TestReadMissingArtifactManifest(t *testing.T) {
+	manifest, err := ReadArtifactManifest(BuildIdAt("no_such_root", KnownProject, KnownTag, KnownDateTime))
+	if err != nil || len(manifest.Artifacts) != 0 {
+		t.Errorf("Missing manifest read as %+v, %v", manifest, err)
+	}
+}
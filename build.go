@@ -2,9 +2,11 @@ package main
 
 import (
 	"fmt"
+	"io"
 	"log"
 	"os"
 	"os/exec"
+	"syscall"
 	"time"
 )
 
@@ -25,70 +27,325 @@ func BuildIdAt(rootDir string, project string, tag string, dateTime time.Time) B
 	return BuildId{RootDir: rootDir, Project: project, Tag: tag, DateTime: dateTime}
 }
 
-// Contains paths to files containing stdout and stderr from the build process.
+// Whether other is the same build, whatever the root dir and time zone it
+// was found with.
+func (buildId BuildId) SameBuild(other BuildId) bool {
+	return buildId.Project == other.Project && buildId.Tag == other.Tag && buildId.DateTime.Equal(other.DateTime)
+}
+
+// Contains paths to files containing stdout and stderr from the build process,
+// and how the process ended (nil if it never started).
 type BuildOutput struct {
 	StdoutPath string
 	StderrPath string
+	Usage      *ProcessUsage
+}
+
+// How a finished build script exited, and the resources it used.
+type ProcessUsage struct {
+	// -1 if the script was killed by a signal.
+	ExitCode int
+	// The signal that killed the script, or 0.
+	Signal     syscall.Signal
+	UserTime   time.Duration
+	SystemTime time.Duration
+	// Maximum resident set size, in kilobytes.
+	MaxRSSKB int64
 }
 
-// Run the supplied build script, after changing directory to buildDir.
+func processUsageFromState(state *os.ProcessState) *ProcessUsage {
+	usage := &ProcessUsage{ExitCode: -1, UserTime: state.UserTime(), SystemTime: state.SystemTime()}
+
+	if waitStatus, ok := state.Sys().(syscall.WaitStatus); ok {
+		usage.ExitCode = waitStatus.ExitStatus()
+		if waitStatus.Signaled() {
+			usage.Signal = waitStatus.Signal()
+		}
+	}
+
+	if rusage, ok := state.SysUsage().(*syscall.Rusage); ok {
+		usage.MaxRSSKB = int64(rusage.Maxrss)
+	}
+
+	return usage
+}
+
+// Run the supplied build script, after changing directory to buildDir, with
+// env (VAR=value, see BuildEnv) as its environment, or kerouac's own if nil.
 //
 // The script's stdout and stderr will be captured and written to the
-// appropriate directory under kerouacResultsRootDir (see dirs.go for more).
-func RunBuildScript(buildDir string, buildScript string, buildScriptArgs []string, timeoutInSecs int, buildId BuildId) (*BuildOutput, error) {
-	cmd := exec.Command(buildScript, buildScriptArgs...)
-	cmd.Dir = buildDir
+// appropriate directory under kerouacResultsRootDir (see dirs.go for more),
+// both separately and interleaved in the combined log (see CombinedLog), with
+// any of the secrets in redact masked (see Redactor).
+//
+// The script is run in its own process group.  If it runs longer than
+// timeoutInSecs, the whole group is sent SIGTERM, and anything still around
+// killGracePeriodInSecs later is sent SIGKILL.  The same happens if anything
+// arrives on cancel.
+//
+// If the script was killed, the error will be a *BuildTimedOutError or a
+// *BuildCancelledError.
+func RunBuildScript(buildDir string, buildScript string, buildScriptArgs []string, env []string, redact []string, timeoutInSecs int, killGracePeriodInSecs int, cancel <-chan os.Signal, buildId BuildId) (*BuildOutput, error) {
+	logs, err := createOutputLogs(buildId.FmtStdoutLogPath(), buildId.FmtStderrLogPath(), buildId.FmtCombinedLogPath())
+	if err != nil {
+		return nil, err
+	}
+	defer logs.close()
+
+	buildOutput := &BuildOutput{StdoutPath: buildId.FmtStdoutLogPath(), StderrPath: buildId.FmtStderrLogPath()}
+
+	buildOutput.Usage, err = runCommand(buildDir, buildScript, buildScriptArgs, env, redact, timeoutInSecs, killGracePeriodInSecs, cancel, logs)
 
-	stdoutPath := buildId.FmtStdoutLogPath()
-	stderrPath := buildId.FmtStderrLogPath()
+	return buildOutput, err
+}
+
+// Run command as described for RunBuildScript, writing its output to each of
+// logs.
+//
+// Returns how the command exited, or nil if it never started.
+func runCommand(dir string, command string, args []string, env []string, redact []string, timeoutInSecs int, killGracePeriodInSecs int, cancel <-chan os.Signal, logs ...*outputLogs) (*ProcessUsage, error) {
+	cmd := exec.Command(command, args...)
+	cmd.Dir = dir
+	cmd.Env = env
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	stdouts := make([]io.Writer, 0, len(logs))
+	stderrs := make([]io.Writer, 0, len(logs))
+	for _, l := range logs {
+		stdouts = append(stdouts, l.stdout())
+		stderrs = append(stderrs, l.stderr())
+	}
 
-	buildOutput := &BuildOutput{StdoutPath: stdoutPath, StderrPath: stderrPath}
+	stdoutRedactor := NewRedactor(io.MultiWriter(stdouts...), redact)
+	stderrRedactor := NewRedactor(io.MultiWriter(stderrs...), redact)
 
-	stdoutFile, err := os.Create(stdoutPath)
+	stdoutCopier, err := startOutputCopier(stdoutRedactor)
 	if err != nil {
 		return nil, err
 	}
-	defer stdoutFile.Close()
+	defer stdoutCopier.close()
 
-	stderrFile, err := os.Create(stderrPath)
+	stderrCopier, err := startOutputCopier(stderrRedactor)
 	if err != nil {
 		return nil, err
 	}
-	defer stderrFile.Close()
+	defer stderrCopier.close()
 
-	cmd.Stdout = stdoutFile
-	cmd.Stderr = stderrFile
+	cmd.Stdout = stdoutCopier.pipeWriter
+	cmd.Stderr = stderrCopier.pipeWriter
 
-	cmdDone := make(chan error)
+	err = cmd.Start()
 
-	go runCmd(cmd, cmdDone)
+	// The command has its own copies of the write ends now.
+	stdoutCopier.pipeWriter.Close()
+	stderrCopier.pipeWriter.Close()
 
-	err = waitForCmd(cmd, timeoutInSecs, cmdDone)
+	if err != nil {
+		return nil, err
+	}
 
-	return buildOutput, err
+	// Buffered so the wait (and so the reaping of the command) completes
+	// even while we're busy signalling the process group.
+	cmdDone := make(chan error, 1)
+
+	go waitCmd(cmd, cmdDone)
+
+	err = waitForCmd(cmd, timeoutInSecs, killGracePeriodInSecs, cancel, cmdDone)
+
+	for _, copier := range []*outputCopier{stdoutCopier, stderrCopier} {
+		if cerr := copier.wait(outputDrainTimeout); cerr != nil {
+			log.Printf("Error copying build output: %s", cerr)
+		}
+	}
+	for _, redactor := range []*Redactor{stdoutRedactor, stderrRedactor} {
+		if rerr := redactor.Flush(); rerr != nil {
+			log.Printf("Error copying build output: %s", rerr)
+		}
+	}
+	for _, l := range logs {
+		l.flush()
+	}
+
+	var usage *ProcessUsage
+	if cmd.ProcessState != nil {
+		usage = processUsageFromState(cmd.ProcessState)
+	}
+
+	return usage, err
 }
 
-func runCmd(cmd *exec.Cmd, cmdDone chan<- error) {
-	cmdDone <- cmd.Run()
+// Where some output is written: writers for its stdout and stderr, the
+// CombinedLogStreams behind them (to flush once it's done), and any files they
+// own (to close).
+type outputLogs struct {
+	stdoutWriter io.Writer
+	stderrWriter io.Writer
+	streams      []*CombinedLogStream
+	files        []*os.File
+}
+
+// Create stdout, stderr and combined log files.
+func createOutputLogs(stdoutPath string, stderrPath string, combinedPath string) (*outputLogs, error) {
+	files, err := createFiles(stdoutPath, stderrPath, combinedPath)
+	if err != nil {
+		return nil, err
+	}
+
+	combinedLog := NewCombinedLog(files[2], time.Now())
+	combinedStdout := combinedLog.Stream(StdoutStream)
+	combinedStderr := combinedLog.Stream(StderrStream)
+
+	return &outputLogs{
+		stdoutWriter: io.MultiWriter(files[0], combinedStdout),
+		stderrWriter: io.MultiWriter(files[1], combinedStderr),
+		streams:      []*CombinedLogStream{combinedStdout, combinedStderr},
+		files:        files,
+	}, nil
 }
 
-func waitForCmd(cmd *exec.Cmd, timeoutInSecs int, cmdDone <-chan error) error {
+// Create all of the files at paths, or none of them.
+func createFiles(paths ...string) ([]*os.File, error) {
+	files := make([]*os.File, 0, len(paths))
+	for _, path := range paths {
+		file, err := os.Create(path)
+		if err != nil {
+			for _, file := range files {
+				file.Close()
+			}
+			return nil, err
+		}
+		files = append(files, file)
+	}
+	return files, nil
+}
+
+func (l *outputLogs) stdout() io.Writer {
+	return l.stdoutWriter
+}
+
+func (l *outputLogs) stderr() io.Writer {
+	return l.stderrWriter
+}
+
+// Write out any incomplete last lines.
+func (l *outputLogs) flush() {
+	for _, stream := range l.streams {
+		if err := stream.Flush(); err != nil {
+			log.Printf("Error writing combined log: %s", err)
+		}
+	}
+}
+
+func (l *outputLogs) close() {
+	for _, file := range l.files {
+		file.Close()
+	}
+}
+
+func waitCmd(cmd *exec.Cmd, cmdDone chan<- error) {
+	cmdDone <- cmd.Wait()
+}
+
+// Wait for cmd to finish, killing it if it runs past timeoutInSecs (0 for no
+// timeout) or a signal is received on cancel.
+func waitForCmd(cmd *exec.Cmd, timeoutInSecs int, killGracePeriodInSecs int, cancel <-chan os.Signal, cmdDone <-chan error) error {
 	var err error
 
+	var deadline <-chan time.Time
+	if timeoutInSecs > 0 {
+		deadline = time.After(time.Second * time.Duration(timeoutInSecs))
+	}
+
 	select {
 	case result := <-cmdDone:
-		err = result
-	case <-time.After(time.Second * time.Duration(timeoutInSecs)):
-		err = fmt.Errorf("Execution of build timed out after %d seconds", timeoutInSecs)
+		return result
+	case <-deadline:
+		err = &BuildTimedOutError{TimeoutInSecs: timeoutInSecs}
 		log.Printf("Attempting to kill long-running build ...")
-		if perr := cmd.Process.Kill(); perr != nil {
-			// TODO: try -9'ing with signal
-			log.Printf("Could not kill process, aborting in dirty state: %s", perr)
-			err = perr
-		} else {
-			log.Printf("Long-running build killed.")
-		}
-		<-cmdDone
+	case sig := <-cancel:
+		err = &BuildCancelledError{Signal: sig}
+		log.Printf("Received %s, attempting to kill build ...", sig)
 	}
+
+	// Setpgid makes the script's pid the pgid of its process group.
+	if perr := KillProcessGroup(cmd.Process.Pid, killGracePeriodInSecs); perr != nil {
+		log.Printf("Could not kill process group, aborting in dirty state: %s", perr)
+	} else {
+		log.Printf("Build killed.")
+	}
+	<-cmdDone
+
 	return err
 }
+
+// How long to keep copying build output after the build script has exited,
+// in case it left something running that still has its stdout or stderr.
+var outputDrainTimeout = 5 * time.Second
+
+// Copies everything written to pipeWriter (which is handed to the build
+// script) to a Writer.
+//
+// exec would make the pipe for us if the script's Stdout wasn't a file, but
+// then Wait would not return until every process holding the pipe had exited,
+// so we do it ourselves to be able to give up on those.
+type outputCopier struct {
+	pipeReader *os.File
+	pipeWriter *os.File
+	done       chan error
+}
+
+func startOutputCopier(w io.Writer) (*outputCopier, error) {
+	pipeReader, pipeWriter, err := os.Pipe()
+	if err != nil {
+		return nil, err
+	}
+
+	copier := &outputCopier{pipeReader: pipeReader, pipeWriter: pipeWriter, done: make(chan error, 1)}
+
+	go func() {
+		_, err := io.Copy(w, pipeReader)
+		copier.done <- err
+	}()
+
+	return copier, nil
+}
+
+// Wait for the copying to finish, i.e. for everything holding the pipe to
+// close it, for up to timeout.
+func (c *outputCopier) wait(timeout time.Duration) error {
+	select {
+	case err := <-c.done:
+		return err
+	case <-time.After(timeout):
+	}
+
+	log.Printf("Build output still open %s after build script exited, no longer copying it.", timeout)
+	// Closing the read end makes io.Copy give up (with an error we expect).
+	c.pipeReader.Close()
+	<-c.done
+	return nil
+}
+
+func (c *outputCopier) close() {
+	c.pipeReader.Close()
+	c.pipeWriter.Close()
+}
+
+// Returned by RunBuildScript when the build script ran past its timeout.
+type BuildTimedOutError struct {
+	TimeoutInSecs int
+}
+
+func (e *BuildTimedOutError) Error() string {
+	return fmt.Sprintf("Execution of build timed out after %d seconds", e.TimeoutInSecs)
+}
+
+// Returned by RunBuildScript when kerouac was told to stop while the build
+// script was running.
+type BuildCancelledError struct {
+	Signal os.Signal
+}
+
+func (e *BuildCancelledError) Error() string {
+	return fmt.Sprintf("Execution of build cancelled by %s", e.Signal)
+}
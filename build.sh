@@ -2,7 +2,9 @@
 
 set -e
 
-go get code.google.com/p/go-sqlite/go1/sqlite3
+go get github.com/mattn/go-sqlite3
+go get github.com/BurntSushi/toml
+go get gopkg.in/yaml.v3
 
 go vet
 go test
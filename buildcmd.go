@@ -6,15 +6,41 @@ import (
 	"io"
 	"log"
 	"os"
+	"os/signal"
+	"sort"
+	"strings"
+	"syscall"
+	"time"
 )
 
 var dryRun = flag.Bool("dry-run", false, "Print the commands that would be run.")
 
 var removeSrcDir = flag.Bool("remove-src", false, "Remove the source dir after building.")
 
+var noTarball = flag.Bool("no-tarball", false, "Don't tarball the source dir after building.")
+
+var strictConfig = flag.Bool("strict-config", false, "For kerouac build, check the config as kerouac config check does, and don't build if it has any problems.")
+
+var secretsDir = flag.String("secrets-dir", DefaultSecretsDir(), "Where to find the secrets files named by configs.")
+
+var queuedBuild = flag.String("queued-build", "", "For kerouac build, run the build queued at this datetime, which kerouac worker has taken from the queue, rather than a new one.")
+
 // We expect 5 arguments on the command line
 const NumArgs = 5
 
+// Exit codes for kerouac build and kerouac enqueue --wait, so hook scripts can
+// tell how the build ended.
+const (
+	ExitSucceeded = 0
+	ExitFailed    = 1
+	ExitTimedOut  = 2
+	ExitCancelled = 3
+	ExitErrored   = 4
+	ExitSkipped   = 5
+	// Only from kerouac enqueue --wait.
+	ExitSuperseded = 6
+)
+
 func DoBuildCommand() {
 	flag.Usage = func() {
 		fmt.Printf("Usage: kerouac build [options] <srcDir> <configFile> <kerouacRootDir> <project> <tag>\n\n")
@@ -25,7 +51,7 @@ func DoBuildCommand() {
 
 	if len(flag.Args()) != NumArgs {
 		flag.Usage()
-		os.Exit(1)
+		os.Exit(ExitErrored)
 	}
 
 	srcDir := flag.Arg(0)
@@ -34,56 +60,126 @@ func DoBuildCommand() {
 	project := flag.Arg(3)
 	tag := flag.Arg(4)
 
-	buildId := BuildIdAtNow(rootDir, project, tag)
+	buildAndExit(srcDir, configFile, rootDir, project, tag, nil)
+}
 
+// Build srcDir with configFile, record it as a build of project with tag (and
+// a rerun of rerunOf, unless nil), and exit with the code for how it went.
+func buildAndExit(srcDir string, configFile string, rootDir string, project string, tag string, rerunOf *BuildId) {
 	log.SetOutput(os.Stderr)
+
+	buildId := BuildIdAtNow(rootDir, project, tag)
+	if *queuedBuild != "" {
+		dateTime, err := time.Parse(DateFormat, *queuedBuild)
+		if err != nil {
+			log.Printf("Bad --queued-build datetime: %s", err)
+			os.Exit(ExitErrored)
+		}
+		buildId = BuildIdAt(rootDir, project, tag, dateTime)
+	}
+
 	if *dryRun {
 		log.Printf("Dry run, will print actions but not take them.")
 	}
 
-	createBuildRecord(buildId)
+	store := openBuildStore(rootDir)
+	defer store.Close()
+
+	createBuildRecord(store, buildId, rerunOf)
 
 	logFile := configureLogging(buildId)
 	defer logFile.Close()
 
 	logStart(buildId)
 
-	config, err := ParseConfigFile(configFile)
-	if err != nil {
-		logAndDie(fmt.Sprintf("Error parsing config file: %s", err), buildId)
-	}
+	config := parseConfig(srcDir, configFile, store, buildId)
+
+	snapshotConfig(config, store, buildId)
+
+	var status BuildStatus
+	if config.Skip {
+		status = skipBuild(store, buildId)
+	} else {
+		secrets := loadSecrets(config, store, buildId)
+		redactLogging(logFile, secrets)
 
-	buildSuceeded := runBuild(srcDir, config, buildId)
-	createTarball(srcDir, buildId)
+		if len(config.Matrix) > 0 {
+			status = runMatrixBuild(srcDir, config, secrets, store, buildId)
+		} else {
+			status = runBuild(srcDir, config, secrets, nil, store, buildId)
+		}
+		createTarball(srcDir, config, store, buildId)
+	}
 	maybeRemoveSrcDir(srcDir)
 
-	if err := renderBuildReport(rootDir); err != nil {
+	if err := renderBuildReport(rootDir, store); err != nil {
 		log.Printf("Warning, error writing build report: %s", err)
 	}
 
-	if buildSuceeded {
-		if err = cleanOldBuilds(buildId.RootDir, buildId.Project, config.NumBuildsToKeep); err != nil {
+	if status == SUCCEEDED {
+		if err := cleanOldBuilds(store, buildId.Project, config.NumBuildsToKeep); err != nil {
 			log.Printf("Warning, error trying to remove old builds: %s", err)
 		}
+	}
 
-		os.Exit(0)
-	} else {
-		os.Exit(1)
+	os.Exit(exitCodeForStatus(status))
+}
+
+func exitCodeForStatus(status BuildStatus) int {
+	switch status {
+	case SUCCEEDED:
+		return ExitSucceeded
+	case TIMED_OUT:
+		return ExitTimedOut
+	case CANCELLED:
+		return ExitCancelled
+	case ERRORED:
+		return ExitErrored
+	case SKIPPED:
+		return ExitSkipped
+	case SUPERSEDED:
+		return ExitSuperseded
+	default:
+		return ExitFailed
 	}
+}
 
+func statusForBuildError(err error) BuildStatus {
+	switch err.(type) {
+	case nil:
+		return SUCCEEDED
+	case *BuildTimedOutError:
+		return TIMED_OUT
+	case *BuildCancelledError:
+		return CANCELLED
+	default:
+		return FAILED
+	}
 }
 
-func cleanOldBuilds(rootDir string, project string, buildsToKeep int) error {
+func cleanOldBuilds(store BuildStore, project string, buildsToKeep int) error {
 	if buildsToKeep < 1 {
 		return fmt.Errorf("Refusing to keep < 1 build, not deleting any: %d", buildsToKeep)
 	}
 
-	buildsToRemove, err := FindBuildsGreaterThanN(rootDir, project, buildsToKeep)
+	buildsToRemove, err := FindBuildsGreaterThanN(store, project, buildsToKeep)
 	if err != nil {
 		return err
 	}
 
 	for _, recordedBuild := range buildsToRemove {
+		children, err := FindMatrixChildren(store, *recordedBuild.BuildId)
+		if err != nil {
+			return err
+		}
+		for _, child := range children {
+			childDir := child.FmtBuildDir()
+			log.Printf("Removing old matrix build dir %s", childDir)
+			if err = os.RemoveAll(childDir); err != nil {
+				return err
+			}
+		}
+
 		buildDir := recordedBuild.FmtBuildDir()
 		log.Printf("Removing old build dir %s", buildDir)
 		if err = os.RemoveAll(buildDir); err != nil {
@@ -94,23 +190,111 @@ func cleanOldBuilds(rootDir string, project string, buildsToKeep int) error {
 	return nil
 }
 
-func logAndDie(msg string, buildId BuildId) {
-	if err := MarkBuildFailed(buildId); err != nil {
-		log.Printf("Could not mark build failed in db: %s", err)
+// Parse the config for the build merged from configFile and its other layers
+// (see ConfigLayerPaths), strictly with --strict-config, dying if it can't be
+// used.
+func parseConfig(srcDir string, configFile string, store BuildStore, buildId BuildId) *Config {
+	layers := ConfigLayerPaths(buildId.RootDir, buildId.Project, configFile)
+	log.Printf("Reading config from %s", strings.Join(layers, ", then "))
+
+	if !*strictConfig {
+		config, _, err := ParseLayeredConfig(buildId.RootDir, buildId.Project, buildId.Tag, configFile)
+		if err != nil {
+			logAndDie(fmt.Sprintf("Error parsing config file: %s", err), store, buildId)
+		}
+		return config
+	}
+
+	config, problems := CheckConfigFiles(srcDir, layers, buildId.Tag)
+	for _, problem := range problems {
+		log.Printf("Config problem: %s", problem)
+	}
+	if len(problems) > 0 {
+		logAndDie(fmt.Sprintf("Config file %s has problems, see kerouac config check", configFile), store, buildId)
+	}
+	return config
+}
+
+// Record the build as SKIPPED, as its config says to Skip it.
+func skipBuild(store BuildStore, buildId BuildId) BuildStatus {
+	log.Printf("Not building, the config for tag %s says to skip it.", buildId.Tag)
+	if err := MarkBuildSkipped(store, buildId); err != nil {
+		log.Printf("Could not mark build skipped in db: %s", err)
 	}
-	log.Fatalf(msg)
+	return SKIPPED
 }
 
-func createBuildRecord(buildId BuildId) {
-	log.Printf("Creating db record for build.")
+func logAndDie(msg string, store BuildStore, buildId BuildId) {
+	if err := MarkBuildErrored(store, buildId); err != nil {
+		log.Printf("Could not mark build errored in db: %s", err)
+	}
+	log.Print(msg)
+	os.Exit(ExitErrored)
+}
+
+// Open the store for rootDir, or for dry runs, an in-memory store that will be
+// thrown away.
+func openBuildStore(rootDir string) BuildStore {
+	if *dryRun {
+		return NewMemoryBuildStore(rootDir)
+	}
+
+	store, err := OpenBuildStore(rootDir)
+	if err != nil {
+		log.Printf("Could not open build db: %s", err)
+		os.Exit(ExitErrored)
+	}
+	return store
+}
+
+func createBuildRecord(store BuildStore, buildId BuildId, rerunOf *BuildId) {
+	// kerouac worker has already marked it RUNNING.
+	if *queuedBuild != "" {
+		log.Printf("Running queued build.")
+		return
+	}
+
+	if rerunOf != nil {
+		log.Printf("Creating db record for build, as a rerun of %s", rerunOf.FmtBuildDir())
+	} else {
+		log.Printf("Creating db record for build.")
+	}
 
 	if !*dryRun {
-		if err := CreateBuildRecord(buildId); err != nil {
-			log.Fatalf("Could not create build record: %s", err)
+		var err error
+		if rerunOf != nil {
+			err = store.CreateRerunBuildRecord(buildId, *rerunOf)
+		} else {
+			err = store.CreateBuildRecord(buildId)
+		}
+		if err != nil {
+			log.Printf("Could not create build record: %s", err)
+			os.Exit(ExitErrored)
 		}
 	}
 }
 
+// Keep the config the build runs with, for reruns and to see what it was.
+func snapshotConfig(config *Config, store BuildStore, buildId BuildId) {
+	snapshotPath := buildId.FmtConfigSnapshotPath()
+	log.Printf("Writing the config to %s", snapshotPath)
+
+	if *dryRun {
+		return
+	}
+
+	configHash, err := WriteConfigSnapshot(snapshotPath, config)
+	if err != nil {
+		log.Printf("Warning, error writing config snapshot: %s", err)
+		return
+	}
+
+	log.Printf("Config sha256 is %s", configHash)
+	if err = store.RecordConfigHash(buildId, configHash); err != nil {
+		log.Printf("Warning, error recording config hash: %s", err)
+	}
+}
+
 func maybeRemoveSrcDir(srcDir string) {
 	if !*removeSrcDir {
 		log.Printf("Not removing source dir.")
@@ -122,22 +306,27 @@ func maybeRemoveSrcDir(srcDir string) {
 	}
 }
 
-func createTarball(srcDir string, buildId BuildId) {
-	log.Printf("Tarballing %s into %s", srcDir, buildId.FmtTarballPath())
+func createTarball(srcDir string, config *Config, store BuildStore, buildId BuildId) {
+	if *noTarball {
+		log.Printf("Not tarballing %s due to --no-tarball", srcDir)
+		return
+	}
+
+	log.Printf("Tarballing %s into %s, excluding %v", srcDir, buildId.FmtTarballPath(), config.TarballExcludes)
 
 	if !*dryRun {
-		if err := CreateTarball(srcDir, buildId); err != nil {
-			logAndDie(fmt.Sprintf("Error creating tarball: %s", err), buildId)
+		if err := CreateTarball(srcDir, config.TarballExcludes, buildId); err != nil {
+			logAndDie(fmt.Sprintf("Error creating tarball: %s", err), store, buildId)
 		}
 	}
 }
 
-func renderBuildReport(rootDir string) error {
+func renderBuildReport(rootDir string, store BuildStore) error {
 	reportPath := FmtBuildHTMLReportPath(rootDir)
 	log.Printf("Writing the build report to %s", reportPath)
 
 	if !*dryRun {
-		if builds, err := FindMatchingBuilds(rootDir, "", "", ""); err != nil {
+		if builds, err := store.FindMatchingBuilds("", "", ""); err != nil {
 			return err
 		} else if err := RenderHTMLReport(reportPath, builds); err != nil {
 			return err
@@ -146,32 +335,114 @@ func renderBuildReport(rootDir string) error {
 	return nil
 }
 
-func runBuild(srcDir string, config *Config, buildId BuildId) bool {
-	log.Printf("Running build in dir %s with script %s and args %s", srcDir, config.BuildScript, config.BuildScriptArgs)
+// Run the build described by config in srcDir, with secrets and then extraEnv
+// (VAR=value, or nil) added to its environment (see BuildEnv), and record how
+// it went.
+func runBuild(srcDir string, config *Config, secrets Secrets, extraEnv []string, store BuildStore, buildId BuildId) BuildStatus {
+	if len(config.Steps) > 0 {
+		log.Printf("Running build in dir %s with %d steps", srcDir, len(config.Steps))
+		for _, step := range config.Steps {
+			log.Printf("Step %s: %s %s in %s, after %v", step.Name, step.Command, step.Args, step.WorkingDir, step.DependsOn)
+		}
+	} else {
+		log.Printf("Running build in dir %s with script %s and args %s", srcDir, config.BuildScript, config.BuildScriptArgs)
+	}
+
+	env := BuildEnv(config, os.Environ(), append(secrets.Env(), extraEnv...), srcDir, buildId)
+	for _, variable := range env {
+		if strings.HasPrefix(variable, KerouacEnvPrefix) {
+			log.Printf("Build environment has %s", variable)
+		}
+	}
 
-	succeeded := false
+	artifactsDir := buildId.FmtArtifactsDir()
+	log.Printf("Creating artifacts dir %s with perms 0700", artifactsDir)
+
+	status := FAILED
 
 	if !*dryRun {
-		buildOutput, err := RunBuildScript(srcDir, config.BuildScript, config.BuildScriptArgs, config.TimeoutInSecs, buildId)
+		if err := os.MkdirAll(artifactsDir, 0700); err != nil {
+			log.Printf("Could not create artifacts dir: %s", err)
+			if err := MarkBuildErrored(store, buildId); err != nil {
+				log.Printf("Could not mark build errored in db: %s", err)
+			}
+			return ERRORED
+		}
+
+		cancel := make(chan os.Signal, 1)
+		signal.Notify(cancel, os.Interrupt, syscall.SIGTERM)
+		defer signal.Stop(cancel)
+
+		var buildOutput *BuildOutput
+		var err error
+		if len(config.Steps) > 0 {
+			timeoutInSecs := config.TimeoutInSecs
+			if timeoutInSecs == InvalidTimeoutInSecs {
+				timeoutInSecs = 0
+			}
+			buildOutput, err = RunBuildSteps(srcDir, config.Steps, env, secrets.Values(), config.MaxParallelSteps, timeoutInSecs, config.KillGracePeriodInSecs, cancel, buildId, func(step RecordedStep) {
+				recordStep(store, buildId, step)
+			})
+		} else {
+			buildOutput, err = RunBuildScript(srcDir, config.BuildScript, config.BuildScriptArgs, env, secrets.Values(), config.TimeoutInSecs, config.KillGracePeriodInSecs, cancel, buildId)
+		}
 
+		status = statusForBuildError(err)
 		if err != nil {
 			log.Printf("Completed build with error: %s", err)
-			if err := MarkBuildFailed(buildId); err != nil {
-				log.Printf("Warning, could not record build as failed: %s", err)
-			}
 		} else {
 			log.Printf("Completed build successfully.")
-			if err := MarkBuildSucceeded(buildId); err != nil {
-				log.Printf("Warning, could not record build as failed: %s", err)
-			}
-			succeeded = true
 		}
 
-		log.Printf("Build script stdout in: %s", buildOutput.StdoutPath)
-		log.Printf("Build script stderr in: %s", buildOutput.StderrPath)
+		if err := store.UpdateBuildStatus(buildId, status); err != nil {
+			log.Printf("Warning, could not record build as %s: %s", status, err)
+		}
+
+		if buildOutput != nil {
+			log.Printf("Build script stdout in: %s", buildOutput.StdoutPath)
+			log.Printf("Build script stderr in: %s", buildOutput.StderrPath)
+			recordUsage(store, buildId, buildOutput.Usage)
+		}
+	}
+
+	collectArtifacts(srcDir, config, buildId)
+
+	return status
+}
+
+func collectArtifacts(srcDir string, config *Config, buildId BuildId) {
+	log.Printf("Collecting artifacts matching %v into %s", config.Artifacts, buildId.FmtArtifactsDir())
+
+	if !*dryRun {
+		manifest, err := CollectArtifacts(srcDir, config.Artifacts, buildId)
+		if err != nil {
+			log.Printf("Warning, error collecting artifacts: %s", err)
+			return
+		}
+		log.Printf("Collected %d artifacts, listed in %s", len(manifest.Artifacts), buildId.FmtArtifactsManifestPath())
+	}
+}
+
+func recordStep(store BuildStore, buildId BuildId, step RecordedStep) {
+	if step.Status != RUNNING {
+		log.Printf("Step %s %s after %s", step.Name, step.Status, step.Duration)
 	}
 
-	return succeeded
+	if err := store.RecordBuildStep(buildId, step); err != nil {
+		log.Printf("Warning, could not record step %s as %s: %s", step.Name, step.Status, err)
+	}
+}
+
+func recordUsage(store BuildStore, buildId BuildId, usage *ProcessUsage) {
+	if usage == nil {
+		return
+	}
+
+	log.Printf("Build script exit code %d, signal %d, user time %s, system time %s, max RSS %d KB", usage.ExitCode, usage.Signal, usage.UserTime, usage.SystemTime, usage.MaxRSSKB)
+
+	if err := store.RecordBuildUsage(buildId, usage); err != nil {
+		log.Printf("Warning, could not record build script usage: %s", err)
+	}
 }
 
 func configureLogging(buildId BuildId) *os.File {
@@ -194,7 +465,8 @@ func configureLogging(buildId BuildId) *os.File {
 	if !*dryRun {
 		logFile, err = os.Create(logPath)
 		if err != nil {
-			log.Fatalf("Logging ironic error, could not configure logging: %s", err)
+			log.Printf("Logging ironic error, could not configure logging: %s", err)
+			os.Exit(ExitErrored)
 		}
 	}
 
@@ -208,6 +480,40 @@ func configureLogging(buildId BuildId) *os.File {
 	return logFile
 }
 
+// Load the secrets file named by config, if any.
+func loadSecrets(config *Config, store BuildStore, buildId BuildId) Secrets {
+	if config.Secrets == "" {
+		return nil
+	}
+
+	secretsPath := FmtSecretsPath(*secretsDir, config.Secrets)
+	log.Printf("Loading secrets from %s", secretsPath)
+
+	secrets, err := LoadSecretsFile(secretsPath)
+	if err != nil {
+		logAndDie(fmt.Sprintf("Error loading secrets: %s", err), store, buildId)
+	}
+
+	names := make([]string, 0, len(secrets))
+	for name := range secrets {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+	log.Printf("Adding secrets %v to the build environment", names)
+
+	return secrets
+}
+
+// Mask secrets in kerouac's own log from now on, as configureLogging set it up.
+func redactLogging(logFile *os.File, secrets Secrets) {
+	if len(secrets) == 0 || *dryRun {
+		return
+	}
+
+	writer := io.MultiWriter(os.Stderr, logFile)
+	log.SetOutput(NewRedactor(writer, secrets.Values()))
+}
+
 func logStart(buildId BuildId) {
 	log.Printf("Starting build of %s with tag %s at %s", buildId.Project, buildId.Tag, buildId.DateTime.Format("2006-01-02 15:04:05 (MST)"))
 	log.Printf("Build dir is %s", buildId.FmtBuildDir())
@@ -0,0 +1,90 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"sync"
+	"time"
+)
+
+// A CombinedLog interleaves the output of several streams (e.g. a build
+// script's stdout and stderr) into one log, a line at a time.  Each line is
+// prefixed with the seconds since the log was started and the stream it came
+// from, e.g.:
+//
+//	0.012 stdout Running tests ...
+//	3.456 stderr panic: oops
+//
+// Lines are written in the order they are completed, and stamped with when
+// that was.
+type CombinedLog struct {
+	mutex sync.Mutex
+	w     io.Writer
+	start time.Time
+	// If false, lines are written as they are, e.g. to interleave the stdout
+	// of several concurrent steps into one log without mixing up their lines.
+	stamped bool
+}
+
+func NewCombinedLog(w io.Writer, start time.Time) *CombinedLog {
+	return &CombinedLog{w: w, start: start, stamped: true}
+}
+
+// A CombinedLog without the offsets and stream names.
+func NewInterleavedLog(w io.Writer) *CombinedLog {
+	return &CombinedLog{w: w}
+}
+
+// An io.Writer for one of the streams of a CombinedLog.
+//
+// Call Flush once the stream is finished, to write any incomplete last line.
+type CombinedLogStream struct {
+	log     *CombinedLog
+	stream  string
+	partial []byte
+}
+
+func (c *CombinedLog) Stream(stream string) *CombinedLogStream {
+	return &CombinedLogStream{log: c, stream: stream}
+}
+
+func (c *CombinedLog) writeLine(stream string, line []byte) error {
+	c.mutex.Lock()
+	defer c.mutex.Unlock()
+
+	if !c.stamped {
+		_, err := fmt.Fprintf(c.w, "%s\n", line)
+		return err
+	}
+
+	// time.Since uses the monotonic clock, so the offsets never go backwards.
+	_, err := fmt.Fprintf(c.w, "%10.3f %s %s\n", time.Since(c.start).Seconds(), stream, line)
+	return err
+}
+
+func (s *CombinedLogStream) Write(p []byte) (int, error) {
+	s.partial = append(s.partial, p...)
+
+	for {
+		newline := bytes.IndexByte(s.partial, '\n')
+		if newline < 0 {
+			break
+		}
+		if err := s.log.writeLine(s.stream, s.partial[:newline]); err != nil {
+			return 0, err
+		}
+		s.partial = s.partial[newline+1:]
+	}
+
+	return len(p), nil
+}
+
+func (s *CombinedLogStream) Flush() error {
+	if len(s.partial) == 0 {
+		return nil
+	}
+	line := s.partial
+	s.partial = nil
+	return s.log.writeLine(s.stream, line)
+}
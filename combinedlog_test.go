@@ -0,0 +1,100 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"regexp"
+	"strings"
+	"testing"
+	"time"
+)
+
+// Strip the time offsets, which we can't predict.
+func stripOffsets(combined string) string {
+	return regexp.MustCompile(`(?m)^ *[0-9]+\.[0-9]{3} `).ReplaceAllString(combined, "")
+}
+
+func TestCombinedLog(t *testing.T) {
+	var buf bytes.Buffer
+	combinedLog := NewCombinedLog(&buf, time.Now())
+	stdout := combinedLog.Stream(StdoutStream)
+	stderr := combinedLog.Stream(StderrStream)
+
+	stdout.Write([]byte("one\ntw"))
+	stderr.Write([]byte("oops\n"))
+	stdout.Write([]byte("o\nthree"))
+	stdout.Flush()
+	stderr.Flush()
+
+	expected := "stdout one\nstderr oops\nstdout two\nstdout three\n"
+	if combined := stripOffsets(buf.String()); combined != expected {
+		t.Errorf("Combined log was %q, expected %q", combined, expected)
+	}
+
+	if !regexp.MustCompile(`^ +0\.[0-9]{3} stdout one\n`).MatchString(buf.String()) {
+		t.Errorf("Combined log lines not prefixed with offset: %q", buf.String())
+	}
+}
+
+func TestRunBuildScriptWritesCombinedLog(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "kerouac_combinedlog_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	srcDir, buildId := makeScriptBuild(t, tmpDir, "#!/bin/sh\necho out\necho err >&2\nsleep 0.1\necho out again\n")
+
+	if _, err = RunBuildScript(srcDir, "./build.sh", []string{}, nil, nil, 60, 1, nil, buildId); err != nil {
+		t.Fatal(err)
+	}
+
+	combined, err := ioutil.ReadFile(buildId.FmtCombinedLogPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	// stdout and stderr race each other until the sleep.
+	lines := strings.Split(stripOffsets(string(combined)), "\n")
+	if len(lines) != 4 || lines[2] != "stdout out again" {
+		t.Errorf("Combined log was %q", combined)
+	}
+
+	stdout, err := ioutil.ReadFile(buildId.FmtStdoutLogPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stdout) != "out\nout again\n" {
+		t.Errorf("stdout log was %q", stdout)
+	}
+}
+
+func TestRunBuildScriptStopsCopyingOutput(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "kerouac_combinedlog_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	defer func(timeout time.Duration) { outputDrainTimeout = timeout }(outputDrainTimeout)
+	outputDrainTimeout = 100 * time.Millisecond
+
+	// The sleep keeps the script's stdout open after it exits.
+	srcDir, buildId := makeScriptBuild(t, tmpDir, "#!/bin/sh\necho out\nsleep 5 &\n")
+
+	start := time.Now()
+	if _, err = RunBuildScript(srcDir, "./build.sh", []string{}, nil, nil, 60, 1, nil, buildId); err != nil {
+		t.Fatal(err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("RunBuildScript waited %s for output", elapsed)
+	}
+
+	stdout, err := ioutil.ReadFile(buildId.FmtStdoutLogPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stdout) != "out\n" {
+		t.Errorf("stdout log was %q", stdout)
+	}
+}
@@ -1,55 +1,372 @@
 package main
 
 import (
+	"bytes"
+	"crypto/sha256"
+	"encoding/hex"
 	"encoding/json"
 	"fmt"
-	"os"
+	"io/ioutil"
+	"path"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strconv"
+	"strings"
 )
 
+// A build is either a single BuildScript, or a list of Steps.
 type Config struct {
 	BuildScript     string
 	BuildScriptArgs []string
+	Steps           []Step
 	NumBuildsToKeep int
-	TimeoutInSecs   int
+	// For Steps, the timeout for the whole build, and the default for steps
+	// that don't set their own.  0 means no timeout.
+	TimeoutInSecs         int
+	KillGracePeriodInSecs int
+	// How many Steps may run at once; 0 means one per CPU.
+	MaxParallelSteps int
+	// Environment variables, and the values of each to build with.  Each
+	// combination of values is built as a child build (see ExpandMatrix).
+	Matrix map[string][]string
+	// How many matrix child builds may run at once; 0 means one per CPU.
+	MaxParallelMatrixBuilds int
+	// Variables to set in the build's environment.
+	Env map[string]string
+	// Globs (as for filepath.Match) of the files and dirs in the source dir to
+	// keep in the build's artifacts dir once it's finished.
+	Artifacts []string
+	// Patterns of files and dirs to leave out of the tarball of the source
+	// dir, as for .kerouacignore (see TarballExcluder).
+	TarballExcludes []string
+	// The name of a secrets file in the secrets dir (see FmtSecretsPath), to
+	// add to the build's environment and mask in its logs.
+	Secrets string
+	// The names of kerouac's own environment variables to pass on to the
+	// build, which may be globs like "LC_*".  If not given,
+	// DefaultInheritEnv.  See BuildEnv.
+	InheritEnv []string
+	// Overrides for builds of particular branches, applied in order.
+	Branches []BranchConfig
+	// Don't build at all, just record the build as SKIPPED.  Mostly useful
+	// in Branches.
+	Skip bool
+	// How many of the project's builds a kerouac worker may run at once; 0
+	// means 1.
+	MaxConcurrentBuilds int
+	// Have kerouac worker mark queued builds SUPERSEDED, rather than run
+	// them, once a newer build of the same branch is queued.
+	SupersedeQueued bool
+}
+
+// Overrides of config fields for builds of branches matching Pattern, a glob
+// as for path.Match, where the build's tag is branch@sha (see TagBranch).
+type BranchConfig struct {
+	Pattern string
+	// Each field given replaces the whole of the config's field, as for config
+	// layers (see ConfigLayerPaths).
+	Config ConfigFields
+}
+
+// Top level config fields, by name, as parsed from JSON.
+type ConfigFields map[string]interface{}
+
+// One step of a multi-step build.
+type Step struct {
+	// Unique within the build, and used for the step's logs dir.
+	Name    string
+	Command string
+	Args    []string
+	// 0 means use the config's TimeoutInSecs.
+	TimeoutInSecs int
+	// Relative to the source dir; empty for the source dir itself.
+	WorkingDir string
+	// Carry on with the next step, and don't fail the build, if this one
+	// fails or times out.
+	ContinueOnError bool
+	// The names of the steps that must finish before this one starts.  If no
+	// step has DependsOn, each step depends on the one before it.
+	DependsOn []string
 }
 
 const (
-	DefaultNumBuildsToKeep = 10
-	InvalidTimeoutInSecs   = -1
+	DefaultNumBuildsToKeep       = 10
+	InvalidTimeoutInSecs         = -1
+	DefaultKillGracePeriodInSecs = 10
 )
 
 var DefaultBuildScriptArgs = []string{}
 
-func ParseConfigFile(path string) (*Config, error) {
-	file, err := os.Open(path)
+// The checks ParseConfigFile makes of a parsed config, in order, each
+// returning every problem it finds.
+var configChecks = []func(Config) []error{
+	checkRequiredConfig,
+	checkSteps,
+	checkMatrix,
+	checkEnv,
+	checkArtifacts,
+	checkTarballExcludes,
+	checkBranches,
+}
 
+// Parse the config file at path, in the format for its extension (see
+// configFormat), checking it has what's required and makes sense.
+func ParseConfigFile(path string) (*Config, error) {
+	data, err := readConfigFile(path)
 	if err != nil {
-		return nil, fmt.Errorf("Could not read config file: %s", err)
+		return nil, err
 	}
 
-	config := Config{NumBuildsToKeep: DefaultNumBuildsToKeep, BuildScriptArgs: DefaultBuildScriptArgs, TimeoutInSecs: InvalidTimeoutInSecs}
+	return parseConfigJSON(data)
+}
+
+// Parse and check a config, as ParseConfigFile does, from JSON.
+func parseConfigJSON(data []byte) (*Config, error) {
+	config := defaultConfig()
 
-	decoder := json.NewDecoder(file)
+	decoder := json.NewDecoder(bytes.NewReader(data))
 
-	if err = decoder.Decode(&config); err != nil {
+	if err := decoder.Decode(&config); err != nil {
 		return nil, fmt.Errorf("Error parsing json: %s", err)
 	}
 
-	if err = checkRequiredConfig(config); err != nil {
-		return nil, err
+	for _, check := range configChecks {
+		if errs := check(config); len(errs) > 0 {
+			return nil, errs[0]
+		}
 	}
 
+	applyStepDefaults(&config)
+
 	return &config, nil
 }
 
-func checkRequiredConfig(config Config) error {
+// Read the config file at path, converted to JSON if it's in another format.
+func readConfigFile(path string) ([]byte, error) {
+	data, err := ioutil.ReadFile(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read config file: %s", err)
+	}
+
+	format := configFormat(path)
+	if data, err = configToJSON(format, data); err != nil {
+		return nil, fmt.Errorf("Error parsing %s: %s", format, err)
+	}
+	return data, nil
+}
+
+// The config fields are set to before parsing, for the ones left out.
+func defaultConfig() Config {
+	return Config{NumBuildsToKeep: DefaultNumBuildsToKeep, BuildScriptArgs: DefaultBuildScriptArgs, TimeoutInSecs: InvalidTimeoutInSecs, KillGracePeriodInSecs: DefaultKillGracePeriodInSecs}
+}
+
+func applyStepDefaults(config *Config) {
+	for i := range config.Steps {
+		if config.Steps[i].TimeoutInSecs == 0 {
+			config.Steps[i].TimeoutInSecs = config.TimeoutInSecs
+		}
+	}
+}
+
+// Write config as JSON to path, as ParseConfigFile can read it back,
+// returning the hex SHA-256 of what was written.
+func WriteConfigSnapshot(path string, config *Config) (string, error) {
+	data, err := json.MarshalIndent(config, "", "    ")
+	if err != nil {
+		return "", err
+	}
+	data = append(data, '\n')
+
+	if err = ioutil.WriteFile(path, data, 0600); err != nil {
+		return "", err
+	}
+	hash := sha256.Sum256(data)
+	return hex.EncodeToString(hash[:]), nil
+}
+
+func checkRequiredConfig(config Config) []error {
+	var errs []error
+	if len(config.Steps) > 0 {
+		if config.BuildScript != "" {
+			errs = append(errs, fmt.Errorf("Only one of BuildScript and Steps is allowed in the config."))
+		}
+		return errs
+	}
+
 	if config.BuildScript == "" {
-		return fmt.Errorf("BuildScript is required in the config.")
+		errs = append(errs, fmt.Errorf("BuildScript is required in the config."))
 	}
 
 	if config.TimeoutInSecs == InvalidTimeoutInSecs {
-		return fmt.Errorf("TimeoutInSecs is required in the config.")
+		errs = append(errs, fmt.Errorf("TimeoutInSecs is required in the config."))
 	}
 
-	return nil
+	return errs
+}
+
+// Matrix values end up in tags, and so paths, so keep them tame too.
+var (
+	envVarNameRegexp  = regexp.MustCompile(`^[A-Za-z_][A-Za-z0-9_]*$`)
+	matrixValueRegexp = regexp.MustCompile(`^[A-Za-z0-9_.+-]+$`)
+)
+
+func checkMatrix(config Config) []error {
+	var errs []error
+	names := make([]string, 0, len(config.Matrix))
+	for name := range config.Matrix {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		values := config.Matrix[name]
+		if !envVarNameRegexp.MatchString(name) {
+			errs = append(errs, fmt.Errorf("Matrix variable %q is not a valid environment variable name.", name))
+		}
+		if strings.HasPrefix(name, KerouacEnvPrefix) {
+			errs = append(errs, fmt.Errorf("Matrix variable %s can't start with %s, those are set by kerouac.", name, KerouacEnvPrefix))
+		}
+		if len(values) == 0 {
+			errs = append(errs, fmt.Errorf("Matrix variable %s needs at least one value.", name))
+		}
+		seen := make(map[string]bool)
+		for _, value := range values {
+			if !matrixValueRegexp.MatchString(value) {
+				errs = append(errs, fmt.Errorf("Matrix value %q for %s must be made of letters, digits, _, ., + and -.", value, name))
+			}
+			if seen[value] {
+				errs = append(errs, fmt.Errorf("Matrix value %s for %s is given more than once.", value, name))
+			}
+			seen[value] = true
+		}
+	}
+
+	if config.MaxParallelMatrixBuilds < 0 {
+		errs = append(errs, fmt.Errorf("MaxParallelMatrixBuilds can't be negative."))
+	}
+
+	return errs
+}
+
+func checkEnv(config Config) []error {
+	var errs []error
+	names := make([]string, 0, len(config.Env))
+	for name := range config.Env {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	for _, name := range names {
+		if !envVarNameRegexp.MatchString(name) {
+			errs = append(errs, fmt.Errorf("Env variable %q is not a valid environment variable name.", name))
+		}
+		if strings.HasPrefix(name, KerouacEnvPrefix) {
+			errs = append(errs, fmt.Errorf("Env variable %s can't start with %s, those are set by kerouac.", name, KerouacEnvPrefix))
+		}
+	}
+
+	if config.Secrets != "" && !stepNameRegexp.MatchString(config.Secrets) {
+		errs = append(errs, fmt.Errorf("Secrets must be the name of a file in the secrets dir, not %q.", config.Secrets))
+	}
+
+	for _, pattern := range config.InheritEnv {
+		if _, err := filepath.Match(pattern, ""); err != nil || pattern == "" {
+			errs = append(errs, fmt.Errorf("InheritEnv entry %q is not a valid name or glob.", pattern))
+		}
+	}
+
+	return errs
+}
+
+func checkTarballExcludes(config Config) []error {
+	var errs []error
+	for _, pattern := range config.TarballExcludes {
+		trimmed := strings.Trim(pattern, "/")
+		if _, err := path.Match(trimmed, ""); err != nil || trimmed == "" {
+			errs = append(errs, fmt.Errorf("TarballExcludes pattern %q is not a valid glob.", pattern))
+		}
+	}
+	return errs
+}
+
+func checkArtifacts(config Config) []error {
+	var errs []error
+	for _, pattern := range config.Artifacts {
+		if _, err := filepath.Match(pattern, ""); err != nil || pattern == "" {
+			errs = append(errs, fmt.Errorf("Artifacts pattern %q is not a valid glob.", pattern))
+		}
+		if clean := filepath.Clean(pattern); filepath.IsAbs(clean) || clean == ".." || strings.HasPrefix(clean, "../") {
+			errs = append(errs, fmt.Errorf("Artifacts pattern %s must be inside the source dir.", pattern))
+		}
+	}
+	return errs
+}
+
+func checkBranches(config Config) []error {
+	var errs []error
+	for _, branch := range config.Branches {
+		if _, err := path.Match(branch.Pattern, ""); err != nil || branch.Pattern == "" {
+			errs = append(errs, fmt.Errorf("Branches pattern %q is not a valid glob.", branch.Pattern))
+		}
+
+		for name := range branch.Config {
+			if strings.EqualFold(name, "Branches") {
+				errs = append(errs, fmt.Errorf("Branches pattern %s can't override Branches.", branch.Pattern))
+			}
+		}
+
+		// So a bad override is found whichever branch is built.
+		data, err := json.Marshal(branch.Config)
+		if err == nil {
+			err = json.Unmarshal(data, &Config{})
+		}
+		if err != nil {
+			errs = append(errs, fmt.Errorf("Branches pattern %s has a bad Config: %s", branch.Pattern, err))
+		}
+	}
+	return errs
+}
+
+// Step names end up in paths, so keep them tame.
+var stepNameRegexp = regexp.MustCompile(`^[A-Za-z0-9_][A-Za-z0-9_.-]*$`)
+
+func checkSteps(config Config) []error {
+	var errs []error
+	names := make(map[string]bool)
+
+	for i, step := range config.Steps {
+		if !stepNameRegexp.MatchString(step.Name) {
+			errs = append(errs, fmt.Errorf("Step %d needs a Name made of letters, digits, _, . and -, not %q.", i+1, step.Name))
+			// So the step's other problems say which it is.
+			step.Name = strconv.Itoa(i + 1)
+		} else if names[step.Name] {
+			errs = append(errs, fmt.Errorf("Step name %s is used more than once.", step.Name))
+		}
+		names[step.Name] = true
+
+		if step.Command == "" {
+			errs = append(errs, fmt.Errorf("Command is required for step %s.", step.Name))
+		}
+
+		if step.TimeoutInSecs == 0 && config.TimeoutInSecs == InvalidTimeoutInSecs {
+			errs = append(errs, fmt.Errorf("TimeoutInSecs is required in the config or for step %s.", step.Name))
+		}
+		if step.TimeoutInSecs < 0 {
+			errs = append(errs, fmt.Errorf("TimeoutInSecs for step %s can't be negative.", step.Name))
+		}
+
+		if workingDir := filepath.Clean(step.WorkingDir); filepath.IsAbs(workingDir) || workingDir == ".." || strings.HasPrefix(workingDir, "../") {
+			errs = append(errs, fmt.Errorf("WorkingDir for step %s must be inside the source dir, not %s.", step.Name, step.WorkingDir))
+		}
+	}
+
+	if config.MaxParallelSteps < 0 {
+		errs = append(errs, fmt.Errorf("MaxParallelSteps can't be negative."))
+	}
+
+	if _, err := stepDependencies(config.Steps); err != nil {
+		errs = append(errs, err)
+	}
+	return errs
 }
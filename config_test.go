@@ -1,6 +1,9 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
 	"reflect"
 	"testing"
 )
@@ -67,6 +70,10 @@ func TestDefaultsOnNonRequired(t *testing.T) {
 	if !reflect.DeepEqual(config.BuildScriptArgs, DefaultBuildScriptArgs) {
 		t.Errorf("Did not use default BuildScriptArgs: %+v", config)
 	}
+
+	if config.KillGracePeriodInSecs != DefaultKillGracePeriodInSecs {
+		t.Errorf("Did not use default KillGracePeriodInSecs: %+v", config)
+	}
 }
 
 func TestRequiredConfig(t *testing.T) {
@@ -111,4 +118,171 @@ func assertExpectedConfig(config *Config, t *testing.T, context string) {
 	if config.TimeoutInSecs != 30 {
 		t.Errorf("%s wrong timeout in secs %+v", context, config)
 	}
+
+	if config.KillGracePeriodInSecs != 5 {
+		t.Errorf("%s wrong kill grace period in secs %+v", context, config)
+	}
+}
+
+func TestConfigParsesSteps(t *testing.T) {
+	config, err := ParseConfigFile("testfiles/good_steps_config.json")
+	if err != nil {
+		t.Fatalf("Err was non-nil on good steps config, %s", err)
+	}
+
+	expected := []Step{
+		{Name: "setup", Command: "./setup.sh", TimeoutInSecs: 30},
+		{Name: "lint", Command: "make", Args: []string{"lint"}, TimeoutInSecs: 60, ContinueOnError: true},
+		{Name: "test", Command: "go", Args: []string{"test", "./..."}, TimeoutInSecs: 30, WorkingDir: "src"},
+	}
+	if !reflect.DeepEqual(config.Steps, expected) {
+		t.Errorf("Steps parsed as %+v not %+v", config.Steps, expected)
+	}
+}
+
+func TestBadSteps(t *testing.T) {
+	for _, path := range []string{
+		"testfiles/steps_and_build_script.json",
+		"testfiles/steps_with_duplicate_names.json",
+		"testfiles/steps_with_bad_name.json",
+		"testfiles/steps_missing_timeout.json",
+		"testfiles/steps_with_escaping_dir.json",
+		"testfiles/steps_with_cycle.json",
+	} {
+		if config, err := ParseConfigFile(path); err == nil {
+			t.Errorf("No error for %s, returned %+v", path, config)
+		}
+	}
+}
+
+func TestBadBranches(t *testing.T) {
+	for _, path := range []string{
+		"testfiles/branches_with_bad_pattern.json",
+		"testfiles/branches_overriding_branches.json",
+		"testfiles/branches_with_bad_config.json",
+	} {
+		if config, err := ParseConfigFile(path); err == nil {
+			t.Errorf("No error for %s, returned %+v", path, config)
+		}
+	}
+}
+
+func TestConfigParsesStepDependencies(t *testing.T) {
+	config, err := ParseConfigFile("testfiles/good_dag_config.json")
+	if err != nil {
+		t.Fatalf("Err was non-nil on good dag config, %s", err)
+	}
+
+	if config.MaxParallelSteps != 2 {
+		t.Errorf("Wrong MaxParallelSteps %+v", config)
+	}
+
+	if dependsOn := config.Steps[3].DependsOn; !reflect.DeepEqual(dependsOn, []string{"lint", "test"}) {
+		t.Errorf("package step depends on %v", dependsOn)
+	}
+}
+
+func TestConfigSnapshotRoundTrips(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "kerouac_config_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for _, path := range []string{
+		"testfiles/good_json_only_required.json",
+		"testfiles/good_steps_config.json",
+		"testfiles/good_matrix_config.json",
+		"testfiles/good_env_config.json",
+		"testfiles/good_branches_config.json",
+	} {
+		config, err := ParseConfigFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		snapshotPath := filepath.Join(tmpDir, ConfigSnapshotName)
+		configHash, err := WriteConfigSnapshot(snapshotPath, config)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if fileHash, err := hashFile(snapshotPath); err != nil || fileHash != configHash {
+			t.Errorf("Snapshot of %s has hash %s, returned %s", path, fileHash, configHash)
+		}
+
+		snapshot, err := ParseConfigFile(snapshotPath)
+		if err != nil {
+			t.Fatalf("Error parsing snapshot of %s: %s", path, err)
+		}
+		if !reflect.DeepEqual(snapshot, config) {
+			t.Errorf("Snapshot of %s parsed as %+v not %+v", path, snapshot, config)
+		}
+	}
+}
+
+func TestConfigParsesMatrix(t *testing.T) {
+	config, err := ParseConfigFile("testfiles/good_matrix_config.json")
+	if err != nil {
+		t.Fatalf("Err was non-nil on good matrix config, %s", err)
+	}
+
+	expected := map[string][]string{"GOOS": {"linux", "darwin"}, "GOVERSION": {"1.19", "1.20"}}
+	if !reflect.DeepEqual(config.Matrix, expected) {
+		t.Errorf("Matrix was %v not %v", config.Matrix, expected)
+	}
+
+	if config.MaxParallelMatrixBuilds != 2 {
+		t.Errorf("Wrong MaxParallelMatrixBuilds %+v", config)
+	}
+}
+
+func TestBadMatrix(t *testing.T) {
+	for _, path := range []string{
+		"testfiles/matrix_with_bad_name.json",
+		"testfiles/matrix_with_bad_value.json",
+		"testfiles/matrix_without_values.json",
+	} {
+		if config, err := ParseConfigFile(path); err == nil {
+			t.Errorf("No error for %s, returned %+v", path, config)
+		}
+	}
+}
+
+func TestConfigParsesEnvSecretsAndArtifacts(t *testing.T) {
+	config, err := ParseConfigFile("testfiles/good_env_config.json")
+	if err != nil {
+		t.Fatalf("Err was non-nil on good env config, %s", err)
+	}
+
+	if expected := map[string]string{"GOFLAGS": "-mod=vendor", "CGO_ENABLED": "0"}; !reflect.DeepEqual(config.Env, expected) {
+		t.Errorf("Env was %v not %v", config.Env, expected)
+	}
+	if expected := []string{"PATH", "GO*"}; !reflect.DeepEqual(config.InheritEnv, expected) {
+		t.Errorf("InheritEnv was %v not %v", config.InheritEnv, expected)
+	}
+	if config.Secrets != "deploy" {
+		t.Errorf("Secrets was %q", config.Secrets)
+	}
+	if expected := []string{"dist/*.deb", "coverage"}; !reflect.DeepEqual(config.Artifacts, expected) {
+		t.Errorf("Artifacts were %v not %v", config.Artifacts, expected)
+	}
+	if expected := []string{".git", "node_modules/"}; !reflect.DeepEqual(config.TarballExcludes, expected) {
+		t.Errorf("TarballExcludes were %v not %v", config.TarballExcludes, expected)
+	}
+}
+
+func TestBadEnv(t *testing.T) {
+	for _, path := range []string{
+		"testfiles/env_with_kerouac_var.json",
+		"testfiles/env_with_bad_name.json",
+		"testfiles/inherit_env_with_bad_glob.json",
+		"testfiles/config_with_bad_secrets_name.json",
+		"testfiles/artifacts_outside_src_dir.json",
+		"testfiles/artifacts_with_bad_glob.json",
+		"testfiles/tarball_excludes_with_bad_glob.json",
+	} {
+		if config, err := ParseConfigFile(path); err == nil {
+			t.Errorf("No error for %s, returned %+v", path, config)
+		}
+	}
 }
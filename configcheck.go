@@ -0,0 +1,294 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"os"
+	"os/exec"
+	"path/filepath"
+	"reflect"
+	"strings"
+)
+
+// A problem CheckConfigFile found with a config.  If it's with one of the
+// config's layers (see ConfigLayerPaths), Path is that file, and if it's at a
+// particular place in it, Line and Column (from 1) are where, or 0 if not.
+type ConfigProblem struct {
+	Path    string
+	Line    int
+	Column  int
+	Message string
+}
+
+func (p ConfigProblem) Error() string {
+	if p.Path == "" {
+		return p.Message
+	}
+	if p.Line == 0 {
+		return fmt.Sprintf("%s: %s", p.Path, p.Message)
+	}
+	return fmt.Sprintf("%s:%d:%d: %s", p.Path, p.Line, p.Column, p.Message)
+}
+
+// Parse the config file at path as ParseConfigFile does, but strictly,
+// returning every problem found rather than the first.  As well as
+// ParseConfigFile's checks, fields the config doesn't have, out of range
+// numbers, and a BuildScript or step Commands that aren't executable files
+// (relative to srcDir, or on the PATH, as they'd be run) are problems.
+//
+// The config is nil if there are any problems.
+func CheckConfigFile(srcDir string, path string) (*Config, []ConfigProblem) {
+	return CheckConfigFiles(srcDir, []string{path}, "")
+}
+
+// As CheckConfigFile, for the config of a build with tag merged from the
+// layers at paths (see ParseLayeredConfig).
+func CheckConfigFiles(srcDir string, paths []string, tag string) (*Config, []ConfigProblem) {
+	var problems []ConfigProblem
+	unmarshalled := true
+	for _, path := range paths {
+		layerProblems, ok := checkConfigLayer(path)
+		problems = append(problems, layerProblems...)
+		unmarshalled = unmarshalled && ok
+	}
+	if !unmarshalled {
+		return nil, problems
+	}
+
+	// Every layer unmarshals, so the merged config will too.
+	data, _, err := mergeConfigFiles(paths, tag)
+	if err != nil {
+		return nil, append(problems, ConfigProblem{Message: err.Error()})
+	}
+	config := defaultConfig()
+	if err = json.Unmarshal(data, &config); err != nil {
+		return nil, append(problems, ConfigProblem{Message: err.Error()})
+	}
+
+	for _, check := range configChecks {
+		for _, err = range check(config) {
+			problems = append(problems, ConfigProblem{Message: err.Error()})
+		}
+	}
+	for _, err = range checkRanges(config) {
+		problems = append(problems, ConfigProblem{Message: err.Error()})
+	}
+	for _, err = range checkCommands(srcDir, config) {
+		problems = append(problems, ConfigProblem{Message: err.Error()})
+	}
+
+	if len(problems) > 0 {
+		return nil, problems
+	}
+
+	applyStepDefaults(&config)
+	return &config, nil
+}
+
+// Problems with the config layer at path on its own: the fields it has that
+// a config doesn't, or if it can't be read or unmarshalled into a Config,
+// why, and false.  Problems are only positioned in JSON files, as others are
+// checked once converted to JSON.
+func checkConfigLayer(path string) ([]ConfigProblem, bool) {
+	positioned := func(problem ConfigProblem) ConfigProblem {
+		problem.Path = path
+		if configFormat(path) != "json" {
+			problem.Line = 0
+			problem.Column = 0
+		}
+		return problem
+	}
+
+	data, err := readConfigFile(path)
+	if err != nil {
+		return []ConfigProblem{{Path: path, Message: err.Error()}}, false
+	}
+
+	config := defaultConfig()
+	if err = json.Unmarshal(data, &config); err != nil {
+		return []ConfigProblem{positioned(jsonProblem(data, err))}, false
+	}
+
+	problems := findUnknownFields(data, 0, reflect.TypeOf(config), "")
+	for i := range problems {
+		problems[i] = positioned(problems[i])
+	}
+	return problems, true
+}
+
+// Numbers ParseConfigFile lets through, but which make no sense.
+func checkRanges(config Config) []error {
+	var errs []error
+	if config.TimeoutInSecs < 0 && config.TimeoutInSecs != InvalidTimeoutInSecs {
+		errs = append(errs, fmt.Errorf("TimeoutInSecs can't be negative."))
+	}
+	if config.KillGracePeriodInSecs < 0 {
+		errs = append(errs, fmt.Errorf("KillGracePeriodInSecs can't be negative."))
+	}
+	if config.MaxConcurrentBuilds < 0 {
+		errs = append(errs, fmt.Errorf("MaxConcurrentBuilds can't be negative."))
+	}
+	// Keeping none would remove the build that's just finished.
+	if config.NumBuildsToKeep < 1 {
+		errs = append(errs, fmt.Errorf("NumBuildsToKeep must be at least 1."))
+	}
+	return errs
+}
+
+func checkCommands(srcDir string, config Config) []error {
+	var errs []error
+	if config.BuildScript != "" {
+		if err := checkExecutable(srcDir, config.BuildScript); err != nil {
+			errs = append(errs, fmt.Errorf("BuildScript %s: %s", config.BuildScript, err))
+		}
+	}
+	for _, step := range config.Steps {
+		if step.Command == "" {
+			continue
+		}
+		if err := checkExecutable(filepath.Join(srcDir, step.WorkingDir), step.Command); err != nil {
+			errs = append(errs, fmt.Errorf("Command %s for step %s: %s", step.Command, step.Name, err))
+		}
+	}
+	return errs
+}
+
+// Check command would run in dir: as for exec.Command, a command without a
+// slash is looked for on the PATH, and one with a slash is relative to dir.
+func checkExecutable(dir string, command string) error {
+	if !strings.Contains(command, "/") {
+		_, err := exec.LookPath(command)
+		return err
+	}
+
+	path := command
+	if !filepath.IsAbs(path) {
+		path = filepath.Join(dir, path)
+	}
+
+	info, err := os.Stat(path)
+	if err != nil {
+		return err
+	}
+	if !info.Mode().IsRegular() {
+		return fmt.Errorf("%s is not a regular file", path)
+	}
+	if info.Mode().Perm()&0111 == 0 {
+		return fmt.Errorf("%s is not executable", path)
+	}
+	return nil
+}
+
+// A problem for an error from json.Unmarshal of data, positioned if the error
+// says where it is.
+func jsonProblem(data []byte, err error) ConfigProblem {
+	var offset int64
+	switch jsonErr := err.(type) {
+	case *json.SyntaxError:
+		offset = jsonErr.Offset
+	case *json.UnmarshalTypeError:
+		offset = jsonErr.Offset
+	default:
+		return ConfigProblem{Message: fmt.Sprintf("Error parsing json: %s", err)}
+	}
+
+	line, column := offsetPosition(data, offset)
+	return ConfigProblem{Line: line, Column: column, Message: fmt.Sprintf("Error parsing json: %s", err)}
+}
+
+// The line and column, from 1, of offset in data.
+func offsetPosition(data []byte, offset int64) (int, int) {
+	if offset > int64(len(data)) {
+		offset = int64(len(data))
+	}
+	before := data[:offset]
+	line := bytes.Count(before, []byte("\n")) + 1
+	column := len(before) - bytes.LastIndexByte(before, '\n')
+	return line, column
+}
+
+// Problems for each key of the JSON value at offset in data that
+// json.Unmarshal into a t would ignore, as it isn't a field of the struct
+// being set.  The value must already have been unmarshalled into a t.  name
+// is where the value is in the config, for the messages.
+func findUnknownFields(data []byte, offset int64, t reflect.Type, name string) []ConfigProblem {
+	if t == reflect.TypeOf(ConfigFields{}) {
+		t = reflect.TypeOf(Config{})
+	}
+	offset = skipJSONSeparators(data, offset)
+	value := data[offset:]
+	if bytes.HasPrefix(value, []byte("null")) {
+		return nil
+	}
+
+	var problems []ConfigProblem
+	decoder := json.NewDecoder(bytes.NewReader(value))
+	// Where the decoder's next token is in data.
+	next := func() int64 {
+		return skipJSONSeparators(data, offset+decoder.InputOffset())
+	}
+
+	switch t.Kind() {
+	case reflect.Struct, reflect.Map:
+		decoder.Token()
+		for decoder.More() {
+			keyOffset := next()
+			token, _ := decoder.Token()
+			key, _ := token.(string)
+
+			elemOffset := next()
+			var elem json.RawMessage
+			if err := decoder.Decode(&elem); err != nil {
+				return problems
+			}
+
+			if t.Kind() == reflect.Map {
+				problems = append(problems, findUnknownFields(data, elemOffset, t.Elem(), joinFieldName(name, key))...)
+			} else if field, ok := configField(t, key); ok {
+				problems = append(problems, findUnknownFields(data, elemOffset, field.Type, joinFieldName(name, field.Name))...)
+			} else {
+				line, column := offsetPosition(data, keyOffset)
+				problems = append(problems, ConfigProblem{Line: line, Column: column, Message: fmt.Sprintf("Unknown field %s.", joinFieldName(name, key))})
+			}
+		}
+	case reflect.Slice:
+		decoder.Token()
+		for i := 0; decoder.More(); i++ {
+			elemOffset := next()
+			var elem json.RawMessage
+			if err := decoder.Decode(&elem); err != nil {
+				return problems
+			}
+			problems = append(problems, findUnknownFields(data, elemOffset, t.Elem(), fmt.Sprintf("%s[%d]", name, i))...)
+		}
+	}
+
+	return problems
+}
+
+// The field of struct type t that json.Unmarshal would set for key.
+func configField(t reflect.Type, key string) (reflect.StructField, bool) {
+	for i := 0; i < t.NumField(); i++ {
+		if field := t.Field(i); strings.EqualFold(field.Name, key) {
+			return field, true
+		}
+	}
+	return reflect.StructField{}, false
+}
+
+func joinFieldName(name string, field string) string {
+	if name == "" {
+		return field
+	}
+	return name + "." + field
+}
+
+// The offset of the next token in data at or after offset, skipping white
+// space and the separators that json.Decoder.Token doesn't return.
+func skipJSONSeparators(data []byte, offset int64) int64 {
+	for offset < int64(len(data)) && strings.IndexByte(" \t\r\n,:", data[offset]) >= 0 {
+		offset++
+	}
+	return offset
+}
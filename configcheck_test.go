@@ -0,0 +1,157 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+// A temp source dir with an executable build.sh in it.
+func makeCheckSrcDir(t *testing.T) string {
+	srcDir, err := ioutil.TempDir("", "kerouac_configcheck_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(srcDir, "build.sh"), []byte("#!/bin/sh\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+	return srcDir
+}
+
+func TestCheckConfigFileAcceptsGoodConfig(t *testing.T) {
+	srcDir := makeCheckSrcDir(t)
+	defer os.RemoveAll(srcDir)
+
+	config, problems := CheckConfigFile(srcDir, "testfiles/strict_good_config.json")
+	if len(problems) > 0 {
+		t.Fatalf("Problems with a good config: %v", problems)
+	}
+
+	expected, err := ParseConfigFile("testfiles/strict_good_config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(config, expected) {
+		t.Errorf("Checked config was %+v not %+v", config, expected)
+	}
+}
+
+func TestCheckConfigFileReportsEveryProblem(t *testing.T) {
+	config, problems := CheckConfigFile(".", "testfiles/strict_config_with_problems.json")
+	if config != nil {
+		t.Errorf("Config with problems returned %+v", config)
+	}
+
+	if len(problems) != 4 {
+		t.Fatalf("Expected 4 problems, got %v", problems)
+	}
+	if expected := (ConfigProblem{Path: "testfiles/strict_config_with_problems.json", Line: 7, Column: 5, Message: "Unknown field Timeout."}); problems[0] != expected {
+		t.Errorf("Unknown field reported as %+v not %+v", problems[0], expected)
+	}
+	for i, message := range []string{"TimeoutInSecs can't be negative.", "NumBuildsToKeep must be at least 1."} {
+		if problems[i+1].Message != message || problems[i+1].Line != 0 {
+			t.Errorf("Problem %d was %+v not %q", i+1, problems[i+1], message)
+		}
+	}
+	if problems[3].Line != 0 || problems[3].Message[:31] != "BuildScript ./no_such_script.sh" {
+		t.Errorf("Missing build script reported as %+v", problems[3])
+	}
+}
+
+func TestCheckConfigFileFindsNestedUnknownFields(t *testing.T) {
+	srcDir := makeCheckSrcDir(t)
+	defer os.RemoveAll(srcDir)
+	os.Rename(filepath.Join(srcDir, "build.sh"), filepath.Join(srcDir, "setup.sh"))
+
+	_, problems := CheckConfigFile(srcDir, "testfiles/strict_steps_with_unknown_fields.json")
+	expected := []ConfigProblem{{Path: "testfiles/strict_steps_with_unknown_fields.json", Line: 4, Column: 51, Message: "Unknown field Steps[1].DependOn."}}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("Problems were %v not %v", problems, expected)
+	}
+
+	os.Chmod(filepath.Join(srcDir, "setup.sh"), 0600)
+	if _, problems = CheckConfigFile(srcDir, "testfiles/strict_steps_with_unknown_fields.json"); len(problems) != 3 {
+		t.Errorf("Expected an unknown field and 2 unexecutable commands, got %v", problems)
+	}
+}
+
+func TestCheckConfigFilePositionsJsonErrors(t *testing.T) {
+	_, problems := CheckConfigFile(".", "testfiles/bad_json_config.json")
+	if len(problems) != 1 || problems[0].Line != 2 || problems[0].Column != 6 {
+		t.Errorf("Bad json reported as %v", problems)
+	}
+
+	_, problems = CheckConfigFile(".", "testfiles/not_a_json_file.json")
+	if len(problems) != 1 || problems[0].Line != 0 {
+		t.Errorf("Missing file reported as %v", problems)
+	}
+}
+
+func TestCheckConfigFileAcceptsSnapshots(t *testing.T) {
+	srcDir := makeCheckSrcDir(t)
+	defer os.RemoveAll(srcDir)
+
+	config, err := ParseConfigFile("testfiles/strict_good_config.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	snapshotPath := filepath.Join(srcDir, ConfigSnapshotName)
+	if _, err = WriteConfigSnapshot(snapshotPath, config); err != nil {
+		t.Fatal(err)
+	}
+
+	if _, problems := CheckConfigFile(srcDir, snapshotPath); len(problems) > 0 {
+		t.Errorf("Problems with a config snapshot: %v", problems)
+	}
+}
+
+func TestCheckConfigFileChecksYaml(t *testing.T) {
+	srcDir := makeCheckSrcDir(t)
+	defer os.RemoveAll(srcDir)
+
+	path := filepath.Join(srcDir, "kerouac.yaml")
+	ioutil.WriteFile(path, []byte("BuildScript: ./build.sh\nTimeoutInSecs: 30\nTimeout: 30\n"), 0600)
+
+	_, problems := CheckConfigFile(srcDir, path)
+	expected := []ConfigProblem{{Path: path, Message: "Unknown field Timeout."}}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("Problems were %v not %v", problems, expected)
+	}
+}
+
+func TestCheckConfigFileReportsEveryProblemOfEachCheck(t *testing.T) {
+	_, problems := CheckConfigFile(".", "testfiles/strict_steps_with_problems.json")
+
+	var messages []string
+	for _, problem := range problems {
+		messages = append(messages, problem.Message)
+	}
+	expected := []string{
+		`Step 1 needs a Name made of letters, digits, _, . and -, not "bad name".`,
+		"Command is required for step build.",
+		"TimeoutInSecs for step test can't be negative.",
+		"Step name test is used more than once.",
+		`Env variable "GO-OS" is not a valid environment variable name.`,
+		"Env variable KEROUAC_TAG can't start with KEROUAC_, those are set by kerouac.",
+	}
+	if !reflect.DeepEqual(messages, expected) {
+		t.Errorf("Problems were %q not %q", messages, expected)
+	}
+}
+
+func TestCheckConfigFilesReportsEveryBadLayer(t *testing.T) {
+	srcDir := makeCheckSrcDir(t)
+	defer os.RemoveAll(srcDir)
+
+	defaultsPath := filepath.Join(srcDir, DefaultsConfigName)
+	ioutil.WriteFile(defaultsPath, []byte(`{"NumBuildsToKeep": "ten"}`), 0600)
+	configPath := filepath.Join(srcDir, "kerouac.json")
+	ioutil.WriteFile(configPath, []byte(`{"BuildScript": "./build.sh", "TimeoutInSecs": "30"}`), 0600)
+
+	_, problems := CheckConfigFiles(srcDir, []string{defaultsPath, configPath}, "")
+	if len(problems) != 2 || problems[0].Path != defaultsPath || problems[1].Path != configPath {
+		t.Errorf("Expected a problem with each layer, got %v", problems)
+	}
+}
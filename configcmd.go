@@ -0,0 +1,133 @@
+package main
+
+import (
+	"encoding/json"
+	"flag"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"reflect"
+	"text/tabwriter"
+)
+
+func DoConfigCommand() {
+	flag.Usage = func() {
+		fmt.Printf("Usage: kerouac config check [options] [<kerouacRootDir> <project>] <srcDir> <configFile> [tag]\n")
+		fmt.Printf("       kerouac config show [options] <kerouacRootDir> <project> <configFile> [tag]\n\n")
+		fmt.Printf("check: Checks configFile strictly, as for building srcDir with it, and prints every problem\n")
+		fmt.Printf("found to stdout.  Exits 1 if there were any, and prints nothing and exits 0 if not.  With a\n")
+		fmt.Printf("kerouac root and project, the root's %s and %s/<project>.json are checked too,\n", DefaultsConfigName, ProjectsDir)
+		fmt.Printf("and configFile layered on them, as kerouac build would.\n\n")
+		fmt.Printf("show: Prints the config a build of project with configFile would use, merged from the\n")
+		fmt.Printf("kerouac root's %s, %s/<project>.json and configFile, with the file each field\n", DefaultsConfigName, ProjectsDir)
+		fmt.Printf("was set by.\n\n")
+		fmt.Printf("With a tag, both use the config for a build with that tag, with the Branches that match it applied.\n\n")
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if len(flag.Args()) < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	switch flag.Arg(0) {
+	case "check":
+		doConfigCheck(flag.Args()[1:])
+	case "show":
+		doConfigShow(flag.Args()[1:])
+	default:
+		flag.Usage()
+		os.Exit(1)
+	}
+}
+
+func doConfigCheck(args []string) {
+	if len(args) < 2 || len(args) > 5 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	var kerouacRoot, project string
+	if len(args) >= 4 {
+		kerouacRoot = args[0]
+		project = args[1]
+		args = args[2:]
+	}
+
+	srcDir := args[0]
+	configFile := args[1]
+	var tag string
+	if len(args) == 3 {
+		tag = args[2]
+	}
+
+	layers := []string{configFile}
+	if kerouacRoot != "" {
+		layers = ConfigLayerPaths(kerouacRoot, project, configFile)
+	}
+
+	_, problems := CheckConfigFiles(srcDir, layers, tag)
+	// file:line:col: message, as compilers do, so editors can jump to them.
+	for _, problem := range problems {
+		if problem.Path == "" {
+			problem.Path = configFile
+		}
+		fmt.Println(problem)
+	}
+
+	if len(problems) > 0 {
+		os.Exit(1)
+	}
+}
+
+func doConfigShow(args []string) {
+	if len(args) < 3 || len(args) > 4 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	kerouacRoot := args[0]
+	project := args[1]
+	configFile := args[2]
+	var tag string
+	if len(args) == 4 {
+		tag = args[3]
+	}
+
+	config, origins, err := ParseLayeredConfig(kerouacRoot, project, tag, configFile)
+	if err != nil {
+		log.Fatalf("Error parsing config: %s", err)
+	}
+
+	if err = writeConfigOrigins(os.Stdout, config, origins); err != nil {
+		log.Fatal(err)
+	}
+}
+
+// Write each field of config to w, one per line as JSON, with where it was set
+// from origins, or DefaultOrigin.
+func writeConfigOrigins(w io.Writer, config *Config, origins map[string]string) error {
+	table := tabwriter.NewWriter(w, 0, 8, 2, ' ', 0)
+
+	value := reflect.ValueOf(*config)
+	for i := 0; i < value.NumField(); i++ {
+		name := value.Type().Field(i).Name
+
+		encoded, err := json.Marshal(value.Field(i).Interface())
+		if err != nil {
+			return err
+		}
+
+		origin, ok := origins[name]
+		if !ok {
+			origin = DefaultOrigin
+		}
+
+		fmt.Fprintf(table, "%s\t%s\t%s\n", name, encoded, origin)
+	}
+
+	return table.Flush()
+}
@@ -0,0 +1,59 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"path/filepath"
+	"strings"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+// Config files are JSON, YAML or TOML, by extension.  The others are
+// converted to JSON before parsing, so every format is defaulted and checked
+// identically.  Files with any other extension are taken to be JSON.
+var configFormats = map[string]string{
+	".json": "json",
+	".yaml": "yaml",
+	".yml":  "yaml",
+	".toml": "toml",
+}
+
+// The format of the config file at path, from its extension.
+func configFormat(path string) string {
+	if format, ok := configFormats[strings.ToLower(filepath.Ext(path))]; ok {
+		return format
+	}
+	return "json"
+}
+
+// Convert data, the contents of a config file in format, to JSON.
+func configToJSON(format string, data []byte) ([]byte, error) {
+	var parsed interface{}
+
+	switch format {
+	case "yaml":
+		if err := yaml.Unmarshal(data, &parsed); err != nil {
+			return nil, err
+		}
+		// An empty file is an empty config, as an empty JSON object would be.
+		if parsed == nil {
+			parsed = map[string]interface{}{}
+		}
+	case "toml":
+		table := make(map[string]interface{})
+		if _, err := toml.Decode(string(data), &table); err != nil {
+			return nil, err
+		}
+		parsed = table
+	default:
+		return data, nil
+	}
+
+	converted, err := json.Marshal(parsed)
+	if err != nil {
+		return nil, fmt.Errorf("can't be converted to a config: %s", err)
+	}
+	return converted, nil
+}
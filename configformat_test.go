@@ -0,0 +1,125 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/BurntSushi/toml"
+	"gopkg.in/yaml.v3"
+)
+
+func TestConfigParsesGoodYaml(t *testing.T) {
+	config, err := ParseConfigFile("testfiles/good_yaml_config.yaml")
+	if err != nil {
+		t.Fatalf("Err was non-nil on good yaml file, %s", err)
+	}
+	assertExpectedConfig(config, t, "good yaml config")
+}
+
+func TestConfigParsesGoodToml(t *testing.T) {
+	config, err := ParseConfigFile("testfiles/good_toml_config.toml")
+	if err != nil {
+		t.Fatalf("Err was non-nil on good toml file, %s", err)
+	}
+	assertExpectedConfig(config, t, "good toml config")
+}
+
+func TestConfigFormat(t *testing.T) {
+	for path, expected := range map[string]string{
+		"kerouac.json":  "json",
+		"kerouac.yaml":  "yaml",
+		"kerouac.YML":   "yaml",
+		"kerouac.toml":  "toml",
+		"kerouac.conf":  "json",
+		"kerouac":       "json",
+		"dir.yaml/conf": "json",
+	} {
+		if format := configFormat(path); format != expected {
+			t.Errorf("Format of %s was %s not %s", path, format, expected)
+		}
+	}
+}
+
+func TestConfigBarfsOnBadYamlAndToml(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "kerouac_configformat_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	for name, contents := range map[string]string{
+		"bad.yaml":      "BuildScript: [build.sh\n",
+		"bad.toml":      "BuildScript = \n",
+		"list.yaml":     "- BuildScript\n",
+		"wrongtype.yml": "TimeoutInSecs: thirty\nBuildScript: build.sh\n",
+	} {
+		path := filepath.Join(tmpDir, name)
+		ioutil.WriteFile(path, []byte(contents), 0600)
+
+		if config, err := ParseConfigFile(path); err == nil {
+			t.Errorf("No error parsing %s, returned %+v", name, config)
+		}
+	}
+}
+
+// Every file in testfiles parses (or fails) the same way in every format.
+func TestConfigFormatsParseTheSame(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "kerouac_configformat_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	paths, err := filepath.Glob("testfiles/*.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range paths {
+		data, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var parsed map[string]interface{}
+		if err = json.Unmarshal(data, &parsed); err != nil {
+			continue
+		}
+
+		expected, expectedErr := ParseConfigFile(path)
+
+		name := strings.TrimSuffix(filepath.Base(path), ".json")
+		for ext, encode := range map[string]func(interface{}) ([]byte, error){
+			".yaml": yaml.Marshal,
+			".toml": encodeTestToml,
+		} {
+			encoded, err := encode(parsed)
+			if err != nil {
+				t.Fatalf("Error encoding %s as %s: %s", path, ext, err)
+			}
+			converted := filepath.Join(tmpDir, name+ext)
+			if err = ioutil.WriteFile(converted, encoded, 0600); err != nil {
+				t.Fatal(err)
+			}
+
+			config, err := ParseConfigFile(converted)
+			if !reflect.DeepEqual(config, expected) {
+				t.Errorf("%s parsed as %+v not %+v", converted, config, expected)
+			}
+			if (err == nil) != (expectedErr == nil) || (err != nil && err.Error() != expectedErr.Error()) {
+				t.Errorf("%s gave error %v not %v", converted, err, expectedErr)
+			}
+		}
+	}
+}
+
+func encodeTestToml(value interface{}) ([]byte, error) {
+	var buffer bytes.Buffer
+	err := toml.NewEncoder(&buffer).Encode(value)
+	return buffer.Bytes(), err
+}
@@ -0,0 +1,131 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+	"path"
+	"reflect"
+	"strings"
+)
+
+// A build's config is merged from layers, lowest precedence first: the
+// kerouac root's defaults (see FmtDefaultsConfigPath), the project's
+// overrides (see FmtProjectConfigPath), then the config file it's built with.
+// A field given in a layer replaces the whole of that field from the layers
+// before it, so e.g. a repo's Env replaces the defaults' Env rather than
+// adding to it.
+
+// The origin of config fields no layer set.
+const DefaultOrigin = "kerouac default"
+
+// The paths of the config layers for a build of project with configFile,
+// leaving out the optional ones that don't exist.
+func ConfigLayerPaths(rootDir string, project string, configFile string) []string {
+	var paths []string
+	for _, path := range []string{FmtDefaultsConfigPath(rootDir), FmtProjectConfigPath(rootDir, project)} {
+		if _, err := os.Stat(path); err == nil {
+			paths = append(paths, path)
+		}
+	}
+	return append(paths, configFile)
+}
+
+// Parse the config for a build of project with tag and configFile, merged
+// from its layers, and check it as ParseConfigFile does.  Also returns where
+// each field was set, by field name: the path of the layer, and the pattern
+// for fields from Branches.  Fields nothing set are missing.
+func ParseLayeredConfig(rootDir string, project string, tag string, configFile string) (*Config, map[string]string, error) {
+	data, origins, err := mergeConfigFiles(ConfigLayerPaths(rootDir, project, configFile), tag)
+	if err != nil {
+		return nil, nil, err
+	}
+
+	config, err := parseConfigJSON(data)
+	if err != nil {
+		return nil, nil, err
+	}
+	return config, origins, nil
+}
+
+// Merge the config files at paths, each read as for ParseConfigFile, into one
+// JSON object, later files' fields replacing earlier ones', then the fields of
+// the Branches that match tag's branch.  Also returns where each field was
+// taken from.
+func mergeConfigFiles(paths []string, tag string) ([]byte, map[string]string, error) {
+	merged := make(map[string]json.RawMessage)
+	origins := make(map[string]string)
+
+	for _, path := range paths {
+		data, err := readConfigFile(path)
+		if err != nil {
+			return nil, nil, fmt.Errorf("%s: %s", path, err)
+		}
+
+		var fields map[string]json.RawMessage
+		if err = json.Unmarshal(data, &fields); err != nil {
+			return nil, nil, fmt.Errorf("%s: Error parsing json: %s", path, err)
+		}
+
+		for name, value := range fields {
+			name = canonicalFieldName(name)
+			merged[name] = value
+			origins[name] = path
+		}
+	}
+
+	applyBranchConfigs(merged, origins, tag)
+
+	data, err := json.Marshal(merged)
+	return data, origins, err
+}
+
+// Fields match case insensitively, so use the names in Config to be sure
+// later layers replace earlier ones.
+func canonicalFieldName(name string) string {
+	if field, ok := configField(reflect.TypeOf(Config{}), name); ok {
+		return field.Name
+	}
+	return name
+}
+
+// Set the fields from the Config of each of the Branches in fields that match
+// the branch of tag, in order.  Branches that can't be parsed are left for
+// the config checks to complain about.
+func applyBranchConfigs(fields map[string]json.RawMessage, origins map[string]string, tag string) {
+	branch, ok := TagBranch(tag)
+	if !ok {
+		return
+	}
+
+	var branches []BranchConfig
+	if err := json.Unmarshal(fields["Branches"], &branches); err != nil {
+		return
+	}
+
+	for _, branchConfig := range branches {
+		if matched, _ := path.Match(branchConfig.Pattern, branch); !matched {
+			continue
+		}
+
+		for name, value := range branchConfig.Config {
+			name = canonicalFieldName(name)
+			data, err := json.Marshal(value)
+			if err != nil || name == "Branches" {
+				continue
+			}
+			fields[name] = data
+			origins[name] = fmt.Sprintf("%s, Branches %s", origins["Branches"], branchConfig.Pattern)
+		}
+	}
+}
+
+// The branch a build is of, from its tag, which the post-receive hook makes
+// branch@sha.  false if the tag isn't of that form.
+func TagBranch(tag string) (string, bool) {
+	at := strings.LastIndex(tag, "@")
+	if at <= 0 {
+		return "", false
+	}
+	return tag[:at], true
+}
@@ -0,0 +1,209 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// A kerouac root with a defaults config and a config for KnownProject, and a
+// repo config next to it, returning the root and the repo config's path.
+func makeLayeredConfigRoot(t *testing.T) (string, string) {
+	rootDir, err := ioutil.TempDir("", "kerouac_configlayers_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(filepath.Join(rootDir, ProjectsDir), 0700)
+
+	for path, contents := range map[string]string{
+		FmtDefaultsConfigPath(rootDir):                 `{"NumBuildsToKeep": 5, "TimeoutInSecs": 60, "Env": {"FROM": "defaults"}}`,
+		FmtProjectConfigPath(rootDir, KnownProject):    `{"TimeoutInSecs": 90, "Artifacts": ["dist/*"]}`,
+		filepath.Join(rootDir, "repo", "kerouac.json"): `{"BuildScript": "./build.sh", "env": {"FROM": "repo"}}`,
+	} {
+		os.MkdirAll(filepath.Dir(path), 0700)
+		if err = ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	return rootDir, filepath.Join(rootDir, "repo", "kerouac.json")
+}
+
+func TestConfigLayerPaths(t *testing.T) {
+	rootDir, configFile := makeLayeredConfigRoot(t)
+	defer os.RemoveAll(rootDir)
+
+	expected := []string{FmtDefaultsConfigPath(rootDir), FmtProjectConfigPath(rootDir, KnownProject), configFile}
+	if paths := ConfigLayerPaths(rootDir, KnownProject, configFile); !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Layers were %v not %v", paths, expected)
+	}
+
+	expected = []string{FmtDefaultsConfigPath(rootDir), configFile}
+	if paths := ConfigLayerPaths(rootDir, "other_project", configFile); !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Layers for a project without a config were %v not %v", paths, expected)
+	}
+
+	os.Remove(FmtDefaultsConfigPath(rootDir))
+	expected = []string{configFile}
+	if paths := ConfigLayerPaths(rootDir, "other_project", configFile); !reflect.DeepEqual(paths, expected) {
+		t.Errorf("Layers with only the repo config were %v not %v", paths, expected)
+	}
+}
+
+func TestParseLayeredConfig(t *testing.T) {
+	rootDir, configFile := makeLayeredConfigRoot(t)
+	defer os.RemoveAll(rootDir)
+
+	config, origins, err := ParseLayeredConfig(rootDir, KnownProject, KnownTag, configFile)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := defaultConfig()
+	expected.BuildScript = "./build.sh"
+	expected.NumBuildsToKeep = 5
+	expected.TimeoutInSecs = 90
+	expected.Artifacts = []string{"dist/*"}
+	expected.Env = map[string]string{"FROM": "repo"}
+	if !reflect.DeepEqual(*config, expected) {
+		t.Errorf("Layered config was %+v not %+v", *config, expected)
+	}
+
+	expectedOrigins := map[string]string{
+		"NumBuildsToKeep": FmtDefaultsConfigPath(rootDir),
+		"TimeoutInSecs":   FmtProjectConfigPath(rootDir, KnownProject),
+		"Artifacts":       FmtProjectConfigPath(rootDir, KnownProject),
+		"BuildScript":     configFile,
+		"Env":             configFile,
+	}
+	if !reflect.DeepEqual(origins, expectedOrigins) {
+		t.Errorf("Origins were %v not %v", origins, expectedOrigins)
+	}
+}
+
+func TestParseLayeredConfigReportsBadLayers(t *testing.T) {
+	rootDir, configFile := makeLayeredConfigRoot(t)
+	defer os.RemoveAll(rootDir)
+
+	ioutil.WriteFile(FmtProjectConfigPath(rootDir, KnownProject), []byte(`{"TimeoutInSecs": `), 0600)
+
+	_, _, err := ParseLayeredConfig(rootDir, KnownProject, KnownTag, configFile)
+	if err == nil || !strings.HasPrefix(err.Error(), FmtProjectConfigPath(rootDir, KnownProject)) {
+		t.Errorf("Bad project config gave error %v", err)
+	}
+}
+
+func TestCheckConfigFilesPositionsProblemsInLayers(t *testing.T) {
+	rootDir, configFile := makeLayeredConfigRoot(t)
+	defer os.RemoveAll(rootDir)
+
+	srcDir := filepath.Dir(configFile)
+	ioutil.WriteFile(filepath.Join(srcDir, "build.sh"), []byte("#!/bin/sh\n"), 0700)
+	ioutil.WriteFile(FmtDefaultsConfigPath(rootDir), []byte("{\n    \"NumBuildsToKep\": 5\n}\n"), 0600)
+
+	_, problems := CheckConfigFiles(srcDir, ConfigLayerPaths(rootDir, KnownProject, configFile), KnownTag)
+	expected := []ConfigProblem{{Path: FmtDefaultsConfigPath(rootDir), Line: 2, Column: 5, Message: "Unknown field NumBuildsToKep."}}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("Problems were %v not %v", problems, expected)
+	}
+}
+
+func TestWriteConfigOrigins(t *testing.T) {
+	config := defaultConfig()
+	config.BuildScript = "./build.sh"
+	config.TimeoutInSecs = 30
+
+	var buffer bytes.Buffer
+	if err := writeConfigOrigins(&buffer, &config, map[string]string{"BuildScript": "kerouac.json", "TimeoutInSecs": "kerouac.json"}); err != nil {
+		t.Fatal(err)
+	}
+
+	lines := strings.Split(strings.TrimSpace(buffer.String()), "\n")
+	if len(lines) != reflect.TypeOf(config).NumField() {
+		t.Fatalf("Expected a line per field, got %q", lines)
+	}
+	for i, expected := range [][]string{
+		{"BuildScript", `"./build.sh"`, "kerouac.json"},
+		{"BuildScriptArgs", "[]", DefaultOrigin},
+		{"Steps", "null", DefaultOrigin},
+		{"NumBuildsToKeep", "10", DefaultOrigin},
+		{"TimeoutInSecs", "30", "kerouac.json"},
+	} {
+		fields := strings.SplitN(strings.Join(strings.Fields(lines[i]), " "), " ", 3)
+		if !reflect.DeepEqual(fields, expected) {
+			t.Errorf("Line %d was %q not %q", i, lines[i], expected)
+		}
+	}
+}
+
+func TestTagBranch(t *testing.T) {
+	for tag, expected := range map[string]string{
+		"master@0123abc":      "master",
+		"release-1.0@0123abc": "release-1.0",
+		"user@host@0123abc":   "user@host",
+		"master":              "",
+		"@0123abc":            "",
+	} {
+		if branch, ok := TagBranch(tag); branch != expected || ok != (expected != "") {
+			t.Errorf("TagBranch(%s) returned %s, %t", tag, branch, ok)
+		}
+	}
+}
+
+func TestParseLayeredConfigAppliesBranches(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "kerouac_configlayers_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	configFile := "testfiles/good_branches_config.json"
+	for _, test := range []struct {
+		tag                   string
+		timeoutInSecs         int
+		numBuildsToKeep       int
+		packageTimeoutInSecs  int
+		skip                  bool
+		numBuildsToKeepOrigin string
+	}{
+		{"master@0123abc", 30, DefaultNumBuildsToKeep, 60, false, ""},
+		{"release-2.0@0123abc", 600, 50, 60, false, configFile + ", Branches release-*"},
+		{"release-1.2@0123abc", 600, 100, 60, false, configFile + ", Branches release-1.*"},
+		{"wip-thing@0123abc", 30, DefaultNumBuildsToKeep, 60, true, ""},
+		{"release-2.0", 30, DefaultNumBuildsToKeep, 60, false, ""},
+	} {
+		config, origins, err := ParseLayeredConfig(rootDir, KnownProject, test.tag, configFile)
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		if config.TimeoutInSecs != test.timeoutInSecs || config.NumBuildsToKeep != test.numBuildsToKeep || config.Skip != test.skip {
+			t.Errorf("Config for %s was %+v", test.tag, config)
+		}
+		// Steps without their own timeout get the branch's.
+		if config.Steps[0].TimeoutInSecs != test.timeoutInSecs || config.Steps[1].TimeoutInSecs != test.packageTimeoutInSecs {
+			t.Errorf("Steps for %s were %+v", test.tag, config.Steps)
+		}
+		if origins["NumBuildsToKeep"] != test.numBuildsToKeepOrigin {
+			t.Errorf("NumBuildsToKeep for %s came from %q not %q", test.tag, origins["NumBuildsToKeep"], test.numBuildsToKeepOrigin)
+		}
+	}
+}
+
+func TestCheckConfigFilesFindsUnknownFieldsInBranches(t *testing.T) {
+	srcDir := makeCheckSrcDir(t)
+	defer os.RemoveAll(srcDir)
+
+	path := filepath.Join(srcDir, "kerouac.json")
+	ioutil.WriteFile(path, []byte(`{"BuildScript": "./build.sh", "TimeoutInSecs": 30, "Branches": [{"Pattern": "*", "Config": {"Timeout": 60}}]}`), 0600)
+
+	_, problems := CheckConfigFiles(srcDir, []string{path}, "master@0123abc")
+	expected := []ConfigProblem{{Path: path, Line: 1, Column: 93, Message: "Unknown field Branches[0].Config.Timeout."}}
+	if !reflect.DeepEqual(problems, expected) {
+		t.Errorf("Problems were %v not %v", problems, expected)
+	}
+}
@@ -0,0 +1,113 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"path/filepath"
+	"time"
+)
+
+var waitForQueued = flag.Bool("wait", false, "For kerouac enqueue, wait for the queued build to finish, and exit with the code kerouac build would have.")
+
+// How often kerouac enqueue --wait checks whether the build has finished.
+var queuedPollInterval = 5 * time.Second
+
+// The kerouac build flags kerouac enqueue passes on to the queued build.
+var queuedBuildFlags = []string{"remove-src", "no-tarball", "strict-config", "secrets-dir"}
+
+func DoEnqueueCommand() {
+	flag.Usage = func() {
+		fmt.Printf("Usage: kerouac enqueue [options] <srcDir> <configFile> <kerouacRootDir> <project> <tag>\n\n")
+		fmt.Printf("Records a QUEUED build, for kerouac worker to build as kerouac build would, in the order queued.\n\n")
+		fmt.Printf("The srcDir must stay until the build has run; use --remove-src to have it removed then.\n\n")
+		fmt.Printf("With --wait, exits once the build has run, as kerouac build would, or with %d if a newer\n", ExitSuperseded)
+		fmt.Printf("build of its branch superseded it.\n\n")
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if len(flag.Args()) != NumArgs {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	rootDir := flag.Arg(2)
+	project := flag.Arg(3)
+	tag := flag.Arg(4)
+
+	queued, err := newQueuedBuild(rootDir, project, tag, flag.Arg(0), flag.Arg(1))
+	if err != nil {
+		log.Fatalf("Can't queue build: %s", err)
+	}
+
+	store, err := OpenBuildStore(rootDir)
+	if err != nil {
+		log.Fatalf("Error opening build db: %s", err)
+	}
+	defer store.Close()
+
+	if err = store.CreateQueuedBuildRecord(queued); err != nil {
+		log.Fatalf("Could not create build record: %s", err)
+	}
+
+	fmt.Printf("%s\n", queued.FmtBuildDir())
+
+	if *waitForQueued {
+		status, err := waitForBuild(store, *queued.BuildId, queuedPollInterval)
+		if err != nil {
+			log.Printf("Error waiting for build: %s", err)
+			os.Exit(ExitErrored)
+		}
+		os.Exit(exitCodeForStatus(status))
+	}
+}
+
+// Wait for buildId to be neither QUEUED nor RUNNING, checking every
+// pollInterval, returning how it ended.
+func waitForBuild(store BuildStore, buildId BuildId, pollInterval time.Duration) (BuildStatus, error) {
+	for {
+		recordedBuild, err := FindLatestBuild(store, buildId.Project, buildId.Tag, buildId.DateTime.Format(DateFormat))
+		if err != nil {
+			return "", err
+		}
+		if recordedBuild == nil {
+			return "", fmt.Errorf("No record of %s", buildId.FmtBuildDir())
+		}
+		if recordedBuild.Status != QUEUED && recordedBuild.Status != RUNNING {
+			return recordedBuild.Status, nil
+		}
+		time.Sleep(pollInterval)
+	}
+}
+
+// A build of project with tag queued now, with the build flags given on the
+// command line.
+func newQueuedBuild(rootDir string, project string, tag string, srcDir string, configFile string) (QueuedBuild, error) {
+	var err error
+	queued := QueuedBuild{}
+	if queued.SrcDir, err = filepath.Abs(srcDir); err != nil {
+		return queued, err
+	}
+	if queued.ConfigFile, err = filepath.Abs(configFile); err != nil {
+		return queued, err
+	}
+	if rootDir, err = filepath.Abs(rootDir); err != nil {
+		return queued, err
+	}
+
+	buildId := BuildIdAtNow(rootDir, project, tag)
+	queued.BuildId = &buildId
+
+	queued.BuildFlags = []string{}
+	flag.Visit(func(f *flag.Flag) {
+		for _, name := range queuedBuildFlags {
+			if f.Name == name {
+				queued.BuildFlags = append(queued.BuildFlags, fmt.Sprintf("--%s=%s", f.Name, f.Value))
+			}
+		}
+	})
+	return queued, nil
+}
@@ -0,0 +1,56 @@
+package main
+
+import (
+	"flag"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestQueuedBuildRunsWithGivenFlags(t *testing.T) {
+	if err := flag.Set("remove-src", "true"); err != nil {
+		t.Fatal(err)
+	}
+	defer flag.Set("remove-src", "false")
+
+	queued, err := newQueuedBuild(KnownRootDir, KnownProject, KnownTag, "src", "src/kerouac.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, path := range []string{queued.SrcDir, queued.ConfigFile, queued.RootDir} {
+		if !filepath.IsAbs(path) {
+			t.Errorf("Queued build has relative path %s", path)
+		}
+	}
+
+	args := queuedBuildArgs(queued)
+	expected := []string{"build", "--queued-build=" + queued.DateTime.Format(DateFormat), "--remove-src=true", queued.SrcDir, queued.ConfigFile, queued.RootDir, KnownProject, KnownTag}
+	if !reflect.DeepEqual(args, expected) {
+		t.Errorf("Queued build runs with %v not %v", args, expected)
+	}
+}
+
+func TestWaitForBuild(t *testing.T) {
+	store := NewMemoryBuildStore(KnownRootDir)
+	buildId := knownBuildId()
+	if err := store.CreateQueuedBuildRecord(QueuedBuild{BuildId: &buildId, SrcDir: "src", ConfigFile: "src/kerouac.json"}); err != nil {
+		t.Fatal(err)
+	}
+
+	go func() {
+		time.Sleep(20 * time.Millisecond)
+		store.StartQueuedBuild(buildId)
+		time.Sleep(20 * time.Millisecond)
+		MarkBuildTimedOut(store, buildId)
+	}()
+
+	status, err := waitForBuild(store, buildId, 5*time.Millisecond)
+	if err != nil || status != TIMED_OUT {
+		t.Errorf("Waited for build to be %s, %v, not TIMED_OUT", status, err)
+	}
+	if code := exitCodeForStatus(status); code != ExitTimedOut {
+		t.Errorf("Exit code for a timed out build was %d", code)
+	}
+}
@@ -0,0 +1,111 @@
+package main
+
+import (
+	"path/filepath"
+	"sort"
+	"strings"
+	"time"
+)
+
+// The names of the variables kerouac sets for builds all start with this.
+const KerouacEnvPrefix = "KEROUAC_"
+
+// Variables kerouac sets in every build's environment.
+const (
+	KerouacProjectEnv      = "KEROUAC_PROJECT"
+	KerouacTagEnv          = "KEROUAC_TAG"
+	KerouacRootEnv         = "KEROUAC_ROOT"
+	KerouacBuildDirEnv     = "KEROUAC_BUILD_DIR"
+	KerouacBuildStartEnv   = "KEROUAC_BUILD_START"
+	KerouacSrcDirEnv       = "KEROUAC_SRC_DIR"
+	KerouacLogsDirEnv      = "KEROUAC_LOGS_DIR"
+	KerouacArtifactsDirEnv = "KEROUAC_ARTIFACTS_DIR"
+)
+
+// The variables passed on from kerouac's own environment for configs without
+// InheritEnv.
+var DefaultInheritEnv = []string{"PATH", "HOME", "USER", "LOGNAME", "SHELL", "TMPDIR", "TZ", "LANG", "LC_*"}
+
+// The environment (as VAR=value) to run buildId's build of srcDir with.  It
+// has, with later ones taking precedence:
+//
+//   - the variables in kerouacEnv (kerouac's own environment, as from
+//     os.Environ) matching one of config's InheritEnv
+//   - config's Env
+//   - extra (e.g. a matrix build's variables), as VAR=value
+//   - the KEROUAC_* variables, describing the build and where things are
+//
+// The variables are sorted by name.
+func BuildEnv(config *Config, kerouacEnv []string, extra []string, srcDir string, buildId BuildId) []string {
+	inherit := config.InheritEnv
+	if inherit == nil {
+		inherit = DefaultInheritEnv
+	}
+
+	vars := make(map[string]string)
+
+	for _, variable := range kerouacEnv {
+		name, value := splitEnvVar(variable)
+		if matchesAny(name, inherit) {
+			vars[name] = value
+		}
+	}
+
+	for name, value := range config.Env {
+		vars[name] = value
+	}
+
+	for _, variable := range extra {
+		name, value := splitEnvVar(variable)
+		vars[name] = value
+	}
+
+	for name, value := range KerouacEnv(srcDir, buildId) {
+		vars[name] = value
+	}
+
+	env := make([]string, 0, len(vars))
+	for name, value := range vars {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// The KEROUAC_* variables for buildId's build of srcDir.
+func KerouacEnv(srcDir string, buildId BuildId) map[string]string {
+	// Builds run in srcDir, so relative paths would be wrong.
+	absolute := func(path string) string {
+		if abs, err := filepath.Abs(path); err == nil {
+			return abs
+		}
+		return path
+	}
+
+	return map[string]string{
+		KerouacProjectEnv:      buildId.Project,
+		KerouacTagEnv:          buildId.Tag,
+		KerouacRootEnv:         absolute(buildId.RootDir),
+		KerouacBuildDirEnv:     absolute(buildId.FmtBuildDir()),
+		KerouacBuildStartEnv:   buildId.DateTime.Format(time.RFC3339),
+		KerouacSrcDirEnv:       absolute(srcDir),
+		KerouacLogsDirEnv:      absolute(buildId.FmtLogsDir()),
+		KerouacArtifactsDirEnv: absolute(buildId.FmtArtifactsDir()),
+	}
+}
+
+func splitEnvVar(variable string) (string, string) {
+	if equals := strings.Index(variable, "="); equals >= 0 {
+		return variable[:equals], variable[equals+1:]
+	}
+	return variable, ""
+}
+
+func matchesAny(name string, patterns []string) bool {
+	for _, pattern := range patterns {
+		if matched, _ := filepath.Match(pattern, name); matched {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,87 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+)
+
+func TestBuildEnv(t *testing.T) {
+	buildId := BuildIdAt("/kerouac", KnownProject, KnownTag, KnownDateTime)
+	config := &Config{
+		Env:        map[string]string{"GOFLAGS": "-mod=vendor", "HOME": "/build/home"},
+		InheritEnv: []string{"PATH", "HOME", "LC_*"},
+	}
+	kerouacEnv := []string{"PATH=/bin", "HOME=/home/kerouac", "LC_ALL=C", "SECRET=hunter2", "KEROUAC_TAG=stale"}
+
+	env := BuildEnv(config, kerouacEnv, []string{"GOOS=linux", "GOFLAGS=-race"}, "/src", buildId)
+
+	expected := []string{
+		"GOFLAGS=-race",
+		"GOOS=linux",
+		"HOME=/build/home",
+		"KEROUAC_ARTIFACTS_DIR=" + buildId.FmtArtifactsDir(),
+		"KEROUAC_BUILD_DIR=" + buildId.FmtBuildDir(),
+		"KEROUAC_BUILD_START=" + KnownDateTime.Format("2006-01-02T15:04:05Z07:00"),
+		"KEROUAC_LOGS_DIR=" + buildId.FmtLogsDir(),
+		"KEROUAC_PROJECT=" + KnownProject,
+		"KEROUAC_ROOT=/kerouac",
+		"KEROUAC_SRC_DIR=/src",
+		"KEROUAC_TAG=" + KnownTag,
+		"LC_ALL=C",
+		"PATH=/bin",
+	}
+	if !reflect.DeepEqual(env, expected) {
+		t.Errorf("Build env was\n%v\nnot\n%v", env, expected)
+	}
+}
+
+func TestBuildEnvDefaultsInheritEnv(t *testing.T) {
+	buildId := BuildIdAt("/kerouac", KnownProject, KnownTag, KnownDateTime)
+
+	env := BuildEnv(&Config{}, []string{"PATH=/bin", "SECRET=hunter2"}, nil, "/src", buildId)
+	inherited := make(map[string]bool)
+	for _, variable := range env {
+		name, _ := splitEnvVar(variable)
+		inherited[name] = true
+	}
+	if !inherited["PATH"] || inherited["SECRET"] {
+		t.Errorf("Build env with default InheritEnv was %v", env)
+	}
+
+	env = BuildEnv(&Config{InheritEnv: []string{}}, []string{"PATH=/bin"}, nil, "/src", buildId)
+	for _, variable := range env {
+		if name, _ := splitEnvVar(variable); name == "PATH" {
+			t.Errorf("Inherited PATH with empty InheritEnv: %v", env)
+		}
+	}
+}
+
+func TestBuildScriptGetsBuildEnv(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "kerouac_env_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	srcDir, buildId := makeScriptBuild(t, tmpDir, "#!/bin/sh\necho $KEROUAC_PROJECT $KEROUAC_TAG $GOFLAGS ${SECRET:-unset}\n")
+	os.Setenv("SECRET", "hunter2")
+	defer os.Unsetenv("SECRET")
+
+	config := &Config{Env: map[string]string{"GOFLAGS": "-mod=vendor"}}
+	env := BuildEnv(config, os.Environ(), nil, srcDir, buildId)
+
+	if _, err = RunBuildScript(srcDir, "./build.sh", nil, env, nil, 10, 1, nil, buildId); err != nil {
+		t.Fatal(err)
+	}
+
+	stdout, err := ioutil.ReadFile(filepath.Join(buildId.FmtLogsDir(), StdoutLogName))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := KnownProject + " " + KnownTag + " -mod=vendor unset\n"; string(stdout) != expected {
+		t.Errorf("Build script wrote %q not %q", stdout, expected)
+	}
+}
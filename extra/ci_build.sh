@@ -55,6 +55,10 @@ KEROUAC_CONFIG_NAME=${KEROUAC_CONFIG_NAME:-"kerouac.json"}
 
 KEROUAC_BUILD_FLAGS="--remove-src"
 
+# If YES, queue the build for a kerouac worker to run and wait for it, rather
+# than building here (the git post-receive hook passes its own setting on).
+KEROUAC_ENQUEUE=${KEROUAC_ENQUEUE:-"NO"}
+
 #############
 # Arguments #
 #############
@@ -69,15 +73,24 @@ LOG_FILE=$5
 # Actually run the build.     #
 ###############################
 
-$KEROUAC build $KEROUAC_BUILD_FLAGS . $KEROUAC_CONFIG_NAME $KEROUAC_ROOT $PROJECT $TAG
-
-if [ $? != "0" ]
+if [ "$KEROUAC_ENQUEUE" == "YES" ]
 then
-    STATUS=FAILED
+    $KEROUAC enqueue --wait $KEROUAC_BUILD_FLAGS . $KEROUAC_CONFIG_NAME $KEROUAC_ROOT $PROJECT $TAG
 else
-    STATUS=SUCCEEDED
+    $KEROUAC build $KEROUAC_BUILD_FLAGS . $KEROUAC_CONFIG_NAME $KEROUAC_ROOT $PROJECT $TAG
 fi
 
+# See the Exit* constants in buildcmd.go.
+case $? in
+    0) STATUS=SUCCEEDED ;;
+    2) STATUS=TIMED_OUT ;;
+    3) STATUS=CANCELLED ;;
+    4) STATUS=ERRORED ;;
+    5) STATUS=SKIPPED ;;
+    6) STATUS=SUPERSEDED ;;
+    *) STATUS=FAILED ;;
+esac
+
 ########################################################
 # Get the output from the build logs into the log file #
 ########################################################
@@ -100,13 +113,20 @@ cat $($KEROUAC print stderrpath $KEROUAC_ROOT $PROJECT $TAG) >> $LOG_FILE
 
 if [ "$MAIL_TO" != "" ]
 then
-    if [ $STATUS == "FAILED" ] && [ $NOTIFY_ON_FAILURE == "YES" ]
+    if [ $STATUS == "SUCCEEDED" ]
     then
-        cat $LOG_FILE | $MAIL_CMD "$PROJECT build $TAG failed" $MAIL_TO
-    elif [ $NOTIFY_ON_SUCCESS == "YES" ]
+        if [ $NOTIFY_ON_SUCCESS == "YES" ]
+        then
+            cat $LOG_FILE | $MAIL_CMD "$PROJECT build $TAG succeeded" $MAIL_TO
+        fi
+    elif [ $STATUS == "SKIPPED" ] || [ $STATUS == "SUPERSEDED" ]
     then
-        cat $LOG_FILE | $MAIL_CMD "$PROJECT build $TAG succeeded" $MAIL_TO
-
+        # The config says not to build this branch, or a newer push of it is
+        # being built instead, so there's nothing to say.
+        :
+    elif [ $NOTIFY_ON_FAILURE == "YES" ]
+    then
+        cat $LOG_FILE | $MAIL_CMD "$PROJECT build $TAG $STATUS" $MAIL_TO
     fi
 fi
 
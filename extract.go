@@ -0,0 +1,121 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+)
+
+// Extract the tarball at tarballPath (as made by CreateTarball, or by older
+// kerouacs with the external tar) into destDir, which must exist.
+//
+// Entries with absolute paths or .. in them, symlinks pointing outside
+// destDir, and entries under symlinks, are rejected with an error, as are
+// entries for files that already exist.  Hard links and special files are
+// skipped.
+func ExtractTarball(tarballPath string, destDir string) error {
+	file, err := os.Open(tarballPath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		return err
+	}
+	tarReader := tar.NewReader(gzipReader)
+
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+
+		name, err := safeTarballEntryName(header.Name)
+		if err != nil {
+			return err
+		}
+		if name == "." {
+			continue
+		}
+		target := filepath.Join(destDir, filepath.FromSlash(name))
+
+		if err = checkNoSymlinkParents(destDir, name); err != nil {
+			return err
+		}
+
+		switch header.Typeflag {
+		case tar.TypeDir:
+			err = os.MkdirAll(target, 0700|os.FileMode(header.Mode).Perm())
+		case tar.TypeReg:
+			err = extractTarballFile(tarReader, target, os.FileMode(header.Mode).Perm())
+		case tar.TypeSymlink:
+			if linked := path.Join(path.Dir(name), header.Linkname); path.IsAbs(header.Linkname) || linked == ".." || strings.HasPrefix(linked, "../") {
+				return fmt.Errorf("Tarball entry %s links outside the destination: %s", header.Name, header.Linkname)
+			}
+			if err = os.MkdirAll(filepath.Dir(target), 0700); err == nil {
+				err = os.Symlink(header.Linkname, target)
+			}
+		default:
+			log.Printf("Not extracting %s, it is not a regular file, dir or symlink", header.Name)
+		}
+		if err != nil {
+			return err
+		}
+	}
+}
+
+// The cleaned, /-separated path of a tarball entry, or an error if it is
+// absolute or has .. in it.
+func safeTarballEntryName(name string) (string, error) {
+	if path.IsAbs(name) || strings.Contains(name, "\x00") {
+		return "", fmt.Errorf("Tarball entry has an absolute path: %s", name)
+	}
+	for _, segment := range strings.Split(name, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("Tarball entry has .. in its path: %s", name)
+		}
+	}
+	return path.Clean(name), nil
+}
+
+func extractTarballFile(r io.Reader, target string, perm os.FileMode) error {
+	if err := os.MkdirAll(filepath.Dir(target), 0700); err != nil {
+		return err
+	}
+
+	// O_EXCL, so we never write through a symlink from earlier in the tarball.
+	file, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, perm)
+	if err != nil {
+		return err
+	}
+
+	if _, err = io.Copy(file, r); err != nil {
+		file.Close()
+		return err
+	}
+	return file.Close()
+}
+
+// Return an error if any of the dirs the entry name is in is a symlink, which
+// could otherwise lead it outside destDir.
+func checkNoSymlinkParents(destDir string, name string) error {
+	parent := destDir
+	segments := strings.Split(name, "/")
+	for _, segment := range segments[:len(segments)-1] {
+		parent = filepath.Join(parent, segment)
+		if info, err := os.Lstat(parent); err == nil && info.Mode()&os.ModeSymlink != 0 {
+			return fmt.Errorf("Tarball entry %s is under a symlink", name)
+		}
+	}
+	return nil
+}
@@ -0,0 +1,160 @@
+package main
+
+import (
+	"archive/tar"
+	"compress/gzip"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// Write a tarball of headers, with contents for the regular files.
+func writeTestTarball(t *testing.T, tarballPath string, headers []tar.Header, contents map[string]string) {
+	file, err := os.Create(tarballPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	gzipWriter := gzip.NewWriter(file)
+	tarWriter := tar.NewWriter(gzipWriter)
+	for _, header := range headers {
+		header.Size = int64(len(contents[header.Name]))
+		if header.Mode == 0 {
+			header.Mode = 0600
+		}
+		if err = tarWriter.WriteHeader(&header); err != nil {
+			t.Fatal(err)
+		}
+		tarWriter.Write([]byte(contents[header.Name]))
+	}
+	tarWriter.Close()
+	gzipWriter.Close()
+}
+
+func TestExtractTarball(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "kerouac_extract_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	srcDir := filepath.Join(tmpDir, "src")
+	os.MkdirAll(filepath.Join(srcDir, "sub"), 0700)
+	ioutil.WriteFile(filepath.Join(srcDir, "sub", "file.txt"), []byte("contents"), 0600)
+	ioutil.WriteFile(filepath.Join(srcDir, "build.sh"), []byte("#!/bin/sh\n"), 0700)
+	os.Symlink("sub/file.txt", filepath.Join(srcDir, "link"))
+
+	buildId := BuildIdAt(filepath.Join(tmpDir, "root"), KnownProject, KnownTag, KnownDateTime)
+	os.MkdirAll(buildId.FmtBuildDir(), 0700)
+	if err = CreateTarball(srcDir, nil, buildId); err != nil {
+		t.Fatal(err)
+	}
+
+	destDir := filepath.Join(tmpDir, "dest")
+	os.MkdirAll(destDir, 0700)
+	if err = ExtractTarball(buildId.FmtTarballPath(), destDir); err != nil {
+		t.Fatal(err)
+	}
+
+	if contents, err := ioutil.ReadFile(filepath.Join(destDir, "link")); err != nil || string(contents) != "contents" {
+		t.Errorf("Extracted file through link was %q, %v", contents, err)
+	}
+	if info, err := os.Stat(filepath.Join(destDir, "build.sh")); err != nil || info.Mode().Perm() != 0700 {
+		t.Errorf("Extracted script was %v, %v", info, err)
+	}
+}
+
+func TestExtractTarballFromExternalTar(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "kerouac_extract_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	tarballPath := filepath.Join(tmpDir, TarballName)
+	writeTestTarball(t, tarballPath, []tar.Header{
+		{Name: "./", Typeflag: tar.TypeDir, Mode: 0700},
+		{Name: "./sub/", Typeflag: tar.TypeDir, Mode: 0700},
+		{Name: "./sub/file.txt", Typeflag: tar.TypeReg},
+	}, map[string]string{"./sub/file.txt": "contents"})
+
+	if err = ExtractTarball(tarballPath, tmpDir); err != nil {
+		t.Fatal(err)
+	}
+	if contents, err := ioutil.ReadFile(filepath.Join(tmpDir, "sub", "file.txt")); err != nil || string(contents) != "contents" {
+		t.Errorf("Extracted file was %q, %v", contents, err)
+	}
+}
+
+func TestExtractTarballRejectsEscapes(t *testing.T) {
+	for name, headers := range map[string][]tar.Header{
+		"absolute path":  {{Name: "/tmp/evil", Typeflag: tar.TypeReg}},
+		"dot dot":        {{Name: "sub/../../evil", Typeflag: tar.TypeReg}},
+		"absolute link":  {{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "/etc"}},
+		"escaping link":  {{Name: "sub/link", Typeflag: tar.TypeSymlink, Linkname: "../../etc"}},
+		"under symlink":  {{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "."}, {Name: "link/evil", Typeflag: tar.TypeReg}},
+		"existing file":  {{Name: "file", Typeflag: tar.TypeReg}, {Name: "file", Typeflag: tar.TypeReg}},
+		"through a link": {{Name: "link", Typeflag: tar.TypeSymlink, Linkname: "target"}, {Name: "link", Typeflag: tar.TypeReg}},
+	} {
+		tmpDir, err := ioutil.TempDir("", "kerouac_extract_test")
+		if err != nil {
+			t.Fatal(err)
+		}
+
+		tarballPath := filepath.Join(tmpDir, TarballName)
+		writeTestTarball(t, tarballPath, headers, nil)
+		destDir := filepath.Join(tmpDir, "dest")
+		os.MkdirAll(destDir, 0700)
+
+		if err = ExtractTarball(tarballPath, destDir); err == nil {
+			t.Errorf("No error extracting tarball with %s", name)
+		}
+		if _, err = os.Stat(filepath.Join(tmpDir, "evil")); !os.IsNotExist(err) {
+			t.Errorf("Tarball with %s wrote outside the destination", name)
+		}
+
+		os.RemoveAll(tmpDir)
+	}
+}
+
+func TestMakeEmptyDir(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "kerouac_extract_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	if err = makeEmptyDir(tmpDir); err != nil {
+		t.Errorf("Error for existing empty dir: %s", err)
+	}
+	if err = makeEmptyDir(filepath.Join(tmpDir, "new", "dir")); err != nil {
+		t.Errorf("Error for new dir: %s", err)
+	}
+	if err = makeEmptyDir(tmpDir); err == nil {
+		t.Errorf("No error for dir that isn't empty")
+	}
+}
+
+func TestRecordedConfigFile(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "kerouac_extract_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	buildId := BuildIdAt(tmpDir, KnownProject, KnownTag, KnownDateTime)
+	recordedBuild := RecordedBuild{BuildId: &buildId}
+	srcDir := filepath.Join(tmpDir, "src")
+
+	if configFile := recordedConfigFile(recordedBuild, srcDir); configFile != filepath.Join(srcDir, SourceConfigName) {
+		t.Errorf("Build without a config snapshot reruns with %s", configFile)
+	}
+
+	os.MkdirAll(buildId.FmtBuildDir(), 0700)
+	ioutil.WriteFile(buildId.FmtConfigSnapshotPath(), []byte("{}"), 0600)
+	if configFile := recordedConfigFile(recordedBuild, srcDir); configFile != buildId.FmtConfigSnapshotPath() {
+		t.Errorf("Build with a config snapshot reruns with %s", configFile)
+	}
+}
@@ -0,0 +1,108 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+	"path/filepath"
+)
+
+var rerun = flag.Bool("rerun", false, "For kerouac extract, build the extracted source again with the config it was built with, tagged <tag>-rerun.")
+
+var rerunConfig = flag.String("rerun-config", "", "For kerouac extract, as --rerun, but with this config file instead.")
+
+const (
+	// The suffix added to the tag of a build to tag its rerun.
+	RerunTagSuffix = "-rerun"
+	// The config in a build's source, as ci_build.sh builds with by default.
+	SourceConfigName = "kerouac.json"
+)
+
+func DoExtractCommand() {
+	flag.Usage = func() {
+		fmt.Printf("Usage: kerouac extract [options] <kerouacRootDir> <project> <tag> [datetime] <destDir>\n\n")
+		fmt.Printf("Extracts the source tarball of the specified build into destDir, which must be empty or not exist.\n\n")
+		fmt.Printf("If datetime is not specified, uses the latest build for the tag.\n\n")
+		fmt.Printf("With --rerun, builds it with the snapshot of the config it was built with, or if it has none,\n")
+		fmt.Printf("the %s in the extracted source.\n\n", SourceConfigName)
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if len(flag.Args()) < 4 || len(flag.Args()) > 5 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	kerouacRoot := flag.Arg(0)
+	project := flag.Arg(1)
+	tag := flag.Arg(2)
+	var datetime string
+	destDir := flag.Arg(3)
+	if len(flag.Args()) == 5 {
+		datetime = flag.Arg(3)
+		destDir = flag.Arg(4)
+	}
+
+	store, err := OpenBuildStore(kerouacRoot)
+	if err != nil {
+		log.Fatalf("Error opening build db: %s", err)
+	}
+
+	recordedBuild, err := FindLatestBuild(store, project, tag, datetime)
+	store.Close()
+	if err != nil {
+		log.Fatalf("Error finding build: %s", err)
+	}
+	if recordedBuild == nil {
+		log.Fatalf("No build of %s with tag %s found.", project, tag)
+	}
+
+	if err = makeEmptyDir(destDir); err != nil {
+		log.Fatalf("Can't extract into %s: %s", destDir, err)
+	}
+
+	tarballPath := recordedBuild.FmtTarballPath()
+	log.Printf("Extracting %s into %s", tarballPath, destDir)
+
+	if err = ExtractTarball(tarballPath, destDir); err != nil {
+		log.Fatalf("Error extracting tarball: %s", err)
+	}
+
+	if *rerun || *rerunConfig != "" {
+		configFile := *rerunConfig
+		if configFile == "" {
+			configFile = recordedConfigFile(*recordedBuild, destDir)
+		}
+		log.Printf("Rerunning the build as %s with %s", tag+RerunTagSuffix, configFile)
+		buildAndExit(destDir, configFile, kerouacRoot, project, tag+RerunTagSuffix, recordedBuild.BuildId)
+	}
+}
+
+// The config recordedBuild was built with: its snapshot, or for builds from
+// before snapshots were kept, the SourceConfigName in srcDir, its extracted
+// source.
+func recordedConfigFile(recordedBuild RecordedBuild, srcDir string) string {
+	if _, err := os.Stat(recordedBuild.FmtConfigSnapshotPath()); err == nil {
+		return recordedBuild.FmtConfigSnapshotPath()
+	}
+	return filepath.Join(srcDir, SourceConfigName)
+}
+
+// Create dir, or check it's empty if it exists.
+func makeEmptyDir(dir string) error {
+	entries, err := ioutil.ReadDir(dir)
+	if os.IsNotExist(err) {
+		return os.MkdirAll(dir, 0700)
+	} else if err != nil {
+		return err
+	}
+
+	if len(entries) > 0 {
+		return fmt.Errorf("it is not empty")
+	}
+	return nil
+}
@@ -16,27 +16,50 @@ import (
 //     - buildtag
 //       - datetag [FmtBuildDir]
 //         build.tar.gz [FmtTarballPath]
+//         - artifacts [FmtArtifactsDir]
+//             path/of/artifact [FmtArtifactPath]
+//         artifacts.json [FmtArtifactsManifestPath]
+//         config.json [FmtConfigSnapshotPath]
 //         - logs [FmtLogsDir]
 //             stdout [FmtStdoutLogPath]
 //             stderr [FmtStderrLogPath]
 //             kerouac.log [FmtKerouacLogPath]
-// - index.html
-// - pages
+//             combined [FmtCombinedLogPath]
+//             - steps (for builds with Steps)
+//               - stepname [FmtStepLogsDir]
+//                   stdout [FmtStepStdoutLogPath]
+//                   stderr [FmtStepStderrLogPath]
+//                   combined [FmtStepCombinedLogPath]
+// - builds.html [FmtBuildHTMLReportPath]
+// - builds.css (optional, user supplied) [FmtBuildCSSPath]
+// - kerouac.defaults.json (optional, user supplied) [FmtDefaultsConfigPath]
+// - projects (optional, user supplied)
+//   - project_one.json [FmtProjectConfigPath]
 //
 
 const (
 	BuildsDir           = "builds"
 	LogsDir             = "logs"
+	StepsDir            = "steps"
+	ArtifactsDir        = "artifacts"
+	ArtifactsManifest   = "artifacts.json"
+	ConfigSnapshotName  = "config.json"
 	StderrLogName       = "stderr"
 	StdoutLogName       = "stdout"
 	KerouacLogName      = "kerouac.log"
+	CombinedLogName     = "combined"
 	TarballName         = "build.tar.gz"
 	BuildDbName         = "builds.db"
 	BuildHTMLReportName = "builds.html"
+	BuildCSSName        = "builds.css"
+	DefaultsConfigName  = "kerouac.defaults.json"
+	ProjectsDir         = "projects"
+	// The format of the datetag dirs in build dirs.
+	DateTagFormat = "2006_01_02_15_04_05"
 )
 
 func (buildId BuildId) FmtBuildDir() string {
-	dateTag := buildId.DateTime.Format("2006_01_02_15_04_05")
+	dateTag := buildId.DateTime.Format(DateTagFormat)
 	return filepath.Join(buildId.RootDir, BuildsDir, buildId.Project, buildId.Tag, dateTag)
 }
 
@@ -44,6 +67,25 @@ func (buildId BuildId) FmtLogsDir() string {
 	return filepath.Join(buildId.FmtBuildDir(), LogsDir)
 }
 
+func (buildId BuildId) FmtArtifactsDir() string {
+	return filepath.Join(buildId.FmtBuildDir(), ArtifactsDir)
+}
+
+// The path of an artifact, given its path relative to the artifacts dir (as in
+// the manifest).
+func (buildId BuildId) FmtArtifactPath(artifactPath string) string {
+	return filepath.Join(buildId.FmtArtifactsDir(), filepath.FromSlash(artifactPath))
+}
+
+func (buildId BuildId) FmtArtifactsManifestPath() string {
+	return filepath.Join(buildId.FmtBuildDir(), ArtifactsManifest)
+}
+
+// Where the config a build ran with is kept.
+func (buildId BuildId) FmtConfigSnapshotPath() string {
+	return filepath.Join(buildId.FmtBuildDir(), ConfigSnapshotName)
+}
+
 func (buildId BuildId) FmtStderrLogPath() string {
 	return filepath.Join(buildId.FmtLogsDir(), StderrLogName)
 }
@@ -56,6 +98,27 @@ func (buildId BuildId) FmtKerouacLogPath() string {
 	return filepath.Join(buildId.FmtLogsDir(), KerouacLogName)
 }
 
+// stdout and stderr interleaved, see CombinedLog.
+func (buildId BuildId) FmtCombinedLogPath() string {
+	return filepath.Join(buildId.FmtLogsDir(), CombinedLogName)
+}
+
+func (buildId BuildId) FmtStepLogsDir(stepName string) string {
+	return filepath.Join(buildId.FmtLogsDir(), StepsDir, stepName)
+}
+
+func (buildId BuildId) FmtStepStdoutLogPath(stepName string) string {
+	return filepath.Join(buildId.FmtStepLogsDir(stepName), StdoutLogName)
+}
+
+func (buildId BuildId) FmtStepStderrLogPath(stepName string) string {
+	return filepath.Join(buildId.FmtStepLogsDir(stepName), StderrLogName)
+}
+
+func (buildId BuildId) FmtStepCombinedLogPath(stepName string) string {
+	return filepath.Join(buildId.FmtStepLogsDir(stepName), CombinedLogName)
+}
+
 func (buildId BuildId) FmtTarballPath() string {
 	return filepath.Join(buildId.FmtBuildDir(), TarballName)
 }
@@ -67,3 +130,15 @@ func FmtBuildDbPath(rootDir string) string {
 func FmtBuildHTMLReportPath(rootDir string) string {
 	return filepath.Join(rootDir, BuildHTMLReportName)
 }
+
+func FmtBuildCSSPath(rootDir string) string {
+	return filepath.Join(rootDir, BuildCSSName)
+}
+
+func FmtDefaultsConfigPath(rootDir string) string {
+	return filepath.Join(rootDir, DefaultsConfigName)
+}
+
+func FmtProjectConfigPath(rootDir string, project string) string {
+	return filepath.Join(rootDir, ProjectsDir, project+".json")
+}
@@ -13,6 +13,7 @@ const (
 	KnownTag        = "known_test_tag"
 	KnownDateTimeS  = "2006-01-02 15:04:05"
 	KnownDateTimeSU = "2006_01_02_15_04_05"
+	KnownStepName   = "known_test_step"
 )
 
 // Do a bunch of the same work we expect layout to do so we can test, but do it
@@ -25,9 +26,20 @@ var (
 	KnownStderrPath          = filepath.Join(KnownLogsDir, StderrLogName)
 	KnownStdoutPath          = filepath.Join(KnownLogsDir, StdoutLogName)
 	KnownKerouacPath         = filepath.Join(KnownLogsDir, KerouacLogName)
+	KnownCombinedPath        = filepath.Join(KnownLogsDir, CombinedLogName)
+	KnownStepLogsDir         = filepath.Join(KnownLogsDir, StepsDir, KnownStepName)
+	KnownStepStdoutPath      = filepath.Join(KnownStepLogsDir, StdoutLogName)
+	KnownStepStderrPath      = filepath.Join(KnownStepLogsDir, StderrLogName)
+	KnownStepCombinedPath    = filepath.Join(KnownStepLogsDir, CombinedLogName)
 	KnownTarballPath         = filepath.Join(KnownBuildDir, TarballName)
+	KnownArtifactsDir        = filepath.Join(KnownBuildDir, ArtifactsDir)
+	KnownArtifactPath        = filepath.Join(KnownArtifactsDir, "dist", "app.deb")
+	KnownArtifactsManifest   = filepath.Join(KnownBuildDir, ArtifactsManifest)
 	KnownBuildDbPath         = filepath.Join(KnownRootDir, BuildDbName)
 	KnownBuildHTMLReportPath = filepath.Join(KnownRootDir, BuildHTMLReportName)
+	KnownBuildCSSPath        = filepath.Join(KnownRootDir, BuildCSSName)
+	KnownDefaultsConfigPath  = filepath.Join(KnownRootDir, DefaultsConfigName)
+	KnownProjectConfigPath   = filepath.Join(KnownRootDir, ProjectsDir, KnownProject+".json")
 )
 
 // Create a known build id from constants, including the datetime, so we can
@@ -76,6 +88,54 @@ func TestFmtKerouacLogPath(t *testing.T) {
 	}
 }
 
+func TestFmtCombinedLogPath(t *testing.T) {
+	buildId := knownBuildId()
+	combinedPath := buildId.FmtCombinedLogPath()
+	if combinedPath != KnownCombinedPath {
+		t.Errorf("FmtCombinedLogPath returned %s not %s", combinedPath, KnownCombinedPath)
+	}
+}
+
+func TestFmtStepLogPaths(t *testing.T) {
+	buildId := knownBuildId()
+	if logsDir := buildId.FmtStepLogsDir(KnownStepName); logsDir != KnownStepLogsDir {
+		t.Errorf("FmtStepLogsDir returned %s not %s", logsDir, KnownStepLogsDir)
+	}
+	if stdoutPath := buildId.FmtStepStdoutLogPath(KnownStepName); stdoutPath != KnownStepStdoutPath {
+		t.Errorf("FmtStepStdoutLogPath returned %s not %s", stdoutPath, KnownStepStdoutPath)
+	}
+	if stderrPath := buildId.FmtStepStderrLogPath(KnownStepName); stderrPath != KnownStepStderrPath {
+		t.Errorf("FmtStepStderrLogPath returned %s not %s", stderrPath, KnownStepStderrPath)
+	}
+	if combinedPath := buildId.FmtStepCombinedLogPath(KnownStepName); combinedPath != KnownStepCombinedPath {
+		t.Errorf("FmtStepCombinedLogPath returned %s not %s", combinedPath, KnownStepCombinedPath)
+	}
+}
+
+func TestFmtArtifactsDir(t *testing.T) {
+	buildId := knownBuildId()
+	artifactsDir := buildId.FmtArtifactsDir()
+	if artifactsDir != KnownArtifactsDir {
+		t.Errorf("FmtArtifactsDir returned %s not %s", artifactsDir, KnownArtifactsDir)
+	}
+}
+
+func TestFmtArtifactPath(t *testing.T) {
+	buildId := knownBuildId()
+	artifactPath := buildId.FmtArtifactPath("dist/app.deb")
+	if artifactPath != KnownArtifactPath {
+		t.Errorf("FmtArtifactPath returned %s not %s", artifactPath, KnownArtifactPath)
+	}
+}
+
+func TestFmtArtifactsManifestPath(t *testing.T) {
+	buildId := knownBuildId()
+	manifestPath := buildId.FmtArtifactsManifestPath()
+	if manifestPath != KnownArtifactsManifest {
+		t.Errorf("FmtArtifactsManifestPath returned %s not %s", manifestPath, KnownArtifactsManifest)
+	}
+}
+
 func TestFmtTarballPath(t *testing.T) {
 	buildId := knownBuildId()
 	tarballPath := buildId.FmtTarballPath()
@@ -99,3 +159,25 @@ func TestFmtBuildHTMLReportName(t *testing.T) {
 		t.Errorf("FmtBuildHTMLReportPath returned %s not %s", buildHTMLReportPath, KnownBuildHTMLReportPath)
 	}
 }
+
+func TestFmtBuildCSSName(t *testing.T) {
+	buildId := knownBuildId()
+	buildCSSPath := FmtBuildCSSPath(buildId.RootDir)
+	if buildCSSPath != KnownBuildCSSPath {
+		t.Errorf("FmtBuildCSSPath returned %s not %s", buildCSSPath, KnownBuildCSSPath)
+	}
+}
+
+func TestFmtDefaultsConfigPath(t *testing.T) {
+	defaultsConfigPath := FmtDefaultsConfigPath(KnownRootDir)
+	if defaultsConfigPath != KnownDefaultsConfigPath {
+		t.Errorf("FmtDefaultsConfigPath returned %s not %s", defaultsConfigPath, KnownDefaultsConfigPath)
+	}
+}
+
+func TestFmtProjectConfigPath(t *testing.T) {
+	projectConfigPath := FmtProjectConfigPath(KnownRootDir, KnownProject)
+	if projectConfigPath != KnownProjectConfigPath {
+		t.Errorf("FmtProjectConfigPath returned %s not %s", projectConfigPath, KnownProjectConfigPath)
+	}
+}
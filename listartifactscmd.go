@@ -0,0 +1,65 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+var longArtifacts = flag.Bool("long", false, "For kerouac list-artifacts, also print each artifact's SHA-256 hash and size in bytes.")
+
+func init() {
+	flag.BoolVar(longArtifacts, "l", false, "Shorthand for --long.")
+}
+
+func DoListArtifactsCommand() {
+	flag.Usage = func() {
+		fmt.Printf("Usage: kerouac list-artifacts [options] <kerouacRootDir> <project> <tag> [datetime]\n\n")
+		fmt.Printf("Prints to stdout the paths of the artifacts kept from the specified build, from its manifest.\n\n")
+		fmt.Printf("If datetime is not specified, uses the latest build for the tag.\n\n")
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if len(flag.Args()) < 3 || len(flag.Args()) > 4 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	kerouacRoot := flag.Arg(0)
+	project := flag.Arg(1)
+	tag := flag.Arg(2)
+	var datetime string
+	if len(flag.Args()) == 4 {
+		datetime = flag.Arg(3)
+	}
+
+	store, err := OpenBuildStore(kerouacRoot)
+	if err != nil {
+		log.Fatalf("Error opening build db: %s", err)
+	}
+	defer store.Close()
+
+	recordedBuild, err := FindLatestBuild(store, project, tag, datetime)
+	if err != nil {
+		log.Fatalf("Error finding build: %s", err)
+	}
+	if recordedBuild == nil {
+		os.Exit(1)
+	}
+
+	manifest, err := ReadArtifactManifest(*recordedBuild.BuildId)
+	if err != nil {
+		log.Fatalf("Error reading artifacts: %s", err)
+	}
+
+	for _, artifact := range manifest.Artifacts {
+		if *longArtifacts {
+			fmt.Printf("%s  %d  %s\n", artifact.SHA256, artifact.Size, recordedBuild.FmtArtifactPath(artifact.Path))
+		} else {
+			fmt.Printf("%s\n", recordedBuild.FmtArtifactPath(artifact.Path))
+		}
+	}
+}
@@ -5,14 +5,21 @@ import (
 	"fmt"
 	"log"
 	"os"
+	"strings"
 )
 
+var listStatus = flag.String("status", "", "For kerouac list, only list builds with this status, e.g. QUEUED.")
+
 func DoListCommand() {
 	flag.Usage = func() {
 		fmt.Printf("Usage: kerouac list [options] <kerouacRootDir> [project] [tag] [datetime]\n\n")
 		fmt.Printf("Prints to stdout the list of build directories matching the supplied criteria.\n\n")
 		fmt.Printf("Example: 'kerouac list' would list all builds.\n\n")
-		fmt.Printf("Example: 'kerouac list myproj' would list all builds for myproj.\n")
+		fmt.Printf("Example: 'kerouac list myproj' would list all builds for myproj.\n\n")
+		fmt.Printf("Example: 'kerouac list --status QUEUED' would list the builds waiting for kerouac worker.\n\n")
+		fmt.Printf("Reruns (see kerouac rerun) are followed by a tab and 'rerun of <original build dir>'.\n")
+		fmt.Printf("Superseded builds (see SupersedeQueued) are followed by a tab and 'superseded by <build dir>'.\n\n")
+		flag.PrintDefaults()
 	}
 
 	flag.Parse()
@@ -37,14 +44,31 @@ func DoListCommand() {
 		datetime = flag.Arg(3)
 	}
 
-	recordedBuilds, err := FindMatchingBuilds(kerouacRoot, project, tag, datetime)
+	store, err := OpenBuildStore(kerouacRoot)
+	if err != nil {
+		log.Fatalf("Error opening build db: %s", err)
+	}
+	defer store.Close()
+
+	recordedBuilds, err := store.FindMatchingBuilds(project, tag, datetime)
 
 	if err != nil {
 		log.Fatalf("Error finding builds: %s", err)
 	}
 
+	status := BuildStatus(strings.ToUpper(*listStatus))
+
 	for _, recordedBuild := range recordedBuilds {
-		fmt.Printf("%s\n", recordedBuild.FmtBuildDir())
+		if status != "" && recordedBuild.Status != status {
+			continue
+		}
+		if recordedBuild.SupersededBy != nil {
+			fmt.Printf("%s\tsuperseded by %s\n", recordedBuild.FmtBuildDir(), recordedBuild.SupersededBy.FmtBuildDir())
+		} else if recordedBuild.RerunOf != nil {
+			fmt.Printf("%s\trerun of %s\n", recordedBuild.FmtBuildDir(), recordedBuild.RerunOf.FmtBuildDir())
+		} else {
+			fmt.Printf("%s\n", recordedBuild.FmtBuildDir())
+		}
 	}
 
 }
@@ -0,0 +1,164 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"io"
+	"os"
+	"time"
+)
+
+// Names of the log streams of a build, for kerouac logs and the log streaming
+// API.
+const (
+	StdoutStream  = "stdout"
+	StderrStream  = "stderr"
+	KerouacStream = "kerouac"
+	// stdout and stderr interleaved, with timestamps.  Not part of
+	// AllStreams, which would repeat everything in it.
+	CombinedStream = "combined"
+	AllStreams     = "all"
+)
+
+// How often to check log files for more output while following them.
+var logPollInterval = 500 * time.Millisecond
+
+// Called with each line of a log (without the newline) and its stream name.
+// Returning an error stops FollowBuildLogs.
+type LogLineFunc func(stream string, line string) error
+
+// Read the lines of the build's stream log(s) (one of the *Stream names),
+// passing each to emit.
+//
+// If follow, keep checking for more until the build is no longer RUNNING, or
+// until stop is closed.  Log files that don't exist yet are treated as empty.
+func FollowBuildLogs(store BuildStore, buildId BuildId, stream string, follow bool, stop <-chan struct{}, emit LogLineFunc) error {
+	tails, err := logTailsForStream(buildId, stream)
+	if err != nil {
+		return err
+	}
+	defer func() {
+		for _, tail := range tails {
+			tail.close()
+		}
+	}()
+
+	for {
+		// Check before reading, so that once we see the build is done we
+		// still read everything it wrote.
+		running := false
+		if follow {
+			recordedBuild, err := FindLatestBuild(store, buildId.Project, buildId.Tag, buildId.DateTime.Format(DateFormat))
+			if err != nil {
+				return err
+			}
+			running = recordedBuild != nil && recordedBuild.Status == RUNNING
+		}
+
+		for _, tail := range tails {
+			if err := tail.readLines(emit); err != nil {
+				return err
+			}
+		}
+
+		if !running {
+			break
+		}
+
+		select {
+		case <-stop:
+			return nil
+		case <-time.After(logPollInterval):
+		}
+	}
+
+	for _, tail := range tails {
+		if err := tail.flush(emit); err != nil {
+			return err
+		}
+	}
+
+	return nil
+}
+
+func logTailsForStream(buildId BuildId, stream string) ([]*logTail, error) {
+	switch stream {
+	case StdoutStream:
+		return []*logTail{{stream: StdoutStream, path: buildId.FmtStdoutLogPath()}}, nil
+	case StderrStream:
+		return []*logTail{{stream: StderrStream, path: buildId.FmtStderrLogPath()}}, nil
+	case KerouacStream:
+		return []*logTail{{stream: KerouacStream, path: buildId.FmtKerouacLogPath()}}, nil
+	case CombinedStream:
+		return []*logTail{{stream: CombinedStream, path: buildId.FmtCombinedLogPath()}}, nil
+	case AllStreams:
+		return []*logTail{
+			{stream: KerouacStream, path: buildId.FmtKerouacLogPath()},
+			{stream: StdoutStream, path: buildId.FmtStdoutLogPath()},
+			{stream: StderrStream, path: buildId.FmtStderrLogPath()},
+		}, nil
+	}
+	return nil, fmt.Errorf("Unknown log stream %s, expected %s, %s, %s, %s or %s", stream, StdoutStream, StderrStream, KerouacStream, CombinedStream, AllStreams)
+}
+
+// Follows one log file, remembering where it got to and any incomplete last
+// line.
+type logTail struct {
+	stream  string
+	path    string
+	file    *os.File
+	partial []byte
+}
+
+// Pass each complete line written since the last call to emit.
+func (t *logTail) readLines(emit LogLineFunc) error {
+	if t.file == nil {
+		file, err := os.Open(t.path)
+		if os.IsNotExist(err) {
+			return nil
+		} else if err != nil {
+			return err
+		}
+		t.file = file
+	}
+
+	buf := make([]byte, 32*1024)
+	for {
+		n, err := t.file.Read(buf)
+		t.partial = append(t.partial, buf[:n]...)
+
+		for {
+			newline := bytes.IndexByte(t.partial, '\n')
+			if newline < 0 {
+				break
+			}
+			line := string(t.partial[:newline])
+			t.partial = t.partial[newline+1:]
+			if err := emit(t.stream, line); err != nil {
+				return err
+			}
+		}
+
+		if err == io.EOF {
+			return nil
+		} else if err != nil {
+			return err
+		}
+	}
+}
+
+// Pass any incomplete last line to emit.
+func (t *logTail) flush(emit LogLineFunc) error {
+	if len(t.partial) == 0 {
+		return nil
+	}
+	line := string(t.partial)
+	t.partial = nil
+	return emit(t.stream, line)
+}
+
+func (t *logTail) close() {
+	if t.file != nil {
+		t.file.Close()
+	}
+}
@@ -0,0 +1,128 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func makeLogsTestBuild(t *testing.T) (*MemoryBuildStore, BuildId, string) {
+	rootDir, err := ioutil.TempDir("", "kerouac_logs_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewMemoryBuildStore(rootDir)
+	buildId := BuildIdAt(rootDir, KnownProject, KnownTag, KnownDateTime)
+	if err = store.CreateBuildRecord(buildId); err != nil {
+		t.Fatal(err)
+	}
+
+	if err = os.MkdirAll(buildId.FmtLogsDir(), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	return store, buildId, rootDir
+}
+
+func appendToFile(t *testing.T, path string, s string) {
+	file, err := os.OpenFile(path, os.O_WRONLY|os.O_APPEND|os.O_CREATE, 0600)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+	if _, err = file.WriteString(s); err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestReadBuildLogs(t *testing.T) {
+	store, buildId, rootDir := makeLogsTestBuild(t)
+	defer os.RemoveAll(rootDir)
+
+	appendToFile(t, buildId.FmtStdoutLogPath(), "out 1\nout 2\nno newline")
+	appendToFile(t, buildId.FmtStderrLogPath(), "err 1\n")
+
+	var lines []string
+	err := FollowBuildLogs(store, buildId, AllStreams, false, nil, func(stream string, line string) error {
+		lines = append(lines, stream+": "+line)
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// No kerouac.log yet, which is fine.
+	expected := []string{"stdout: out 1", "stdout: out 2", "stderr: err 1", "stdout: no newline"}
+	if !reflect.DeepEqual(lines, expected) {
+		t.Errorf("Read %q, expected %q", lines, expected)
+	}
+}
+
+func TestFollowBuildLogs(t *testing.T) {
+	store, buildId, rootDir := makeLogsTestBuild(t)
+	defer os.RemoveAll(rootDir)
+
+	defer func(interval time.Duration) { logPollInterval = interval }(logPollInterval)
+	logPollInterval = 10 * time.Millisecond
+
+	lines := make(chan string, 10)
+	done := make(chan error)
+	go func() {
+		done <- FollowBuildLogs(store, buildId, StdoutStream, true, nil, func(stream string, line string) error {
+			lines <- line
+			return nil
+		})
+	}()
+
+	appendToFile(t, buildId.FmtStdoutLogPath(), "line 1\nline")
+	if line := <-lines; line != "line 1" {
+		t.Errorf("Got %q, expected line 1", line)
+	}
+
+	appendToFile(t, buildId.FmtStdoutLogPath(), " 2\nlast")
+	if line := <-lines; line != "line 2" {
+		t.Errorf("Got %q, expected line 2", line)
+	}
+
+	if err := MarkBuildSucceeded(store, buildId); err != nil {
+		t.Fatal(err)
+	}
+
+	if err := <-done; err != nil {
+		t.Fatal(err)
+	}
+	if line := <-lines; line != "last" {
+		t.Errorf("Got %q, expected last", line)
+	}
+}
+
+func TestFollowBuildLogsStops(t *testing.T) {
+	store, buildId, rootDir := makeLogsTestBuild(t)
+	defer os.RemoveAll(rootDir)
+
+	stop := make(chan struct{})
+	close(stop)
+
+	// The build is still RUNNING, so only stop gets us out of here.
+	err := FollowBuildLogs(store, buildId, AllStreams, true, stop, func(stream string, line string) error {
+		return nil
+	})
+	if err != nil {
+		t.Fatal(err)
+	}
+}
+
+func TestFollowBuildLogsUnknownStream(t *testing.T) {
+	store, buildId, rootDir := makeLogsTestBuild(t)
+	defer os.RemoveAll(rootDir)
+
+	err := FollowBuildLogs(store, buildId, "stdin", false, nil, func(stream string, line string) error {
+		return nil
+	})
+	if err == nil {
+		t.Errorf("No error for unknown stream")
+	}
+}
@@ -0,0 +1,69 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+var followLogs = flag.Bool("follow", false, "For kerouac logs, keep printing output until the build finishes.")
+
+var logStream = flag.String("stream", AllStreams, "For kerouac logs, which log to print: stdout, stderr, kerouac, combined or all.")
+
+func init() {
+	flag.BoolVar(followLogs, "f", false, "Shorthand for --follow.")
+}
+
+func DoLogsCommand() {
+	flag.Usage = func() {
+		fmt.Printf("Usage: kerouac logs [options] <kerouacRootDir> <project> <tag> [datetime]\n\n")
+		fmt.Printf("Prints the logs of the specified build to stdout.  With --stream all, each line is\n")
+		fmt.Printf("prefixed with the name of the log it came from.\n\n")
+		fmt.Printf("If datetime is not specified, uses the latest build for the tag.\n\n")
+		fmt.Printf("Example: 'kerouac logs -f --stream stdout /var/kerouac myproj master@abc123'\n")
+	}
+
+	flag.Parse()
+
+	if len(flag.Args()) < 3 || len(flag.Args()) > 4 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	kerouacRoot := flag.Arg(0)
+	project := flag.Arg(1)
+	tag := flag.Arg(2)
+	var datetime string
+	if len(flag.Args()) == 4 {
+		datetime = flag.Arg(3)
+	}
+
+	store, err := OpenBuildStore(kerouacRoot)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	recordedBuild, err := FindLatestBuild(store, project, tag, datetime)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	if recordedBuild == nil {
+		os.Exit(1)
+	}
+
+	printLine := func(stream string, line string) error {
+		if *logStream == AllStreams {
+			_, err := fmt.Printf("[%s] %s\n", stream, line)
+			return err
+		}
+		_, err := fmt.Println(line)
+		return err
+	}
+
+	if err = FollowBuildLogs(store, *recordedBuild.BuildId, *logStream, *followLogs, nil, printLine); err != nil {
+		log.Fatal(err)
+	}
+}
@@ -30,13 +30,31 @@ func main() {
 		DoListCommand()
 	case "print":
 		DoPrintCommand()
+	case "migrate":
+		DoMigrateCommand()
+	case "serve":
+		DoServeCommand()
+	case "logs":
+		DoLogsCommand()
+	case "list-artifacts":
+		DoListArtifactsCommand()
+	case "extract":
+		DoExtractCommand()
+	case "rerun":
+		DoRerunCommand()
+	case "config":
+		DoConfigCommand()
+	case "enqueue":
+		DoEnqueueCommand()
+	case "worker":
+		DoWorkerCommand()
 	default:
 		usage()
 	}
 }
 
 func usage() {
-	fmt.Printf("Usage: kerouac {build, list, print}\n")
+	fmt.Printf("Usage: kerouac {build, list, print, logs, list-artifacts, extract, rerun, config, enqueue, worker, migrate, serve}\n")
 	fmt.Printf("\n")
 	fmt.Printf("Use kerouac <subcommand> -h for help.\n")
 	os.Exit(1)
@@ -0,0 +1,302 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"io/ioutil"
+	"log"
+	"os"
+	"os/signal"
+	"path/filepath"
+	"runtime"
+	"sort"
+	"strings"
+	"sync"
+	"syscall"
+)
+
+// Separates a matrix build's tag from the values of its child builds, e.g.
+// "v1.2~linux,1.20" for the child of "v1.2" with GOOS=linux and GOVERSION=1.20.
+const MatrixTagSeparator = "~"
+
+// One combination of a config's Matrix values.
+type MatrixCell struct {
+	// The variables and values, e.g. "GOOS=linux,GOVERSION=1.20".
+	Key string
+	// Just the values, e.g. "linux,1.20".
+	Values string
+	// The variables to add to the build's environment, as VAR=value.
+	Env []string
+}
+
+// Every combination of one value for each of matrix's variables, in order of
+// the variables' names and then of their values as given.
+func ExpandMatrix(matrix map[string][]string) []MatrixCell {
+	names := make([]string, 0, len(matrix))
+	for name := range matrix {
+		names = append(names, name)
+	}
+	sort.Strings(names)
+
+	combinations := [][]string{{}}
+	for _, name := range names {
+		next := make([][]string, 0, len(combinations)*len(matrix[name]))
+		for _, combination := range combinations {
+			for _, value := range matrix[name] {
+				next = append(next, append(append([]string{}, combination...), value))
+			}
+		}
+		combinations = next
+	}
+
+	cells := make([]MatrixCell, 0, len(combinations))
+	for _, values := range combinations {
+		env := make([]string, 0, len(names))
+		for i, name := range names {
+			env = append(env, name+"="+values[i])
+		}
+		cells = append(cells, MatrixCell{Key: strings.Join(env, ","), Values: strings.Join(values, ","), Env: env})
+	}
+	return cells
+}
+
+// The id of the child build of parent for cell.  It shares parent's datetime.
+func MatrixChildId(parent BuildId, cell MatrixCell) BuildId {
+	return BuildIdAt(parent.RootDir, parent.Project, parent.Tag+MatrixTagSeparator+cell.Values, parent.DateTime)
+}
+
+// The status of a matrix build, given those of its children: SUCCEEDED if they
+// all did, or else the worst of them.
+func AggregateMatrixStatus(statuses []BuildStatus) BuildStatus {
+	seen := make(map[BuildStatus]bool)
+	for _, status := range statuses {
+		seen[status] = true
+	}
+
+	for _, status := range []BuildStatus{CANCELLED, ERRORED, TIMED_OUT, FAILED} {
+		if seen[status] {
+			return status
+		}
+	}
+	if len(statuses) == 0 {
+		return FAILED
+	}
+	return SUCCEEDED
+}
+
+// Run a child build for each cell of config's Matrix, up to
+// MaxParallelMatrixBuilds (0 for one per CPU) at once, and record the
+// aggregate of their statuses as buildId's.
+//
+// Each child builds a copy of srcDir, with its cell's variables added to the
+// environment, and gets its own build dir, logs and tarball.
+func runMatrixBuild(srcDir string, config *Config, secrets Secrets, store BuildStore, buildId BuildId) BuildStatus {
+	cells := ExpandMatrix(config.Matrix)
+	log.Printf("Running matrix build of %d combinations", len(cells))
+
+	maxParallel := config.MaxParallelMatrixBuilds
+	if maxParallel == 0 {
+		maxParallel = runtime.NumCPU()
+	}
+
+	// Children that haven't started by the time we're told to stop never do;
+	// those that have are stopped by their own signal handling.
+	cancelled := make(chan struct{})
+	cancel := make(chan os.Signal, 1)
+	signal.Notify(cancel, os.Interrupt, syscall.SIGTERM)
+	defer signal.Stop(cancel)
+	finished := make(chan struct{})
+	defer close(finished)
+	go func() {
+		select {
+		case sig := <-cancel:
+			log.Printf("Received %s, not starting any more matrix builds.", sig)
+			close(cancelled)
+		case <-finished:
+		}
+	}()
+
+	statuses := make([]BuildStatus, len(cells))
+	slots := make(chan struct{}, maxParallel)
+	var wg sync.WaitGroup
+
+	for i, cell := range cells {
+		childId := MatrixChildId(buildId, cell)
+
+		slots <- struct{}{}
+		select {
+		case <-cancelled:
+			<-slots
+			statuses[i] = CANCELLED
+			recordCancelledMatrixChild(store, buildId, childId, cell)
+			continue
+		default:
+		}
+
+		wg.Add(1)
+		go func(i int, cell MatrixCell, childId BuildId) {
+			defer wg.Done()
+			defer func() { <-slots }()
+			statuses[i] = runMatrixChild(srcDir, config, secrets, store, buildId, childId, cell)
+		}(i, cell, childId)
+	}
+	wg.Wait()
+
+	status := AggregateMatrixStatus(statuses)
+	log.Printf("Completed matrix build, %s", status)
+
+	if !*dryRun {
+		if err := store.UpdateBuildStatus(buildId, status); err != nil {
+			log.Printf("Warning, could not record build as %s: %s", status, err)
+		}
+	}
+
+	return status
+}
+
+func runMatrixChild(srcDir string, config *Config, secrets Secrets, store BuildStore, parent BuildId, childId BuildId, cell MatrixCell) BuildStatus {
+	log.Printf("Starting matrix build %s with %s in %s", childId.Tag, cell.Key, childId.FmtBuildDir())
+
+	if *dryRun {
+		return runBuild(srcDir, config, secrets, cell.Env, store, childId)
+	}
+
+	if err := store.CreateMatrixBuildRecord(childId, parent, cell.Key); err != nil {
+		log.Printf("Could not create record for matrix build %s: %s", childId.Tag, err)
+		return ERRORED
+	}
+
+	status, err := buildMatrixChild(srcDir, config, secrets, store, childId, cell)
+	if err != nil {
+		log.Printf("Error running matrix build %s: %s", childId.Tag, err)
+		if err := MarkBuildErrored(store, childId); err != nil {
+			log.Printf("Could not mark matrix build %s errored in db: %s", childId.Tag, err)
+		}
+		return ERRORED
+	}
+
+	log.Printf("Completed matrix build %s, %s", childId.Tag, status)
+	return status
+}
+
+// Build a copy of srcDir for childId and tarball the result, unless
+// --no-tarball.
+func buildMatrixChild(srcDir string, config *Config, secrets Secrets, store BuildStore, childId BuildId, cell MatrixCell) (BuildStatus, error) {
+	if err := os.MkdirAll(childId.FmtLogsDir(), 0700); err != nil {
+		return ERRORED, err
+	}
+
+	childSrcDir, err := ioutil.TempDir("", "kerouac_matrix_")
+	if err != nil {
+		return ERRORED, err
+	}
+	defer os.RemoveAll(childSrcDir)
+
+	if err = copySrcDir(srcDir, childSrcDir); err != nil {
+		return ERRORED, fmt.Errorf("Could not copy %s for matrix build: %s", srcDir, err)
+	}
+
+	status := runBuild(childSrcDir, config, secrets, cell.Env, store, childId)
+
+	if !*noTarball {
+		if err = CreateTarball(childSrcDir, config.TarballExcludes, childId); err != nil {
+			return ERRORED, fmt.Errorf("Error creating tarball: %s", err)
+		}
+	}
+
+	return status, nil
+}
+
+func recordCancelledMatrixChild(store BuildStore, parent BuildId, childId BuildId, cell MatrixCell) {
+	log.Printf("Not starting matrix build %s", childId.Tag)
+
+	if *dryRun {
+		return
+	}
+
+	if err := store.CreateMatrixBuildRecord(childId, parent, cell.Key); err != nil {
+		log.Printf("Could not create record for matrix build %s: %s", childId.Tag, err)
+	} else if err := store.UpdateBuildStatus(childId, CANCELLED); err != nil {
+		log.Printf("Warning, could not record matrix build %s as %s: %s", childId.Tag, CANCELLED, err)
+	}
+}
+
+// Copy the contents of srcDir into dstDir, which must exist, keeping the
+// modes and modification times of files and dirs.  Symlinks are copied as
+// symlinks, and special files are skipped.
+func copySrcDir(srcDir string, dstDir string) error {
+	// Dirs get their modes once everything is in them, in case they aren't
+	// writable.
+	var dirs []string
+	var dirInfos []os.FileInfo
+
+	err := filepath.Walk(srcDir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(srcDir, filePath)
+		if err != nil {
+			return err
+		}
+		target := filepath.Join(dstDir, rel)
+
+		switch {
+		case info.IsDir():
+			dirs = append(dirs, target)
+			dirInfos = append(dirInfos, info)
+			return os.MkdirAll(target, 0700)
+		case info.Mode()&os.ModeSymlink != 0:
+			linkname, err := os.Readlink(filePath)
+			if err != nil {
+				return err
+			}
+			return os.Symlink(linkname, target)
+		case info.Mode().IsRegular():
+			return copySrcFile(filePath, target, info)
+		default:
+			log.Printf("Not copying %s, it is not a regular file, dir or symlink", filePath)
+			return nil
+		}
+	})
+	if err != nil {
+		return err
+	}
+
+	// Innermost first, so setting a dir's time isn't undone by its children.
+	for i := len(dirs) - 1; i >= 0; i-- {
+		if err = os.Chmod(dirs[i], dirInfos[i].Mode().Perm()); err != nil {
+			return err
+		}
+		if err = os.Chtimes(dirs[i], dirInfos[i].ModTime(), dirInfos[i].ModTime()); err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+func copySrcFile(filePath string, target string, info os.FileInfo) error {
+	src, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer src.Close()
+
+	dst, err := os.OpenFile(target, os.O_WRONLY|os.O_CREATE|os.O_EXCL, info.Mode().Perm())
+	if err != nil {
+		return err
+	}
+	if _, err = io.Copy(dst, src); err != nil {
+		dst.Close()
+		return err
+	}
+	if err = dst.Close(); err != nil {
+		return err
+	}
+
+	// The umask may have taken bits off the mode.
+	if err = os.Chmod(target, info.Mode().Perm()); err != nil {
+		return err
+	}
+	return os.Chtimes(target, info.ModTime(), info.ModTime())
+}
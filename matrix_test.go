@@ -0,0 +1,161 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+func TestExpandMatrix(t *testing.T) {
+	cells := ExpandMatrix(map[string][]string{"GOVERSION": {"1.19", "1.20"}, "GOOS": {"linux", "darwin"}})
+
+	keys := make([]string, 0, len(cells))
+	for _, cell := range cells {
+		keys = append(keys, cell.Key)
+	}
+	expected := []string{
+		"GOOS=linux,GOVERSION=1.19",
+		"GOOS=linux,GOVERSION=1.20",
+		"GOOS=darwin,GOVERSION=1.19",
+		"GOOS=darwin,GOVERSION=1.20",
+	}
+	if !reflect.DeepEqual(keys, expected) {
+		t.Errorf("Matrix expanded to %v not %v", keys, expected)
+	}
+
+	if cells[1].Values != "linux,1.20" || !reflect.DeepEqual(cells[1].Env, []string{"GOOS=linux", "GOVERSION=1.20"}) {
+		t.Errorf("Cell was %+v", cells[1])
+	}
+
+	parent := BuildIdAt(KnownRootDir, KnownProject, KnownTag, KnownDateTime)
+	child := MatrixChildId(parent, cells[1])
+	if child.Tag != KnownTag+"~linux,1.20" || child.DateTime != parent.DateTime {
+		t.Errorf("Child id was %+v", child)
+	}
+}
+
+func TestAggregateMatrixStatus(t *testing.T) {
+	for _, test := range []struct {
+		statuses []BuildStatus
+		expected BuildStatus
+	}{
+		{[]BuildStatus{SUCCEEDED, SUCCEEDED}, SUCCEEDED},
+		{[]BuildStatus{SUCCEEDED, FAILED, TIMED_OUT}, TIMED_OUT},
+		{[]BuildStatus{FAILED, ERRORED, SUCCEEDED}, ERRORED},
+		{[]BuildStatus{ERRORED, CANCELLED}, CANCELLED},
+		{nil, FAILED},
+	} {
+		if status := AggregateMatrixStatus(test.statuses); status != test.expected {
+			t.Errorf("Aggregate of %v was %s not %s", test.statuses, status, test.expected)
+		}
+	}
+}
+
+func TestRunMatrixBuild(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "kerouac_matrix_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// Fails for darwin, and leaves a file behind to check children don't share
+	// a source dir.
+	srcDir, buildId := makeScriptBuild(t, tmpDir, "#!/bin/sh\n[ -e built ] && exit 3\ntouch built\necho $GOOS\n[ $GOOS = linux ]\n")
+
+	store := NewMemoryBuildStore(buildId.RootDir)
+	if err = store.CreateBuildRecord(buildId); err != nil {
+		t.Fatal(err)
+	}
+
+	config := &Config{
+		BuildScript:             "./build.sh",
+		TimeoutInSecs:           10,
+		Matrix:                  map[string][]string{"GOOS": {"linux", "darwin"}},
+		MaxParallelMatrixBuilds: 1,
+	}
+
+	if status := runMatrixBuild(srcDir, config, nil, store, buildId); status != FAILED {
+		t.Errorf("Matrix build was %s not FAILED", status)
+	}
+
+	children, err := FindMatrixChildren(store, buildId)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != 2 {
+		t.Fatalf("Found %d children not 2: %+v", len(children), children)
+	}
+
+	for _, child := range children {
+		var expected BuildStatus = SUCCEEDED
+		if child.MatrixKey == "GOOS=darwin" {
+			expected = FAILED
+		}
+		if child.Status != expected {
+			t.Errorf("Child %s was %s not %s", child.Tag, child.Status, expected)
+		}
+
+		stdout, err := ioutil.ReadFile(child.FmtStdoutLogPath())
+		if err != nil {
+			t.Fatal(err)
+		}
+		if value := strings.TrimPrefix(child.MatrixKey, "GOOS="); string(stdout) != value+"\n" {
+			t.Errorf("Child %s wrote %q", child.Tag, stdout)
+		}
+
+		if _, err := os.Stat(child.FmtTarballPath()); err != nil {
+			t.Errorf("Child %s has no tarball: %s", child.Tag, err)
+		}
+	}
+
+	if _, err := os.Stat(srcDir + "/built"); !os.IsNotExist(err) {
+		t.Errorf("Matrix build changed the source dir: %v", err)
+	}
+}
+
+func TestCopySrcDir(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "kerouac_matrix_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	srcDir := filepath.Join(tmpDir, "src")
+	os.MkdirAll(filepath.Join(srcDir, "lib", "readonly"), 0700)
+	ioutil.WriteFile(filepath.Join(srcDir, "build.sh"), []byte("#!/bin/sh\n"), 0750)
+	ioutil.WriteFile(filepath.Join(srcDir, "lib", "readonly", "data"), []byte("data"), 0400)
+	os.Symlink("lib/readonly", filepath.Join(srcDir, "data"))
+	os.Chmod(filepath.Join(srcDir, "lib", "readonly"), 0500)
+	defer os.Chmod(filepath.Join(srcDir, "lib", "readonly"), 0700)
+	modTime := KnownDateTime
+	os.Chtimes(filepath.Join(srcDir, "build.sh"), modTime, modTime)
+
+	dstDir := filepath.Join(tmpDir, "dst")
+	os.Mkdir(dstDir, 0700)
+	if err = copySrcDir(srcDir, dstDir); err != nil {
+		t.Fatal(err)
+	}
+	defer os.Chmod(filepath.Join(dstDir, "lib", "readonly"), 0700)
+
+	for name, mode := range map[string]os.FileMode{"build.sh": 0750, "lib/readonly": os.ModeDir | 0500, "lib/readonly/data": 0400} {
+		info, err := os.Lstat(filepath.Join(dstDir, name))
+		if err != nil {
+			t.Errorf("Copy is missing %s: %s", name, err)
+		} else if info.Mode() != mode {
+			t.Errorf("%s copied with mode %s not %s", name, info.Mode(), mode)
+		}
+	}
+
+	if info, err := os.Stat(filepath.Join(dstDir, "build.sh")); err != nil || !info.ModTime().Equal(modTime) {
+		t.Errorf("build.sh copied with modification time %v, %v", info, err)
+	}
+	if linkname, err := os.Readlink(filepath.Join(dstDir, "data")); err != nil || linkname != "lib/readonly" {
+		t.Errorf("Symlink copied as %q, %v", linkname, err)
+	}
+	if data, err := ioutil.ReadFile(filepath.Join(dstDir, "data", "data")); err != nil || string(data) != "data" {
+		t.Errorf("Copied file has %q, %v", data, err)
+	}
+}
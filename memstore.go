@@ -0,0 +1,287 @@
+package main
+
+import (
+	"fmt"
+	"sort"
+	"sync"
+	"time"
+)
+
+// MemoryBuildStore keeps build records in memory only, for tests and dry runs.
+type MemoryBuildStore struct {
+	rootDir string
+	mutex   sync.Mutex
+	builds  []RecordedBuild
+	queued  []QueuedBuild
+}
+
+func NewMemoryBuildStore(rootDir string) *MemoryBuildStore {
+	return &MemoryBuildStore{rootDir: rootDir}
+}
+
+func (s *MemoryBuildStore) CreateBuildRecord(buildId BuildId) error {
+	return s.create(RecordedBuild{BuildId: &buildId})
+}
+
+func (s *MemoryBuildStore) CreateMatrixBuildRecord(buildId BuildId, parent BuildId, matrixKey string) error {
+	return s.create(RecordedBuild{BuildId: &buildId, Parent: &parent, MatrixKey: matrixKey})
+}
+
+func (s *MemoryBuildStore) CreateRerunBuildRecord(buildId BuildId, original BuildId) error {
+	return s.create(RecordedBuild{BuildId: &buildId, RerunOf: &original})
+}
+
+func (s *MemoryBuildStore) CreateQueuedBuildRecord(queued QueuedBuild) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if err := s.add(RecordedBuild{BuildId: queued.BuildId, Status: QUEUED}); err != nil {
+		return err
+	}
+	buildId := BuildIdAt(s.rootDir, queued.Project, queued.Tag, truncateToDateFormat(queued.DateTime))
+	queued.BuildId = &buildId
+	queued.BuildFlags = append([]string{}, queued.BuildFlags...)
+	s.queued = append(s.queued, queued)
+	return nil
+}
+
+func (s *MemoryBuildStore) StartQueuedBuild(buildId BuildId) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	recordedBuild := s.find(buildId)
+	if recordedBuild == nil || recordedBuild.Status != QUEUED {
+		return fmt.Errorf("Build of %s with tag %s at %s is not queued", buildId.Project, buildId.Tag, buildId.DateTime.Format(DateFormat))
+	}
+	recordedBuild.Status = RUNNING
+	s.dequeue(*recordedBuild.BuildId)
+	return nil
+}
+
+func (s *MemoryBuildStore) SupersedeQueuedBuild(buildId BuildId, supersededBy BuildId) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	recordedBuild := s.find(buildId)
+	if recordedBuild == nil || recordedBuild.Status != QUEUED {
+		return fmt.Errorf("Build of %s with tag %s at %s is not queued", buildId.Project, buildId.Tag, buildId.DateTime.Format(DateFormat))
+	}
+	recordedBuild.Status = SUPERSEDED
+	recordedBuild.EndTime = truncateToDateFormat(time.Now().UTC())
+	supersededById := BuildIdAt(s.rootDir, buildId.Project, supersededBy.Tag, truncateToDateFormat(supersededBy.DateTime))
+	recordedBuild.SupersededBy = &supersededById
+	s.dequeue(*recordedBuild.BuildId)
+	return nil
+}
+
+func (s *MemoryBuildStore) FindQueuedBuilds() ([]QueuedBuild, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	queuedBuilds := make([]QueuedBuild, 0, len(s.queued))
+	for _, queued := range s.queued {
+		if recordedBuild := s.find(*queued.BuildId); recordedBuild == nil || recordedBuild.Status != QUEUED {
+			continue
+		}
+		buildId := *queued.BuildId
+		queued.BuildId = &buildId
+		queued.BuildFlags = append([]string{}, queued.BuildFlags...)
+		queuedBuilds = append(queuedBuilds, queued)
+	}
+
+	sort.SliceStable(queuedBuilds, func(i, j int) bool {
+		return queuedBuilds[i].DateTime.Before(queuedBuilds[j].DateTime)
+	})
+	return queuedBuilds, nil
+}
+
+func (s *MemoryBuildStore) create(recordedBuild RecordedBuild) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	recordedBuild.Status = RUNNING
+	return s.add(recordedBuild)
+}
+
+// Must be called with the mutex held.
+func (s *MemoryBuildStore) add(recordedBuild RecordedBuild) error {
+	buildId := recordedBuild.BuildId
+	if s.find(*buildId) != nil {
+		return fmt.Errorf("Build of %s with tag %s at %s already recorded", buildId.Project, buildId.Tag, buildId.DateTime.Format(DateFormat))
+	}
+
+	recordedId := BuildIdAt(s.rootDir, buildId.Project, buildId.Tag, truncateToDateFormat(buildId.DateTime))
+	recordedBuild.BuildId = &recordedId
+	if recordedBuild.Parent != nil {
+		parentId := BuildIdAt(s.rootDir, buildId.Project, recordedBuild.Parent.Tag, recordedId.DateTime)
+		recordedBuild.Parent = &parentId
+	}
+	if recordedBuild.RerunOf != nil {
+		originalId := BuildIdAt(s.rootDir, buildId.Project, recordedBuild.RerunOf.Tag, truncateToDateFormat(recordedBuild.RerunOf.DateTime))
+		recordedBuild.RerunOf = &originalId
+	}
+
+	s.builds = append(s.builds, recordedBuild)
+	return nil
+}
+
+func (s *MemoryBuildStore) UpdateBuildStatus(buildId BuildId, status BuildStatus) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if recordedBuild := s.find(buildId); recordedBuild != nil {
+		recordedBuild.Status = status
+		recordedBuild.EndTime = truncateToDateFormat(time.Now().UTC())
+	}
+	return nil
+}
+
+func (s *MemoryBuildStore) RecordConfigHash(buildId BuildId, configHash string) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if recordedBuild := s.find(buildId); recordedBuild != nil {
+		recordedBuild.ConfigHash = configHash
+	}
+	return nil
+}
+
+func (s *MemoryBuildStore) RecordBuildUsage(buildId BuildId, usage *ProcessUsage) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	if recordedBuild := s.find(buildId); recordedBuild != nil {
+		usageCopy := *usage
+		recordedBuild.Usage = &usageCopy
+	}
+	return nil
+}
+
+func (s *MemoryBuildStore) RecordBuildStep(buildId BuildId, step RecordedStep) error {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	recordedBuild := s.find(buildId)
+	if recordedBuild == nil {
+		return nil
+	}
+
+	step = copyRecordedStep(step)
+	step.StartTime = truncateToStepTimeFormat(step.StartTime)
+	step.Duration = step.Duration.Truncate(time.Millisecond)
+
+	for i := range recordedBuild.Steps {
+		if recordedBuild.Steps[i].Position == step.Position {
+			recordedBuild.Steps[i] = step
+			return nil
+		}
+	}
+
+	recordedBuild.Steps = append(recordedBuild.Steps, step)
+	sort.SliceStable(recordedBuild.Steps, func(i, j int) bool {
+		return recordedBuild.Steps[i].Position < recordedBuild.Steps[j].Position
+	})
+	return nil
+}
+
+func (s *MemoryBuildStore) FindMatchingBuilds(project string, tag string, datetime string) ([]RecordedBuild, error) {
+	s.mutex.Lock()
+	defer s.mutex.Unlock()
+
+	recordedBuilds := make([]RecordedBuild, 0, 0)
+
+	for _, recordedBuild := range s.builds {
+		if project != "" && recordedBuild.Project != project {
+			continue
+		}
+		if tag != "" && recordedBuild.Tag != tag {
+			continue
+		}
+		if datetime != "" && recordedBuild.DateTime.Format(DateFormat) != datetime {
+			continue
+		}
+
+		// Copy, so callers can't change our records behind our back.
+		buildId := *recordedBuild.BuildId
+		recordedBuild.BuildId = &buildId
+		if recordedBuild.Parent != nil {
+			parentId := *recordedBuild.Parent
+			recordedBuild.Parent = &parentId
+		}
+		if recordedBuild.RerunOf != nil {
+			originalId := *recordedBuild.RerunOf
+			recordedBuild.RerunOf = &originalId
+		}
+		if recordedBuild.SupersededBy != nil {
+			supersededById := *recordedBuild.SupersededBy
+			recordedBuild.SupersededBy = &supersededById
+		}
+		if recordedBuild.Usage != nil {
+			usage := *recordedBuild.Usage
+			recordedBuild.Usage = &usage
+		}
+		if recordedBuild.Steps != nil {
+			steps := make([]RecordedStep, 0, len(recordedBuild.Steps))
+			for _, step := range recordedBuild.Steps {
+				steps = append(steps, copyRecordedStep(step))
+			}
+			recordedBuild.Steps = steps
+		}
+		recordedBuilds = append(recordedBuilds, recordedBuild)
+	}
+
+	sort.SliceStable(recordedBuilds, func(i, j int) bool {
+		return recordedBuilds[i].DateTime.After(recordedBuilds[j].DateTime)
+	})
+
+	return recordedBuilds, nil
+}
+
+func (s *MemoryBuildStore) Close() error {
+	return nil
+}
+
+// Must be called with the mutex held.
+func (s *MemoryBuildStore) find(buildId BuildId) *RecordedBuild {
+	dateTime := buildId.DateTime.Format(DateFormat)
+	for i := range s.builds {
+		recordedBuild := &s.builds[i]
+		if recordedBuild.Project == buildId.Project && recordedBuild.Tag == buildId.Tag && recordedBuild.DateTime.Format(DateFormat) == dateTime {
+			return recordedBuild
+		}
+	}
+	return nil
+}
+
+// Must be called with the mutex held.
+func (s *MemoryBuildStore) dequeue(buildId BuildId) {
+	for i, queued := range s.queued {
+		if queued.SameBuild(buildId) {
+			s.queued = append(s.queued[:i], s.queued[i+1:]...)
+			return
+		}
+	}
+}
+
+func copyRecordedStep(step RecordedStep) RecordedStep {
+	if step.Usage != nil {
+		usage := *step.Usage
+		step.Usage = &usage
+	}
+	return step
+}
+
+// Times only go into a SQLBuildStore to DateFormat's precision, so do the same
+// here to behave the same way.
+func truncateToDateFormat(t time.Time) time.Time {
+	truncated, _ := time.Parse(DateFormat, t.Format(DateFormat))
+	return truncated
+}
+
+func truncateToStepTimeFormat(t time.Time) time.Time {
+	if t.IsZero() {
+		return t
+	}
+	truncated, _ := time.Parse(StepTimeFormat, t.UTC().Format(StepTimeFormat))
+	return truncated
+}
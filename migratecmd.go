@@ -0,0 +1,47 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+)
+
+func DoMigrateCommand() {
+	flag.Usage = func() {
+		fmt.Printf("Usage: kerouac migrate [options] <kerouacRootDir>\n\n")
+		fmt.Printf("Brings the schema of the kerouac builds db up to date.\n\n")
+		fmt.Printf("Other subcommands do this automatically; this is for doing it ahead of time, or\n")
+		fmt.Printf("with --dry-run, seeing what would be done.\n")
+	}
+
+	flag.Parse()
+
+	if len(flag.Args()) != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	kerouacRoot := flag.Arg(0)
+
+	version, migrations, err := MigrateBuildDb(kerouacRoot, *dryRun)
+
+	fmt.Printf("Builds db was at schema version %d.\n", version)
+
+	verb := "Applied"
+	if *dryRun {
+		verb = "Would apply"
+	}
+
+	for _, migration := range migrations {
+		fmt.Printf("%s migration %d: %s\n", verb, migration.Version, migration.Description)
+	}
+
+	if err != nil {
+		log.Fatalf("Error migrating builds db: %s", err)
+	}
+
+	if len(migrations) == 0 {
+		fmt.Printf("Nothing to do.\n")
+	}
+}
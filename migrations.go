@@ -0,0 +1,261 @@
+package main
+
+import (
+	"context"
+	"database/sql"
+	"fmt"
+	"time"
+)
+
+// Schema migrations for builds.db.
+//
+// The db records which migrations have been applied in the schema_version
+// table.  Migrations are applied in order, each in its own transaction, when
+// a SQLBuildStore is created (or explicitly by kerouac migrate).
+//
+// Never edit a migration once it has been released; to change the schema, add
+// a new one to the end of migrations.
+
+// A Migration takes builds.db from schema version Version-1 to Version.
+type Migration struct {
+	Version     int
+	Description string
+	apply       func(conn *sql.Conn) error
+}
+
+var migrations = []Migration{
+	{1, "Create builds table and index", execAll(
+		"CREATE TABLE IF NOT EXISTS builds (id INTEGER PRIMARYKEY ASC, project TEXT NOT NULL, tag TEXT NOT NULL, started_at TEXT NOT NULL, finished_at TEXT, status TEXT)",
+		"CREATE UNIQUE INDEX IF NOT EXISTS builds_idx ON builds (project, tag, started_at)",
+	)},
+	// Dbs from before schema_version existed may already have these.
+	{2, "Add build script exit code and resource usage columns to builds", addMissingColumns("builds", [][2]string{
+		{"exit_code", "INTEGER"},
+		{"signal", "INTEGER"},
+		{"user_time_ms", "INTEGER"},
+		{"system_time_ms", "INTEGER"},
+		{"max_rss_kb", "INTEGER"},
+	})},
+	// The original table said PRIMARYKEY, so id was never a rowid alias (and
+	// was always NULL).  SQLite can't alter a primary key, so copy the table.
+	{3, "Rebuild builds with id as INTEGER PRIMARY KEY", execAll(
+		"CREATE TABLE builds_new (id INTEGER PRIMARY KEY ASC, project TEXT NOT NULL, tag TEXT NOT NULL, started_at TEXT NOT NULL, finished_at TEXT, status TEXT, exit_code INTEGER, signal INTEGER, user_time_ms INTEGER, system_time_ms INTEGER, max_rss_kb INTEGER)",
+		"INSERT INTO builds_new (project, tag, started_at, finished_at, status, exit_code, signal, user_time_ms, system_time_ms, max_rss_kb) SELECT project, tag, started_at, finished_at, status, exit_code, signal, user_time_ms, system_time_ms, max_rss_kb FROM builds ORDER BY rowid",
+		"DROP TABLE builds",
+		"ALTER TABLE builds_new RENAME TO builds",
+		"CREATE UNIQUE INDEX builds_idx ON builds (project, tag, started_at)",
+	)},
+	{4, "Create build_steps table", execAll(
+		"CREATE TABLE build_steps (id INTEGER PRIMARY KEY ASC, build_id INTEGER NOT NULL REFERENCES builds (id), position INTEGER NOT NULL, name TEXT NOT NULL, status TEXT NOT NULL, started_at TEXT, duration_ms INTEGER, exit_code INTEGER, signal INTEGER, user_time_ms INTEGER, system_time_ms INTEGER, max_rss_kb INTEGER, UNIQUE (build_id, position))",
+	)},
+	// A matrix build's children have the same project and started_at as it,
+	// so the parent's tag is enough to find it.
+	{5, "Add matrix build parent_tag and matrix_key columns to builds", execAll(
+		"ALTER TABLE builds ADD COLUMN parent_tag TEXT",
+		"ALTER TABLE builds ADD COLUMN matrix_key TEXT",
+	)},
+	// Reruns are of builds of the same project.
+	{6, "Add rerun_of_tag and rerun_of_started_at columns to builds", execAll(
+		"ALTER TABLE builds ADD COLUMN rerun_of_tag TEXT",
+		"ALTER TABLE builds ADD COLUMN rerun_of_started_at TEXT",
+	)},
+	{7, "Add config_hash column to builds", execAll(
+		"ALTER TABLE builds ADD COLUMN config_hash TEXT",
+	)},
+	// build_flags is a JSON list.  Rows stay until the build is started.
+	{8, "Create queued_builds table", execAll(
+		"CREATE TABLE queued_builds (build_id INTEGER PRIMARY KEY REFERENCES builds (id), src_dir TEXT NOT NULL, config_file TEXT NOT NULL, build_flags TEXT NOT NULL)",
+	)},
+	// Superseding builds are of the same project.
+	{9, "Add superseded_by_tag and superseded_by_started_at columns to builds", execAll(
+		"ALTER TABLE builds ADD COLUMN superseded_by_tag TEXT",
+		"ALTER TABLE builds ADD COLUMN superseded_by_started_at TEXT",
+	)},
+}
+
+const createSchemaVersionTable = "CREATE TABLE IF NOT EXISTS schema_version (version INTEGER PRIMARY KEY, description TEXT NOT NULL, applied_at TEXT NOT NULL)"
+
+// Find the schema version of the builds db under rootDir and the migrations
+// pending for it, applying them unless dryRun.
+func MigrateBuildDb(rootDir string, dryRun bool) (int, []Migration, error) {
+	db, err := openBuildDb(rootDir)
+	if err != nil {
+		return 0, nil, err
+	}
+	defer db.Close()
+
+	version, pending, err := findPendingMigrations(db)
+	if err != nil || dryRun {
+		return version, pending, err
+	}
+
+	applied, err := applyMigrations(db)
+	return version, applied, err
+}
+
+// Apply any pending migrations to db, returning those applied.
+func applyMigrations(db *sql.DB) ([]Migration, error) {
+	_, pending, err := findPendingMigrations(db)
+	if err != nil || len(pending) == 0 {
+		return nil, err
+	}
+
+	// Transactions are per connection, so we need to hold on to one.
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return nil, err
+	}
+	defer conn.Close()
+
+	applied := make([]Migration, 0, len(pending))
+
+	for _, migration := range pending {
+		wasApplied, err := applyMigration(conn, migration)
+		if err != nil {
+			return applied, fmt.Errorf("Error applying migration %d (%s): %s", migration.Version, migration.Description, err)
+		}
+		if wasApplied {
+			applied = append(applied, migration)
+		}
+	}
+
+	return applied, nil
+}
+
+// Apply migration in a transaction, unless another kerouac got there first.
+//
+// Returns whether the migration was applied.
+func applyMigration(conn *sql.Conn, migration Migration) (applied bool, err error) {
+	// IMMEDIATE takes the write lock up front, so concurrent kerouacs wait
+	// for each other here rather than both trying to migrate.
+	if err = connExec(conn, "BEGIN IMMEDIATE"); err != nil {
+		return false, err
+	}
+	defer func() {
+		if err != nil {
+			connExec(conn, "ROLLBACK")
+		}
+	}()
+
+	version, err := findSchemaVersion(conn)
+	if err != nil {
+		return false, err
+	}
+
+	if version >= migration.Version {
+		return false, connExec(conn, "COMMIT")
+	}
+
+	if err = connExec(conn, createSchemaVersionTable); err != nil {
+		return false, err
+	}
+
+	if err = migration.apply(conn); err != nil {
+		return false, err
+	}
+
+	if err = connExec(conn, "INSERT INTO schema_version (version, description, applied_at) VALUES (?, ?, ?)", migration.Version, migration.Description, time.Now().UTC().Format(DateFormat)); err != nil {
+		return false, err
+	}
+
+	return true, connExec(conn, "COMMIT")
+}
+
+func findPendingMigrations(db *sql.DB) (int, []Migration, error) {
+	conn, err := db.Conn(context.Background())
+	if err != nil {
+		return 0, nil, err
+	}
+	defer conn.Close()
+
+	version, err := findSchemaVersion(conn)
+	if err != nil {
+		return 0, nil, err
+	}
+
+	if version > len(migrations) {
+		return version, nil, fmt.Errorf("builds db is at schema version %d, but this kerouac only knows up to %d", version, len(migrations))
+	}
+
+	return version, migrations[version:], nil
+}
+
+// Returns 0 for dbs that have never been migrated.
+func findSchemaVersion(conn *sql.Conn) (int, error) {
+	ctx := context.Background()
+
+	var count int
+	if err := conn.QueryRowContext(ctx, "SELECT COUNT(*) FROM sqlite_master WHERE type = 'table' AND name = 'schema_version'").Scan(&count); err != nil {
+		return 0, err
+	}
+
+	if count == 0 {
+		return 0, nil
+	}
+
+	var version int
+	if err := conn.QueryRowContext(ctx, "SELECT COALESCE(MAX(version), 0) FROM schema_version").Scan(&version); err != nil {
+		return 0, err
+	}
+
+	return version, nil
+}
+
+func connExec(conn *sql.Conn, query string, args ...interface{}) error {
+	_, err := conn.ExecContext(context.Background(), query, args...)
+	return err
+}
+
+func execAll(stmts ...string) func(conn *sql.Conn) error {
+	return func(conn *sql.Conn) error {
+		for _, stmt := range stmts {
+			if err := connExec(conn, stmt); err != nil {
+				return err
+			}
+		}
+		return nil
+	}
+}
+
+// Add each of columns (name, type pairs) to table, unless it's already there.
+func addMissingColumns(table string, columns [][2]string) func(conn *sql.Conn) error {
+	return func(conn *sql.Conn) error {
+		existing, err := findColumns(conn, table)
+		if err != nil {
+			return err
+		}
+
+		for _, column := range columns {
+			if existing[column[0]] {
+				continue
+			}
+			if err := connExec(conn, fmt.Sprintf("ALTER TABLE %s ADD COLUMN %s %s", table, column[0], column[1])); err != nil {
+				return err
+			}
+		}
+
+		return nil
+	}
+}
+
+func findColumns(conn *sql.Conn, table string) (map[string]bool, error) {
+	rows, err := conn.QueryContext(context.Background(), fmt.Sprintf("PRAGMA table_info(%s)", table))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	columns := make(map[string]bool)
+
+	for rows.Next() {
+		var cid, notNull, pk int
+		var name, colType string
+		var defaultValue sql.NullString
+		if err = rows.Scan(&cid, &name, &colType, &notNull, &defaultValue, &pk); err != nil {
+			return nil, err
+		}
+		columns[name] = true
+	}
+
+	return columns, rows.Err()
+}
@@ -0,0 +1,134 @@
+package main
+
+import (
+	"context"
+	"io/ioutil"
+	"os"
+	"testing"
+)
+
+// The builds table as created by kerouac before schema_version existed.
+const unversionedBuildsTable = "CREATE TABLE IF NOT EXISTS builds (id INTEGER PRIMARYKEY ASC, project TEXT NOT NULL, tag TEXT NOT NULL, started_at TEXT NOT NULL, finished_at TEXT, status TEXT, exit_code INTEGER, signal INTEGER, user_time_ms INTEGER, system_time_ms INTEGER, max_rss_kb INTEGER)"
+
+const unversionedBuildsUniqueIdx = "CREATE UNIQUE INDEX IF NOT EXISTS builds_idx ON builds (project, tag, started_at)"
+
+func createUnversionedDb(t *testing.T, rootDir string) {
+	db, err := openBuildDb(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer db.Close()
+
+	stmts := []string{
+		unversionedBuildsTable,
+		unversionedBuildsUniqueIdx,
+		"INSERT INTO builds (project, tag, started_at, finished_at, status) VALUES ('proj', 'one', '2014-01-01 00:00:00', '2014-01-01 00:01:00', 'SUCCEEDED')",
+		"INSERT INTO builds (project, tag, started_at, finished_at, status, exit_code, signal, user_time_ms, system_time_ms, max_rss_kb) VALUES ('proj', 'two', '2014-01-02 00:00:00', '2014-01-02 00:01:00', 'FAILED', 2, 0, 10, 20, 30)",
+	}
+	for _, stmt := range stmts {
+		if _, err := db.Exec(stmt); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestMigrateFreshDb(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "kerouac_migrations_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	version, applied, err := MigrateBuildDb(rootDir, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != 0 {
+		t.Errorf("Fresh db was at version %d", version)
+	}
+	if len(applied) != len(migrations) {
+		t.Errorf("Applied %d migrations to fresh db, not %d", len(applied), len(migrations))
+	}
+
+	version, pending, err := MigrateBuildDb(rootDir, true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != len(migrations) || len(pending) != 0 {
+		t.Errorf("Migrated db at version %d with %d pending", version, len(pending))
+	}
+}
+
+func TestMigrateDryRun(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "kerouac_migrations_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	createUnversionedDb(t, rootDir)
+
+	for i := 0; i < 2; i++ {
+		version, pending, err := MigrateBuildDb(rootDir, true)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if version != 0 || len(pending) != len(migrations) {
+			t.Errorf("Dry run %d saw version %d with %d pending", i, version, len(pending))
+		}
+	}
+}
+
+func TestMigrateUnversionedDb(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "kerouac_migrations_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	createUnversionedDb(t, rootDir)
+
+	// Opening a store should migrate the db.
+	store, err := OpenSQLiteBuildStore(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	recordedBuilds, err := store.FindMatchingBuilds("proj", "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	if len(recordedBuilds) != 2 {
+		t.Fatalf("Found %d builds after migrating, not 2", len(recordedBuilds))
+	}
+	if recordedBuilds[0].Tag != "two" || recordedBuilds[0].Usage == nil || recordedBuilds[0].Usage.MaxRSSKB != 30 {
+		t.Errorf("Newest build lost data migrating: %+v", recordedBuilds[0])
+	}
+	if recordedBuilds[1].Tag != "one" || recordedBuilds[1].Status != SUCCEEDED || recordedBuilds[1].Usage != nil {
+		t.Errorf("Oldest build lost data migrating: %+v", recordedBuilds[1])
+	}
+
+	conn, err := store.db.Conn(context.Background())
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer conn.Close()
+
+	version, err := findSchemaVersion(conn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if version != len(migrations) {
+		t.Errorf("Migrated db at version %d not %d", version, len(migrations))
+	}
+
+	var maxId int
+	if err = conn.QueryRowContext(context.Background(), "SELECT MAX(id) FROM builds").Scan(&maxId); err != nil {
+		t.Fatal(err)
+	}
+	if maxId != 2 {
+		t.Errorf("ids not assigned after migrating, max is %d", maxId)
+	}
+}
@@ -9,8 +9,12 @@ import (
 
 func DoPrintCommand() {
 	flag.Usage = func() {
-		fmt.Printf("Usage: kerouac print [options] <builddir|stdoutpath|stderrpath|kerouaclogpath|tarballpath> <kerouacRootDir> <project> <tag> [datetime]\n\n")
+		fmt.Printf("Usage: kerouac print [options] <builddir|stdoutpath|stderrpath|kerouaclogpath|combinedpath|tarballpath|artifactsdir|artifactsmanifestpath|configpath|confighash|exitcode|signal|usertime|systemtime|maxrss> <kerouacRootDir> <project> <tag> [datetime]\n\n")
 		fmt.Printf("Prints to stdout the build directory, stdout log path, etc. of the specified build.\n\n")
+		fmt.Printf("exitcode, signal, usertime, systemtime and maxrss (in KB) describe how the build script exited,\n")
+		fmt.Printf("and exit 1 if that was not recorded.\n\n")
+		fmt.Printf("configpath is the config the build ran with, and confighash its sha256, which exits 1 if\n")
+		fmt.Printf("that was not recorded.\n\n")
 		fmt.Printf("If datetime is not specified, uses the latest build for the tag.\n")
 	}
 
@@ -30,7 +34,13 @@ func DoPrintCommand() {
 		datetime = flag.Arg(4)
 	}
 
-	recordedBuild, err := FindLatestBuild(kerouacRoot, project, tag, datetime)
+	store, err := OpenBuildStore(kerouacRoot)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	recordedBuild, err := FindLatestBuild(store, project, tag, datetime)
 
 	if err != nil {
 		log.Fatal(err)
@@ -49,11 +59,45 @@ func DoPrintCommand() {
 		fmt.Print(recordedBuild.FmtStderrLogPath())
 	case "kerouaclogpath":
 		fmt.Print(recordedBuild.FmtKerouacLogPath())
+	case "combinedpath":
+		fmt.Print(recordedBuild.FmtCombinedLogPath())
 	case "tarballpath":
 		fmt.Print(recordedBuild.FmtTarballPath())
+	case "artifactsdir":
+		fmt.Print(recordedBuild.FmtArtifactsDir())
+	case "artifactsmanifestpath":
+		fmt.Print(recordedBuild.FmtArtifactsManifestPath())
+	case "configpath":
+		fmt.Print(recordedBuild.FmtConfigSnapshotPath())
+	case "confighash":
+		if recordedBuild.ConfigHash == "" {
+			os.Exit(1)
+		}
+		fmt.Print(recordedBuild.ConfigHash)
+	case "exitcode", "signal", "usertime", "systemtime", "maxrss":
+		printUsage(path, recordedBuild.Usage)
 	default:
 		log.Printf("Did not recognize path to print: %s\n\n", path)
 		flag.Usage()
 		os.Exit(1)
 	}
 }
+
+func printUsage(field string, usage *ProcessUsage) {
+	if usage == nil {
+		os.Exit(1)
+	}
+
+	switch field {
+	case "exitcode":
+		fmt.Print(usage.ExitCode)
+	case "signal":
+		fmt.Print(int(usage.Signal))
+	case "usertime":
+		fmt.Print(usage.UserTime)
+	case "systemtime":
+		fmt.Print(usage.SystemTime)
+	case "maxrss":
+		fmt.Print(usage.MaxRSSKB)
+	}
+}
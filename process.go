@@ -0,0 +1,123 @@
+package main
+
+import (
+	"io/ioutil"
+	"log"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"syscall"
+	"time"
+)
+
+// How often to check whether a signalled process group has finished exiting.
+const killPollInterval = 100 * time.Millisecond
+
+// Kill every process in the process group pgid.
+//
+// The group is first sent SIGTERM.  If anything in it is still running after
+// gracePeriodInSecs, the group is sent SIGKILL.  The pids signalled each time
+// are written to the log.
+//
+// Returns nil on success (including when the group has already exited), or
+// an error if a signal could not be sent.
+func KillProcessGroup(pgid int, gracePeriodInSecs int) error {
+	if err := signalProcessGroup(pgid, syscall.SIGTERM); err != nil {
+		return err
+	}
+
+	deadline := time.Now().Add(time.Second * time.Duration(gracePeriodInSecs))
+	for processGroupAlive(pgid) {
+		if !time.Now().Before(deadline) {
+			return killAfterGracePeriod(pgid, gracePeriodInSecs)
+		}
+		time.Sleep(killPollInterval)
+	}
+
+	log.Printf("Process group %d exited after SIGTERM.", pgid)
+	return nil
+}
+
+func killAfterGracePeriod(pgid int, gracePeriodInSecs int) error {
+	log.Printf("Process group %d still running after %d second grace period.", pgid, gracePeriodInSecs)
+	return signalProcessGroup(pgid, syscall.SIGKILL)
+}
+
+func signalProcessGroup(pgid int, sig syscall.Signal) error {
+	if pids, err := findProcessGroupPids(pgid); err != nil {
+		log.Printf("Sending signal %d (%s) to process group %d (could not list its pids: %s)", sig, sig, pgid, err)
+	} else {
+		log.Printf("Sending signal %d (%s) to process group %d, pids: %v", sig, sig, pgid, pids)
+	}
+
+	// A negative pid signals the whole group.
+	if err := syscall.Kill(-pgid, sig); err != nil && err != syscall.ESRCH {
+		return err
+	}
+	return nil
+}
+
+func processGroupAlive(pgid int) bool {
+	if pids, err := findProcessGroupPids(pgid); err == nil {
+		return len(pids) > 0
+	}
+	// Without /proc, fall back to asking the kernel, which will count zombies
+	// as alive (so we may wait out the grace period unnecessarily).
+	return syscall.Kill(-pgid, 0) != syscall.ESRCH
+}
+
+// Find the pids of all live (non-zombie) processes in process group pgid by
+// reading /proc.
+//
+// Returns an error if /proc can't be read (e.g. on systems without it).
+func findProcessGroupPids(pgid int) ([]int, error) {
+	entries, err := ioutil.ReadDir("/proc")
+	if err != nil {
+		return nil, err
+	}
+
+	pids := make([]int, 0)
+
+	for _, entry := range entries {
+		pid, err := strconv.Atoi(entry.Name())
+		if err != nil {
+			continue
+		}
+
+		// Processes can exit while we're looking, so just skip any we can't
+		// read.
+		stat, err := ioutil.ReadFile(filepath.Join("/proc", entry.Name(), "stat"))
+		if err != nil {
+			continue
+		}
+
+		state, pgrp, ok := parseProcStat(string(stat))
+		if ok && pgrp == pgid && state != "Z" {
+			pids = append(pids, pid)
+		}
+	}
+
+	return pids, nil
+}
+
+// Pull the state and process group out of the contents of /proc/<pid>/stat,
+// which look like "pid (comm) state ppid pgrp ...".  comm may itself contain
+// spaces and parens, so we parse from the last ')'.
+func parseProcStat(stat string) (string, int, bool) {
+	commEnd := strings.LastIndex(stat, ")")
+	if commEnd < 0 {
+		return "", 0, false
+	}
+
+	fields := strings.Fields(stat[commEnd+1:])
+	if len(fields) < 3 {
+		return "", 0, false
+	}
+
+	pgrp, err := strconv.Atoi(fields[2])
+	if err != nil {
+		return "", 0, false
+	}
+
+	return fields[0], pgrp, true
+}
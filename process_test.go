@@ -0,0 +1,132 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseProcStat(t *testing.T) {
+	state, pgrp, ok := parseProcStat("4516 (odd) name) S 1 4510 4510 0 -1 4228108")
+	if !ok {
+		t.Fatalf("parseProcStat failed on valid stat")
+	}
+	if state != "S" {
+		t.Errorf("parseProcStat returned state %s not S", state)
+	}
+	if pgrp != 4510 {
+		t.Errorf("parseProcStat returned pgrp %d not 4510", pgrp)
+	}
+
+	if _, _, ok := parseProcStat("garbage"); ok {
+		t.Errorf("parseProcStat succeeded on garbage")
+	}
+}
+
+// The script ignores SIGTERM and leaves a background child, so the whole
+// group should have to be SIGKILLed for the build to finish.
+const stubbornBuildScript = `#!/bin/sh
+trap '' TERM
+echo $$ > pgid
+sleep 60 &
+wait
+`
+
+// Set up a source dir containing script as build.sh, and the logs dir for a
+// build in tmpDir.
+func makeScriptBuild(t *testing.T, tmpDir string, script string) (string, BuildId) {
+	srcDir := filepath.Join(tmpDir, "src")
+	os.MkdirAll(srcDir, 0700)
+	if err := ioutil.WriteFile(filepath.Join(srcDir, "build.sh"), []byte(script), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	buildId := BuildIdAtNow(filepath.Join(tmpDir, "root"), KnownProject, KnownTag)
+	os.MkdirAll(buildId.FmtLogsDir(), 0700)
+
+	return srcDir, buildId
+}
+
+func TestRunBuildScriptKillsProcessGroupOnTimeout(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "kerouac_process_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	srcDir, buildId := makeScriptBuild(t, tmpDir, stubbornBuildScript)
+
+	start := time.Now()
+	_, err = RunBuildScript(srcDir, "./build.sh", []string{}, nil, nil, 1, 1, nil, buildId)
+	if _, ok := err.(*BuildTimedOutError); !ok {
+		t.Errorf("RunBuildScript returned %v not a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 10*time.Second {
+		t.Errorf("RunBuildScript took %s to kill the build", elapsed)
+	}
+
+	pgidBytes, err := ioutil.ReadFile(filepath.Join(srcDir, "pgid"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	pgid, err := strconv.Atoi(strings.TrimSpace(string(pgidBytes)))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// SIGKILLed processes can take a moment to finish dying.
+	for i := 0; ; i++ {
+		pids, err := findProcessGroupPids(pgid)
+		if err != nil || len(pids) == 0 {
+			break
+		}
+		if i == 10 {
+			t.Errorf("Processes left running in build's process group: %v", pids)
+			break
+		}
+		time.Sleep(killPollInterval)
+	}
+}
+
+func TestRunBuildScriptCancels(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "kerouac_process_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	srcDir, buildId := makeScriptBuild(t, tmpDir, "#!/bin/sh\nsleep 60\n")
+
+	cancel := make(chan os.Signal, 1)
+	cancel <- os.Interrupt
+
+	_, err = RunBuildScript(srcDir, "./build.sh", []string{}, nil, nil, 60, 1, cancel, buildId)
+	if _, ok := err.(*BuildCancelledError); !ok {
+		t.Errorf("RunBuildScript returned %v not a cancellation", err)
+	}
+}
+
+func TestRunBuildScriptRecordsUsage(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "kerouac_process_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	srcDir, buildId := makeScriptBuild(t, tmpDir, "#!/bin/sh\nexit 3\n")
+
+	buildOutput, err := RunBuildScript(srcDir, "./build.sh", []string{}, nil, nil, 60, 1, nil, buildId)
+	if err == nil {
+		t.Errorf("RunBuildScript did not report the failed exit")
+	}
+	if buildOutput.Usage == nil {
+		t.Fatalf("RunBuildScript did not report usage")
+	}
+	if buildOutput.Usage.ExitCode != 3 || buildOutput.Usage.Signal != 0 {
+		t.Errorf("RunBuildScript reported usage %+v not exit code 3", buildOutput.Usage)
+	}
+}
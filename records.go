@@ -1,11 +1,7 @@
 package main
 
 import (
-	"code.google.com/p/go-sqlite/go1/sqlite3"
 	"fmt"
-	"io"
-	"os"
-	"path/filepath"
 	"time"
 )
 
@@ -17,106 +13,161 @@ const (
 	FAILED    BuildStatus = "FAILED"
 	SUCCEEDED             = "SUCCEEDED"
 	RUNNING               = "RUNNING"
+	// The build script was killed for running past its timeout.
+	TIMED_OUT BuildStatus = "TIMED_OUT"
+	// Kerouac was told to stop (e.g. ^C) while the build was running.
+	CANCELLED BuildStatus = "CANCELLED"
+	// Kerouac itself failed, e.g. couldn't parse the config or make the
+	// tarball, so we don't know whether the build would have passed.
+	ERRORED BuildStatus = "ERRORED"
+	// A build waiting for kerouac worker to run it (see kerouac enqueue).
+	QUEUED BuildStatus = "QUEUED"
+	// A queued build that wasn't run, as a newer build of the same branch was
+	// queued (see SupersedeQueued).
+	SUPERSEDED BuildStatus = "SUPERSEDED"
+	// A step that wasn't run, because an earlier one failed, or a build that
+	// wasn't run, because its config says to Skip it.
+	SKIPPED BuildStatus = "SKIPPED"
+
+	// Steps are recorded to the millisecond.
+	StepTimeFormat = "2006-01-02 15:04:05.000"
 )
 
 // RecordedBuild adds the end time of a build and its result to a BuildId.
+//
+// Usage is nil unless the build script ran to completion (or was killed).  For
+// builds with Steps, it's that of the last step run.
 type RecordedBuild struct {
 	*BuildId
 	EndTime time.Time
 	Status  BuildStatus
+	Usage   *ProcessUsage
+	// Empty unless the build has Steps.
+	Steps []RecordedStep
+	// For the child builds of a matrix build, the parent build, and the
+	// matrix values the child was built with (see MatrixCell).
+	Parent    *BuildId
+	MatrixKey string
+	// For reruns (see kerouac rerun), the build that was rerun.
+	RerunOf *BuildId
+	// For SUPERSEDED builds, the build that was run instead.
+	SupersededBy *BuildId
+	// The hex SHA-256 of the build's config snapshot (see
+	// FmtConfigSnapshotPath), empty if none was written.
+	ConfigHash string
 }
 
-func (r RecordedBuild) Duration() time.Duration {
-	if r.EndTime.IsZero() {
-		return time.Since(r.DateTime)
-	}
-	return r.EndTime.Sub(r.DateTime)
+// RecordedStep is the record of one of the Steps of a build.
+type RecordedStep struct {
+	// The index of the step in the config's Steps.
+	Position int
+	Name     string
+	Status   BuildStatus
+	// Zero if the step hasn't started, e.g. if SKIPPED.
+	StartTime time.Time
+	// Zero until the step has finished.
+	Duration time.Duration
+	// As for RecordedBuild.
+	Usage *ProcessUsage
 }
 
-func CreateBuildRecord(buildId BuildId) error {
-	conn, err := getConn(buildId.RootDir)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-
-	if err = createTablesAndIndexes(conn); err != nil {
-		return err
+// When the step finished, or zero if it hasn't.
+func (s RecordedStep) EndTime() time.Time {
+	if s.StartTime.IsZero() || s.Status == RUNNING {
+		return time.Time{}
 	}
+	return s.StartTime.Add(s.Duration)
+}
 
-	if err = insertBuildRecord(conn, buildId); err != nil {
-		return err
+func (r RecordedBuild) Duration() time.Duration {
+	if r.EndTime.IsZero() {
+		return time.Since(r.DateTime)
 	}
-
-	return nil
+	return r.EndTime.Sub(r.DateTime)
 }
 
-func MarkBuildFailed(buildId BuildId) error {
-	return updateBuildStatus(buildId, FAILED)
+// QueuedBuild is what kerouac worker needs to run a QUEUED build.
+type QueuedBuild struct {
+	*BuildId
+	// Absolute, as the worker runs from elsewhere.
+	SrcDir     string
+	ConfigFile string
+	// Flags to pass on to kerouac build, e.g. --remove-src.
+	BuildFlags []string
 }
 
-func MarkBuildSucceeded(buildId BuildId) error {
-	return updateBuildStatus(buildId, SUCCEEDED)
+// A BuildStore keeps the records of the builds under one kerouac root.
+//
+// See SQLBuildStore for the real thing, and MemoryBuildStore for tests and
+// dry runs.
+type BuildStore interface {
+	// Record a new RUNNING build.  This acts as the locking mechanism to make
+	// sure we don't have two builds in the identical folder, so it must fail
+	// if buildId has already been recorded.
+	CreateBuildRecord(buildId BuildId) error
+	// As CreateBuildRecord, for a child build of the matrix build parent.
+	CreateMatrixBuildRecord(buildId BuildId, parent BuildId, matrixKey string) error
+	// As CreateBuildRecord, for a rerun of the build original.
+	CreateRerunBuildRecord(buildId BuildId, original BuildId) error
+	// As CreateBuildRecord, but QUEUED, with what's needed to run it later.
+	CreateQueuedBuildRecord(queued QueuedBuild) error
+	// Mark a QUEUED build RUNNING.  This must fail if it isn't QUEUED, e.g.
+	// as another worker has already started it.
+	StartQueuedBuild(buildId BuildId) error
+	// Mark a QUEUED build SUPERSEDED by another build of the same project, and
+	// finished now.  This must fail if it isn't QUEUED.
+	SupersedeQueuedBuild(buildId BuildId, supersededBy BuildId) error
+	// Find the QUEUED builds, oldest first.
+	FindQueuedBuilds() ([]QueuedBuild, error)
+	// Set the status of a build, and mark it finished now.
+	UpdateBuildStatus(buildId BuildId, status BuildStatus) error
+	// Record the hash of the config snapshot written for buildId.
+	RecordConfigHash(buildId BuildId, configHash string) error
+	// Record how the build script for buildId exited and what it used.
+	RecordBuildUsage(buildId BuildId, usage *ProcessUsage) error
+	// Record (or update the record of) the step at step.Position of a build.
+	RecordBuildStep(buildId BuildId, step RecordedStep) error
+	// Find the builds matching the non-empty arguments (with their steps),
+	// newest first.  datetime is formatted with DateFormat.
+	FindMatchingBuilds(project string, tag string, datetime string) ([]RecordedBuild, error)
+	Close() error
 }
 
-func FindMatchingBuilds(rootDir string, project string, tag string, datetime string) ([]RecordedBuild, error) {
-	query := "SELECT project, tag, started_at, finished_at, status FROM builds WHERE 1 = 1"
-
-	args := make([]interface{}, 0, 0)
-
-	if project != "" {
-		query = query + " AND project = ?"
-		args = append(args, project)
-	}
-
-	if tag != "" {
-		query = query + " AND tag = ?"
-		args = append(args, tag)
-	}
-
-	if datetime != "" {
-		query = query + " AND started_at = ?"
-		args = append(args, datetime)
-	}
-
-	query = query + " ORDER BY started_at DESC;"
-
-	conn, err := getConn(rootDir)
+// Open the BuildStore for the kerouac root rootDir, i.e. its builds db.
+func OpenBuildStore(rootDir string) (BuildStore, error) {
+	store, err := OpenSQLiteBuildStore(rootDir)
 	if err != nil {
 		return nil, err
 	}
-	defer conn.Close()
+	return store, nil
+}
 
-	conn.Query(query, args...)
+func MarkBuildFailed(store BuildStore, buildId BuildId) error {
+	return store.UpdateBuildStatus(buildId, FAILED)
+}
 
-	recordedBuilds := make([]RecordedBuild, 0, 0)
+func MarkBuildSucceeded(store BuildStore, buildId BuildId) error {
+	return store.UpdateBuildStatus(buildId, SUCCEEDED)
+}
 
-	stmt, err := conn.Query(query, args...)
+func MarkBuildSkipped(store BuildStore, buildId BuildId) error {
+	return store.UpdateBuildStatus(buildId, SKIPPED)
+}
 
-	if err == io.EOF {
-		return recordedBuilds, nil
-	} else if err != nil {
-		return nil, err
-	}
+func MarkBuildTimedOut(store BuildStore, buildId BuildId) error {
+	return store.UpdateBuildStatus(buildId, TIMED_OUT)
+}
 
-	for {
-		recordedBuild, err := scanBuild(rootDir, stmt)
-		if err != nil {
-			return nil, err
-		}
-		recordedBuilds = append(recordedBuilds, recordedBuild)
-		if err = stmt.Next(); err == io.EOF {
-			break
-		} else if err != nil {
-			return nil, err
-		}
-	}
+func MarkBuildCancelled(store BuildStore, buildId BuildId) error {
+	return store.UpdateBuildStatus(buildId, CANCELLED)
+}
 
-	return recordedBuilds, nil
+func MarkBuildErrored(store BuildStore, buildId BuildId) error {
+	return store.UpdateBuildStatus(buildId, ERRORED)
 }
 
-func FindLatestBuild(rootDir string, project string, tag string, datetime string) (*RecordedBuild, error) {
-	recordedBuilds, err := FindMatchingBuilds(rootDir, project, tag, datetime)
+func FindLatestBuild(store BuildStore, project string, tag string, datetime string) (*RecordedBuild, error) {
+	recordedBuilds, err := store.FindMatchingBuilds(project, tag, datetime)
 	if err != nil {
 		return nil, err
 	}
@@ -126,14 +177,24 @@ func FindLatestBuild(rootDir string, project string, tag string, datetime string
 	return &recordedBuilds[0], nil
 }
 
-func FindBuildsGreaterThanN(rootDir string, project string, n int) ([]RecordedBuild, error) {
+// Find the builds of project after the newest n.  The children of matrix builds
+// aren't counted, or returned.
+func FindBuildsGreaterThanN(store BuildStore, project string, n int) ([]RecordedBuild, error) {
 	if n < 0 {
 		return nil, fmt.Errorf("Cannot find builds greater than %d", n)
 	}
 
-	recordedBuilds, err := FindMatchingBuilds(rootDir, project, "", "")
+	matchingBuilds, err := store.FindMatchingBuilds(project, "", "")
 	if err != nil {
-		return recordedBuilds, err
+		return matchingBuilds, err
+	}
+
+	recordedBuilds := make([]RecordedBuild, 0, len(matchingBuilds))
+	for _, recordedBuild := range matchingBuilds {
+		// Queued and superseded builds have nothing to remove.
+		if recordedBuild.Parent == nil && recordedBuild.Status != QUEUED && recordedBuild.Status != SUPERSEDED {
+			recordedBuilds = append(recordedBuilds, recordedBuild)
+		}
 	}
 
 	if n > len(recordedBuilds) {
@@ -143,64 +204,26 @@ func FindBuildsGreaterThanN(rootDir string, project string, n int) ([]RecordedBu
 	return recordedBuilds[n:], nil
 }
 
-func scanBuild(rootDir string, stmt *sqlite3.Stmt) (RecordedBuild, error) {
-	var rowProject, rowTag, rowDatetime, rowEndTime, rowStatus string
-	err := stmt.Scan(&rowProject, &rowTag, &rowDatetime, &rowEndTime, &rowStatus)
+// Find the child builds of the matrix build parent.
+func FindMatrixChildren(store BuildStore, parent BuildId) ([]RecordedBuild, error) {
+	recordedBuilds, err := store.FindMatchingBuilds(parent.Project, "", parent.DateTime.Format(DateFormat))
 	if err != nil {
-		return RecordedBuild{}, err
-	}
-
-	dateTime, err := time.Parse(DateFormat, rowDatetime)
-	if err != nil {
-		return RecordedBuild{}, err
+		return nil, err
 	}
 
-	var endTime time.Time
-	if rowEndTime != "" {
-		if endTime, err = time.Parse(DateFormat, rowEndTime); err != nil {
-			return RecordedBuild{}, err
+	children := make([]RecordedBuild, 0)
+	for _, recordedBuild := range recordedBuilds {
+		if recordedBuild.Parent != nil && recordedBuild.Parent.Tag == parent.Tag {
+			children = append(children, recordedBuild)
 		}
 	}
-
-	buildId := BuildIdAt(rootDir, rowProject, rowTag, dateTime)
-	return RecordedBuild{&buildId, endTime, BuildStatus(rowStatus)}, nil
-}
-
-func updateBuildStatus(buildId BuildId, status BuildStatus) error {
-	conn, err := getConn(buildId.RootDir)
-	if err != nil {
-		return err
-	}
-	defer conn.Close()
-
-	return conn.Exec("UPDATE builds SET status = ?, finished_at = ? WHERE project = ? AND tag = ? AND started_at = ?", string(status), time.Now().UTC().Format(DateFormat), buildId.Project, buildId.Tag, buildId.DateTime.Format(DateFormat))
-
-}
-
-func getConn(rootDir string) (*sqlite3.Conn, error) {
-	buildDbPath := FmtBuildDbPath(rootDir)
-	os.MkdirAll(filepath.Dir(buildDbPath), 0700)
-	return sqlite3.Open(buildDbPath)
+	return children, nil
 }
 
-const createBuildsTable = "CREATE TABLE IF NOT EXISTS builds (id INTEGER PRIMARYKEY ASC, project TEXT NOT NULL, tag TEXT NOT NULL, started_at TEXT NOT NULL, finished_at TEXT, status TEXT)"
-
-const createBuildsUniqueIdx = "CREATE UNIQUE INDEX IF NOT EXISTS builds_idx ON builds (project, tag, started_at)"
-
-func createTablesAndIndexes(conn *sqlite3.Conn) error {
-	stmts := []string{createBuildsTable, createBuildsUniqueIdx}
-
-	for _, stmt := range stmts {
-		if err := conn.Exec(stmt); err != nil {
-			return err
-		}
-	}
-
-	return nil
+func durationToMs(d time.Duration) int64 {
+	return int64(d / time.Millisecond)
 }
 
-// This acts as the locking mechanism to make sure we don't have two builds in
-// the identical folder, as well as record keeping.
-func insertBuildRecord(conn *sqlite3.Conn, buildId BuildId) error {
-	return conn.Exec("INSERT INTO builds (project, tag, started_at, status) VALUES (?, ?, ?, ?)", buildId.Project, buildId.Tag, buildId.DateTime.Format(DateFormat), string(RUNNING))
+func msToDuration(ms int64) time.Duration {
+	return time.Duration(ms) * time.Millisecond
 }
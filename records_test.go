@@ -1,13 +1,17 @@
 package main
 
 import (
+	"io/ioutil"
+	"os"
+	"reflect"
+	"syscall"
 	"testing"
 	"time"
 )
 
 func knownRecordedBuild() RecordedBuild {
 	buildId := knownBuildId()
-	return RecordedBuild{&buildId, buildId.DateTime.Add(1 * time.Minute), SUCCEEDED}
+	return RecordedBuild{BuildId: &buildId, EndTime: buildId.DateTime.Add(1 * time.Minute), Status: SUCCEEDED}
 }
 
 func TestRecordedBuildDuration(t *testing.T) {
@@ -17,3 +21,257 @@ func TestRecordedBuildDuration(t *testing.T) {
 		t.Errorf("Duration() returned %s not %s", duration, expectedDuration)
 	}
 }
+
+func TestMemoryBuildStore(t *testing.T) {
+	testBuildStore(t, NewMemoryBuildStore(KnownRootDir), KnownRootDir)
+}
+
+func TestSQLiteBuildStore(t *testing.T) {
+	rootDir, err := ioutil.TempDir("", "kerouac_records_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(rootDir)
+
+	store, err := OpenSQLiteBuildStore(rootDir)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+
+	testBuildStore(t, store, rootDir)
+}
+
+// Exercise a BuildStore, which should start out empty.
+func testBuildStore(t *testing.T, store BuildStore, rootDir string) {
+	older := BuildIdAt(rootDir, KnownProject, KnownTag, KnownDateTime)
+	newer := BuildIdAt(rootDir, KnownProject, "other_tag", KnownDateTime.Add(time.Hour))
+	otherProject := BuildIdAt(rootDir, "other_project", KnownTag, KnownDateTime.Add(time.Minute))
+
+	for _, buildId := range []BuildId{older, newer, otherProject} {
+		if err := store.CreateBuildRecord(buildId); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	if err := store.CreateBuildRecord(older); err == nil {
+		t.Errorf("Recording the same build twice did not fail")
+	}
+
+	recordedBuilds, err := store.FindMatchingBuilds(KnownProject, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recordedBuilds) != 2 {
+		t.Fatalf("Found %d builds of %s not 2", len(recordedBuilds), KnownProject)
+	}
+	if !reflect.DeepEqual(*recordedBuilds[0].BuildId, newer) || !reflect.DeepEqual(*recordedBuilds[1].BuildId, older) {
+		t.Errorf("Builds not found newest first: %+v", recordedBuilds)
+	}
+	if recordedBuilds[0].Status != RUNNING || !recordedBuilds[0].EndTime.IsZero() || recordedBuilds[0].Usage != nil {
+		t.Errorf("New build not RUNNING without end time and usage: %+v", recordedBuilds[0])
+	}
+
+	if err = MarkBuildTimedOut(store, older); err != nil {
+		t.Fatal(err)
+	}
+
+	usage := &ProcessUsage{ExitCode: -1, Signal: syscall.SIGKILL, UserTime: 1500 * time.Millisecond, SystemTime: 250 * time.Millisecond, MaxRSSKB: 4096}
+	if err = store.RecordBuildUsage(older, usage); err != nil {
+		t.Fatal(err)
+	}
+
+	recordedBuild, err := FindLatestBuild(store, KnownProject, KnownTag, KnownDateTimeS)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recordedBuild == nil {
+		t.Fatalf("Could not find build by datetime")
+	}
+	if recordedBuild.Status != TIMED_OUT || recordedBuild.EndTime.IsZero() {
+		t.Errorf("Build not marked finished and TIMED_OUT: %+v", recordedBuild)
+	}
+	if !reflect.DeepEqual(recordedBuild.Usage, usage) {
+		t.Errorf("Recorded usage was %+v not %+v", recordedBuild.Usage, usage)
+	}
+
+	if len(recordedBuild.Steps) != 0 {
+		t.Errorf("Build without steps has steps: %+v", recordedBuild.Steps)
+	}
+
+	stepStart := KnownDateTime.Add(1500 * time.Millisecond)
+	steps := []RecordedStep{
+		{Position: 0, Name: "setup", Status: SUCCEEDED, StartTime: stepStart, Duration: 2500 * time.Millisecond, Usage: &ProcessUsage{UserTime: time.Second}},
+		{Position: 1, Name: "test", Status: RUNNING, StartTime: stepStart.Add(3 * time.Second)},
+		{Position: 2, Name: "package", Status: SKIPPED},
+	}
+	for _, step := range []RecordedStep{steps[1], steps[0], steps[2]} {
+		if err = store.RecordBuildStep(older, step); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	// Update a step.
+	steps[1].Status = FAILED
+	steps[1].Duration = 10 * time.Second
+	steps[1].Usage = &ProcessUsage{ExitCode: 1}
+	if err = store.RecordBuildStep(older, steps[1]); err != nil {
+		t.Fatal(err)
+	}
+
+	recordedBuilds, err = store.FindMatchingBuilds(KnownProject, "", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(recordedBuilds[0].Steps) != 0 {
+		t.Errorf("Steps recorded against the wrong build: %+v", recordedBuilds[0].Steps)
+	}
+	if !reflect.DeepEqual(recordedBuilds[1].Steps, steps) {
+		t.Errorf("Recorded steps were %+v not %+v", recordedBuilds[1].Steps, steps)
+	}
+
+	if recordedBuild, err = FindLatestBuild(store, "no_such_project", "", ""); err != nil || recordedBuild != nil {
+		t.Errorf("Found %+v, %s for a project with no builds", recordedBuild, err)
+	}
+
+	toRemove, err := FindBuildsGreaterThanN(store, KnownProject, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toRemove) != 1 || !reflect.DeepEqual(*toRemove[0].BuildId, older) {
+		t.Errorf("FindBuildsGreaterThanN returned %+v not just the older build", toRemove)
+	}
+
+	child := BuildIdAt(rootDir, KnownProject, KnownTag+MatrixTagSeparator+"linux", KnownDateTime)
+	if err = store.CreateMatrixBuildRecord(child, older, "GOOS=linux"); err != nil {
+		t.Fatal(err)
+	}
+
+	children, err := FindMatrixChildren(store, older)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(children) != 1 || !reflect.DeepEqual(*children[0].BuildId, child) {
+		t.Fatalf("FindMatrixChildren returned %+v not just the child", children)
+	}
+	if !reflect.DeepEqual(children[0].Parent, &older) || children[0].MatrixKey != "GOOS=linux" {
+		t.Errorf("Child recorded with parent %+v and key %q", children[0].Parent, children[0].MatrixKey)
+	}
+
+	if children, err = FindMatrixChildren(store, newer); err != nil || len(children) != 0 {
+		t.Errorf("Found children %+v, %s of a build without any", children, err)
+	}
+
+	toRemove, err = FindBuildsGreaterThanN(store, KnownProject, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(toRemove) != 1 || !reflect.DeepEqual(*toRemove[0].BuildId, older) {
+		t.Errorf("FindBuildsGreaterThanN counted matrix children, returned %+v", toRemove)
+	}
+
+	rerun := BuildIdAt(rootDir, KnownProject, KnownTag, KnownDateTime.Add(2*time.Hour))
+	if err = store.CreateRerunBuildRecord(rerun, older); err != nil {
+		t.Fatal(err)
+	}
+
+	recordedBuild, err = FindLatestBuild(store, KnownProject, KnownTag, "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(*recordedBuild.BuildId, rerun) || !reflect.DeepEqual(recordedBuild.RerunOf, &older) {
+		t.Errorf("Rerun recorded as %+v, rerun of %+v", recordedBuild.BuildId, recordedBuild.RerunOf)
+	}
+
+	if recordedBuild, err = FindLatestBuild(store, KnownProject, KnownTag, KnownDateTimeS); err != nil || recordedBuild.RerunOf != nil {
+		t.Errorf("Original build recorded as a rerun of %+v, %v", recordedBuild.RerunOf, err)
+	}
+
+	if err = store.RecordConfigHash(rerun, "abc123"); err != nil {
+		t.Fatal(err)
+	}
+	if recordedBuild, err = FindLatestBuild(store, KnownProject, KnownTag, ""); err != nil || recordedBuild.ConfigHash != "abc123" {
+		t.Errorf("Config hash recorded as %q, %v", recordedBuild.ConfigHash, err)
+	}
+
+	testQueuedBuilds(t, store, rootDir)
+}
+
+// Queue builds in a store set up by testBuildStore.
+func testQueuedBuilds(t *testing.T, store BuildStore, rootDir string) {
+	firstId := BuildIdAt(rootDir, KnownProject, "queued_tag", KnownDateTime.Add(3*time.Hour))
+	secondId := BuildIdAt(rootDir, "other_project", "queued_tag", KnownDateTime.Add(4*time.Hour))
+	first := QueuedBuild{BuildId: &firstId, SrcDir: "/src/first", ConfigFile: "/src/first/kerouac.json", BuildFlags: []string{"--remove-src=true"}}
+	second := QueuedBuild{BuildId: &secondId, SrcDir: "/src/second", ConfigFile: "/src/second/kerouac.yaml", BuildFlags: []string{}}
+
+	for _, queued := range []QueuedBuild{second, first} {
+		if err := store.CreateQueuedBuildRecord(queued); err != nil {
+			t.Fatal(err)
+		}
+	}
+
+	queuedBuilds, err := store.FindQueuedBuilds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(queuedBuilds, []QueuedBuild{first, second}) {
+		t.Errorf("Queued builds were %+v not oldest first %+v", queuedBuilds, []QueuedBuild{first, second})
+	}
+
+	recordedBuild, err := FindLatestBuild(store, KnownProject, "queued_tag", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recordedBuild.Status != QUEUED || !recordedBuild.EndTime.IsZero() {
+		t.Errorf("Queued build recorded as %+v", recordedBuild)
+	}
+
+	toRemove, err := FindBuildsGreaterThanN(store, KnownProject, 1)
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, build := range toRemove {
+		if build.Status == QUEUED {
+			t.Errorf("FindBuildsGreaterThanN returned queued build %+v", build)
+		}
+	}
+
+	if err = store.StartQueuedBuild(firstId); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.StartQueuedBuild(firstId); err == nil {
+		t.Errorf("Starting a queued build twice did not fail")
+	}
+	if err = store.StartQueuedBuild(BuildIdAt(rootDir, KnownProject, KnownTag, KnownDateTime)); err == nil {
+		t.Errorf("Starting a build that was never queued did not fail")
+	}
+
+	if recordedBuild, err = FindLatestBuild(store, KnownProject, "queued_tag", ""); err != nil || recordedBuild.Status != RUNNING {
+		t.Errorf("Started build recorded as %+v, %v", recordedBuild, err)
+	}
+	if queuedBuilds, err = store.FindQueuedBuilds(); err != nil || !reflect.DeepEqual(queuedBuilds, []QueuedBuild{second}) {
+		t.Errorf("Queued builds were %+v, %v after starting one, not %+v", queuedBuilds, err, []QueuedBuild{second})
+	}
+
+	thirdId := BuildIdAt(rootDir, "other_project", "queued_tag", KnownDateTime.Add(5*time.Hour))
+	if err = store.CreateQueuedBuildRecord(QueuedBuild{BuildId: &thirdId, SrcDir: "/src/third", ConfigFile: "/src/third/kerouac.json", BuildFlags: []string{}}); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.SupersedeQueuedBuild(secondId, thirdId); err != nil {
+		t.Fatal(err)
+	}
+	if err = store.SupersedeQueuedBuild(firstId, thirdId); err == nil {
+		t.Errorf("Superseding a running build did not fail")
+	}
+
+	recordedBuild, err = FindLatestBuild(store, "other_project", "queued_tag", secondId.DateTime.Format(DateFormat))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if recordedBuild.Status != SUPERSEDED || recordedBuild.EndTime.IsZero() || !reflect.DeepEqual(recordedBuild.SupersededBy, &thirdId) {
+		t.Errorf("Superseded build recorded as %+v, superseded by %+v", recordedBuild, recordedBuild.SupersededBy)
+	}
+	if queuedBuilds, err = store.FindQueuedBuilds(); err != nil || len(queuedBuilds) != 1 || !reflect.DeepEqual(*queuedBuilds[0].BuildId, thirdId) {
+		t.Errorf("Queued builds were %+v, %v after superseding one, not just the third", queuedBuilds, err)
+	}
+}
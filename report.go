@@ -3,6 +3,8 @@ package main
 import (
 	"fmt"
 	"html/template"
+	"io"
+	"log"
 	"os"
 	"path/filepath"
 	"time"
@@ -13,15 +15,25 @@ const REPORT_MAX_BUILDS = 100 // Eventually, this will be configurable.
 type templateFields struct {
 	Builds  []RecordedBuild
 	CSSPath string
+	// If non-zero, have the browser reload the report this often.
+	RefreshSecs int
 }
 
-func RenderHTMLReport(reportPath string, builds []RecordedBuild) (err error) {
+func RenderHTMLReport(reportPath string, builds []RecordedBuild) error {
 	file, err := os.Create(reportPath)
 	if err != nil {
 		return err
 	}
 	defer file.Close()
 
+	return WriteHTMLReport(file, filepath.Dir(reportPath), builds, 0)
+}
+
+// Write the HTML report of builds to w, with links relative to reportDir.
+//
+// If refreshSecs is non-zero, the report will ask the browser to reload it
+// that often.
+func WriteHTMLReport(w io.Writer, reportDir string, builds []RecordedBuild, refreshSecs int) (err error) {
 	// Templates can panic(), so set up a recover just in case.
 	defer func() {
 		if r := recover(); r != nil {
@@ -29,20 +41,16 @@ func RenderHTMLReport(reportPath string, builds []RecordedBuild) (err error) {
 		}
 	}()
 
-	numBuilds := len(builds)
-	if numBuilds > REPORT_MAX_BUILDS {
-		numBuilds = REPORT_MAX_BUILDS
-	}
-	fields := &templateFields{Builds: builds[0:numBuilds]}
+	fields := &templateFields{Builds: groupMatrixBuilds(builds, REPORT_MAX_BUILDS), RefreshSecs: refreshSecs}
 
-	tryCSSPath := filepath.Join(filepath.Dir(reportPath), "builds.css")
+	tryCSSPath := filepath.Join(reportDir, BuildCSSName)
 	if stat, err := os.Stat(tryCSSPath); err == nil && !stat.IsDir() {
 		fields.CSSPath = tryCSSPath
 	}
 
 	funcMap := map[string]interface{}{
 		"relative": func(path string) (string, error) {
-			return filepath.Rel(filepath.Dir(reportPath), path)
+			return filepath.Rel(reportDir, path)
 		},
 		"base": func(path string) string {
 			return filepath.Base(path)
@@ -50,19 +58,134 @@ func RenderHTMLReport(reportPath string, builds []RecordedBuild) (err error) {
 		"friendlyDate": func(timestamp time.Time) string {
 			return timestamp.Format(time.RFC1123)
 		},
+		"friendlyKB": func(kb int64) string {
+			return fmt.Sprintf("%.1f MB", float64(kb)/1024)
+		},
+		"timeline": stepTimeline,
+		// A bad manifest shouldn't stop the rest of the report.
+		"artifacts": func(buildId *BuildId) []Artifact {
+			manifest, err := ReadArtifactManifest(*buildId)
+			if err != nil {
+				log.Printf("Could not read artifacts of %s: %s", buildId.FmtBuildDir(), err)
+				return nil
+			}
+			return manifest.Artifacts
+		},
 	}
 	htmlTemplate := template.Must(template.New("HTMLReport").Funcs(funcMap).Parse(HTMLTemplate))
-	return htmlTemplate.Execute(file, fields)
+	return htmlTemplate.Execute(w, fields)
+}
+
+// The first maxBuilds builds that aren't matrix children, each followed by its
+// matrix children.  Children whose parent isn't in builds count as top level.
+func groupMatrixBuilds(builds []RecordedBuild, maxBuilds int) []RecordedBuild {
+	parentKey := func(buildId BuildId) string {
+		return buildId.Project + "/" + buildId.Tag + "/" + buildId.DateTime.Format(DateTagFormat)
+	}
+
+	parents := make(map[string]bool)
+	for _, build := range builds {
+		if build.Parent == nil {
+			parents[parentKey(*build.BuildId)] = true
+		}
+	}
+
+	children := make(map[string][]RecordedBuild)
+	topLevel := make([]RecordedBuild, 0, len(builds))
+	for _, build := range builds {
+		if build.Parent != nil && parents[parentKey(*build.Parent)] {
+			key := parentKey(*build.Parent)
+			children[key] = append(children[key], build)
+		} else {
+			topLevel = append(topLevel, build)
+		}
+	}
+
+	if len(topLevel) > maxBuilds {
+		topLevel = topLevel[:maxBuilds]
+	}
+
+	grouped := make([]RecordedBuild, 0, len(builds))
+	for _, build := range topLevel {
+		grouped = append(grouped, build)
+		if build.Parent == nil {
+			grouped = append(grouped, children[parentKey(*build.BuildId)]...)
+		}
+	}
+	return grouped
+}
+
+// A step, and where its bar goes on its build's timeline, as percentages of the
+// timeline's width.
+type timelineBar struct {
+	RecordedStep
+	Offset string
+	Width  string
+}
+
+// Lay steps out on a timeline from the first starting to the last finishing
+// (or now, if any are still running).
+func stepTimeline(steps []RecordedStep) []timelineBar {
+	var start, end time.Time
+	for _, step := range steps {
+		if step.StartTime.IsZero() {
+			continue
+		}
+		stepEnd := step.EndTime()
+		if stepEnd.IsZero() {
+			stepEnd = time.Now()
+		}
+		if start.IsZero() || step.StartTime.Before(start) {
+			start = step.StartTime
+		}
+		if stepEnd.After(end) {
+			end = stepEnd
+		}
+	}
+	span := end.Sub(start)
+
+	bars := make([]timelineBar, 0, len(steps))
+	for _, step := range steps {
+		offset, width := 0.0, 0.0
+		if !step.StartTime.IsZero() && span > 0 {
+			stepEnd := step.EndTime()
+			if stepEnd.IsZero() {
+				stepEnd = end
+			}
+			offset = 100 * float64(step.StartTime.Sub(start)) / float64(span)
+			width = 100 * float64(stepEnd.Sub(step.StartTime)) / float64(span)
+		}
+		bars = append(bars, timelineBar{RecordedStep: step, Offset: fmt.Sprintf("%.1f", offset), Width: fmt.Sprintf("%.1f", width)})
+	}
+	return bars
 }
 
 var HTMLTemplate = `<!doctype html>
 <html>
 <head>
   <title>Kerouac: Build Report</title>
+  {{ if .RefreshSecs }}<meta http-equiv="refresh" content="{{ .RefreshSecs }}" />{{ end }}
   <style>
     table { border-collapse: collapse; }
 	table, th, td { border: 1px solid black; }
     th, td { padding: 1em; text-align: center; }
+    tr.status-SUCCEEDED { background-color: #dfd; }
+    tr.status-FAILED { background-color: #fdd; }
+    tr.status-RUNNING { background-color: #ddf; }
+    tr.status-TIMED_OUT { background-color: #fdb; }
+    tr.status-CANCELLED { background-color: #ddd; }
+    tr.status-ERRORED { background-color: #fdf; }
+    tr.status-SKIPPED { background-color: #eee; }
+    tr.status-QUEUED { background-color: #ffd; }
+    tr.status-SUPERSEDED { background-color: #eee; }
+    tr.matrix-child td.project, tr.matrix-child td.tag { padding-left: 2em; }
+    td.artifacts { text-align: left; }
+    td.steps { text-align: left; min-width: 20em; }
+    .timeline { background-color: #eee; height: 0.5em; }
+    .timeline .bar { display: block; height: 100%; background-color: #66c; }
+    .step.status-SUCCEEDED { color: #060; }
+    .step.status-FAILED, .step.status-TIMED_OUT { color: #c00; }
+    .step.status-SKIPPED, .step.status-CANCELLED { color: #666; }
   </style>
   {{ if .CSSPath }}<link rel="stylesheet" type="text/css" href="{{ .CSSPath | relative }}" />{{ end }}
 </head>
@@ -77,25 +200,61 @@ var HTMLTemplate = `<!doctype html>
 <th>End</th>
 <th>Duration</th>
 <th>Status</th>
+<th>Exit</th>
+<th>CPU (user / sys)</th>
+<th>Max RSS</th>
+<th>Steps</th>
 <th>Logs</th>
+<th>Artifacts</th>
 <th>Tarball</th>
+<th>Config</th>
 </tr>
 </thead>
 <tbody>
 {{ range .Builds }}
-<tr class="build status-{{ .Status }}">
+<tr class="build status-{{ .Status }}{{ if .Parent }} matrix-child{{ end }}">
   <td class="project">{{ .Project }}</td>
-  <td class="tag">{{ .Tag }}</td>
+  <td class="tag">{{ if .Parent }}<span class="matrix-key">{{ .MatrixKey }}</span><br />{{ end }}{{ .Tag }}{{ with .RerunOf }}<br /><span class="rerun-of">rerun of {{ .Tag }} at {{ .DateTime | friendlyDate }}</span>{{ end }}{{ with .SupersededBy }}<br /><span class="superseded-by">superseded by {{ .Tag }} at {{ .DateTime | friendlyDate }}</span>{{ end }}</td>
   <td class="start">{{ .DateTime | friendlyDate }}</td>
   <td class="end">{{ if .EndTime }}{{ .EndTime | friendlyDate }}{{ end }}</td>
   <td class="duration">{{ .Duration }}</td>
   <td class="status">{{ .Status }}</td>
+  {{ with .Usage }}
+  <td class="exit">{{ if .Signal }}signal {{ printf "%d" .Signal }} ({{ .Signal }}){{ else }}{{ .ExitCode }}{{ end }}</td>
+  <td class="cpu">{{ .UserTime }} / {{ .SystemTime }}</td>
+  <td class="maxrss">{{ .MaxRSSKB | friendlyKB }}</td>
+  {{ else }}
+  <td class="exit"></td>
+  <td class="cpu"></td>
+  <td class="maxrss"></td>
+  {{ end }}
+  {{ $build := . }}
+  <td class="steps">
+	{{ range timeline .Steps }}
+	<div class="step status-{{ .Status }}">
+	  <div class="timeline"><span class="bar" style="margin-left: {{ .Offset }}%; width: {{ .Width }}%"></span></div>
+	  {{ .Name }}: {{ .Status }}{{ if .Duration }} in {{ .Duration }}{{ end }}
+	  {{ if not .StartTime.IsZero }}
+	  <a href="{{ $build.FmtStepStdoutLogPath .Name | relative }}">stdout</a>
+	  <a href="{{ $build.FmtStepStderrLogPath .Name | relative }}">stderr</a>
+	  <a href="{{ $build.FmtStepCombinedLogPath .Name | relative }}">combined</a>
+	  {{ end }}
+	</div>
+	{{ end }}
+  </td>
   <td class="logs">
 	<a href="{{ .FmtStdoutLogPath | relative }}">{{ .FmtStdoutLogPath | base }}</a>
 	<a href="{{ .FmtStderrLogPath | relative }}">{{ .FmtStderrLogPath | base }}</a>
 	<a href="{{ .FmtKerouacLogPath | relative }}">{{ .FmtKerouacLogPath | base }}</a>
+	<a href="{{ .FmtCombinedLogPath | relative }}">{{ .FmtCombinedLogPath | base }}</a>
+  </td>
+  <td class="artifacts">
+	{{ range artifacts .BuildId }}
+	<a href="{{ $build.FmtArtifactPath .Path | relative }}" title="sha256 {{ .SHA256 }}">{{ .Path }}</a> ({{ .Size }} bytes)<br />
+	{{ end }}
   </td>
   <td class="tarball"><a href="{{ .FmtTarballPath | relative }}">{{ .FmtTarballPath | base }}</a></td>
+  <td class="config">{{ with .ConfigHash }}<a href="{{ $build.FmtConfigSnapshotPath | relative }}" title="sha256 {{ . }}">{{ printf "%.12s" . }}</a>{{ end }}</td>
 </tr>
 {{ end }}
 </tbody>
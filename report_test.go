@@ -0,0 +1,58 @@
+package main
+
+import (
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestStepTimeline(t *testing.T) {
+	start := KnownDateTime
+	steps := []RecordedStep{
+		{Position: 0, Name: "setup", Status: SUCCEEDED, StartTime: start, Duration: 2 * time.Second},
+		{Position: 1, Name: "lint", Status: SUCCEEDED, StartTime: start.Add(2 * time.Second), Duration: 8 * time.Second},
+		{Position: 2, Name: "test", Status: FAILED, StartTime: start.Add(2 * time.Second), Duration: 4 * time.Second},
+		{Position: 3, Name: "package", Status: SKIPPED},
+	}
+
+	bars := stepTimeline(steps)
+
+	positions := make([][2]string, 0, len(bars))
+	for _, bar := range bars {
+		positions = append(positions, [2]string{bar.Offset, bar.Width})
+	}
+	expected := [][2]string{{"0.0", "20.0"}, {"20.0", "80.0"}, {"20.0", "40.0"}, {"0.0", "0.0"}}
+	if !reflect.DeepEqual(positions, expected) {
+		t.Errorf("Timeline positions were %v not %v", positions, expected)
+	}
+}
+
+func TestGroupMatrixBuilds(t *testing.T) {
+	parent := BuildIdAt(KnownRootDir, KnownProject, "v1", KnownDateTime)
+	child := BuildIdAt(KnownRootDir, KnownProject, "v1~linux", KnownDateTime)
+	newer := BuildIdAt(KnownRootDir, KnownProject, "v2", KnownDateTime.Add(time.Hour))
+	orphan := BuildIdAt(KnownRootDir, KnownProject, "v0~linux", KnownDateTime.Add(-time.Hour))
+	missingParent := BuildIdAt(KnownRootDir, KnownProject, "v0", KnownDateTime.Add(-time.Hour))
+
+	builds := []RecordedBuild{
+		{BuildId: &newer},
+		{BuildId: &child, Parent: &parent, MatrixKey: "GOOS=linux"},
+		{BuildId: &parent},
+		{BuildId: &orphan, Parent: &missingParent, MatrixKey: "GOOS=linux"},
+	}
+
+	tags := func(builds []RecordedBuild) []string {
+		tags := make([]string, 0, len(builds))
+		for _, build := range builds {
+			tags = append(tags, build.Tag)
+		}
+		return tags
+	}
+
+	if grouped := tags(groupMatrixBuilds(builds, 10)); !reflect.DeepEqual(grouped, []string{"v2", "v1", "v1~linux", "v0~linux"}) {
+		t.Errorf("Builds grouped as %v", grouped)
+	}
+	if grouped := tags(groupMatrixBuilds(builds, 2)); !reflect.DeepEqual(grouped, []string{"v2", "v1", "v1~linux"}) {
+		t.Errorf("Builds limited to 2 grouped as %v", grouped)
+	}
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"io/ioutil"
+	"log"
+	"os"
+)
+
+func DoRerunCommand() {
+	flag.Usage = func() {
+		fmt.Printf("Usage: kerouac rerun [options] <kerouacRootDir> <project> <tag> [datetime]\n\n")
+		fmt.Printf("Builds the source tarball of the specified build again, with the config it was built with,\n")
+		fmt.Printf("as a new build of the same tag recorded as a rerun of it.  Builds from before configs were\n")
+		fmt.Printf("recorded are rebuilt with the %s in their source.\n\n", SourceConfigName)
+		fmt.Printf("If datetime is not specified, reruns the latest build for the tag.\n\n")
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if len(flag.Args()) < 3 || len(flag.Args()) > 4 {
+		flag.Usage()
+		os.Exit(ExitErrored)
+	}
+
+	kerouacRoot := flag.Arg(0)
+	project := flag.Arg(1)
+	tag := flag.Arg(2)
+	var datetime string
+	if len(flag.Args()) == 4 {
+		datetime = flag.Arg(3)
+	}
+
+	store, err := OpenBuildStore(kerouacRoot)
+	if err != nil {
+		log.Printf("Error opening build db: %s", err)
+		os.Exit(ExitErrored)
+	}
+
+	original, err := FindLatestBuild(store, project, tag, datetime)
+	store.Close()
+	if err != nil {
+		log.Printf("Error finding build: %s", err)
+		os.Exit(ExitErrored)
+	}
+	if original == nil {
+		log.Printf("No build of %s with tag %s found.", project, tag)
+		os.Exit(ExitErrored)
+	}
+
+	srcDir, configFile, err := restoreForRerun(*original)
+	if err != nil {
+		log.Printf("Can't rerun %s: %s", original.FmtBuildDir(), err)
+		os.Exit(ExitErrored)
+	}
+
+	// The restored source is ours to clean up.
+	*removeSrcDir = true
+
+	log.Printf("Rerunning %s in %s with %s", original.FmtBuildDir(), srcDir, configFile)
+	buildAndExit(srcDir, configFile, kerouacRoot, project, tag, original.BuildId)
+}
+
+// Extract original's tarball into a new temp dir, returning it and the config
+// original was built with (see recordedConfigFile), checking there is one.
+func restoreForRerun(original RecordedBuild) (string, string, error) {
+	if original.Parent != nil {
+		return "", "", fmt.Errorf("it is part of the matrix build %s, rerun that instead", original.Parent.Tag)
+	}
+
+	if _, err := os.Stat(original.FmtTarballPath()); err != nil {
+		return "", "", err
+	}
+
+	srcDir, err := ioutil.TempDir("", "kerouac_rerun_")
+	if err != nil {
+		return "", "", err
+	}
+
+	if err = ExtractTarball(original.FmtTarballPath(), srcDir); err != nil {
+		os.RemoveAll(srcDir)
+		return "", "", err
+	}
+
+	configFile := recordedConfigFile(original, srcDir)
+	if _, err = os.Stat(configFile); err != nil {
+		os.RemoveAll(srcDir)
+		return "", "", err
+	}
+
+	return srcDir, configFile, nil
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"testing"
+)
+
+// A build under tmpDir whose tarball has the given files, with only its
+// tarball recorded.
+func makeRerunBuild(t *testing.T, tmpDir string, files map[string]string) RecordedBuild {
+	srcDir := filepath.Join(tmpDir, "src")
+	os.MkdirAll(srcDir, 0700)
+	for name, contents := range files {
+		ioutil.WriteFile(filepath.Join(srcDir, name), []byte(contents), 0700)
+	}
+
+	buildId := BuildIdAt(filepath.Join(tmpDir, "root"), KnownProject, KnownTag, KnownDateTime)
+	os.MkdirAll(buildId.FmtBuildDir(), 0700)
+	if err := CreateTarball(srcDir, nil, buildId); err != nil {
+		t.Fatal(err)
+	}
+	return RecordedBuild{BuildId: &buildId}
+}
+
+func TestRestoreForRerun(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "kerouac_rerun_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	original := makeRerunBuild(t, tmpDir, map[string]string{"build.sh": "#!/bin/sh\n"})
+
+	if _, _, err = restoreForRerun(original); err == nil {
+		t.Errorf("No error restoring a build without a config snapshot or source config")
+	}
+
+	config, err := ParseConfigFile("testfiles/good_json_only_required.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if _, err = WriteConfigSnapshot(original.FmtConfigSnapshotPath(), config); err != nil {
+		t.Fatal(err)
+	}
+
+	restored, configFile, err := restoreForRerun(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(restored)
+	if _, err = os.Stat(filepath.Join(restored, "build.sh")); err != nil {
+		t.Errorf("Restored source is missing build.sh: %s", err)
+	}
+	if configFile != original.FmtConfigSnapshotPath() {
+		t.Errorf("Rerun config was %s not the snapshot", configFile)
+	}
+
+	parent := BuildIdAt(original.RootDir, KnownProject, KnownTag, KnownDateTime)
+	original.Parent = &parent
+	if _, _, err = restoreForRerun(original); err == nil {
+		t.Errorf("No error restoring a matrix child")
+	}
+}
+
+func TestRestoreForRerunWithoutSnapshot(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "kerouac_rerun_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	original := makeRerunBuild(t, tmpDir, map[string]string{"build.sh": "#!/bin/sh\n", SourceConfigName: `{"BuildScript": "./build.sh", "TimeoutInSecs": 10}`})
+
+	restored, configFile, err := restoreForRerun(original)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(restored)
+	if expected := filepath.Join(restored, SourceConfigName); configFile != expected {
+		t.Errorf("Rerun config was %s not %s", configFile, expected)
+	}
+}
@@ -0,0 +1,201 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+)
+
+// Secrets for a build, from a JSON file of variable names and values, e.g.:
+//
+//	{"DEPLOY_TOKEN": "hunter2"}
+//
+// The variables are added to the build's environment, and their values are
+// masked in its logs (see Redactor).
+type Secrets map[string]string
+
+// Where kerouac looks for secrets files by default, ~/.kerouac/secrets.  It's
+// outside the kerouac root so it isn't served with the builds.
+func DefaultSecretsDir() string {
+	return filepath.Join(os.Getenv("HOME"), ".kerouac", "secrets")
+}
+
+// The path of the secrets file called name in dir.
+func FmtSecretsPath(dir string, name string) string {
+	return filepath.Join(dir, name+".json")
+}
+
+func LoadSecretsFile(path string) (Secrets, error) {
+	file, err := os.Open(path)
+	if err != nil {
+		return nil, fmt.Errorf("Could not read secrets file: %s", err)
+	}
+	defer file.Close()
+
+	if stat, err := file.Stat(); err == nil && stat.Mode().Perm()&0077 != 0 {
+		log.Printf("Warning, secrets file %s can be read by others (mode %s).", path, stat.Mode().Perm())
+	}
+
+	var secrets Secrets
+	if err = json.NewDecoder(file).Decode(&secrets); err != nil {
+		// Don't include the error, it may quote the file.
+		return nil, fmt.Errorf("Error parsing json in secrets file %s", path)
+	}
+
+	for name := range secrets {
+		if !envVarNameRegexp.MatchString(name) {
+			return nil, fmt.Errorf("Secret %q is not a valid environment variable name.", name)
+		}
+		if strings.HasPrefix(name, KerouacEnvPrefix) {
+			return nil, fmt.Errorf("Secret %s can't start with %s, those are set by kerouac.", name, KerouacEnvPrefix)
+		}
+	}
+
+	return secrets, nil
+}
+
+// The secrets as VAR=value, sorted by name.
+func (s Secrets) Env() []string {
+	env := make([]string, 0, len(s))
+	for name, value := range s {
+		env = append(env, name+"="+value)
+	}
+	sort.Strings(env)
+	return env
+}
+
+// The shortest line of a value with several lines that's masked, so lines like
+// "}" don't mask everything else that has them.
+const MinSecretLineLength = 8
+
+// The values to mask in logs.  Values with several lines are masked a line at
+// a time, so the log line they'd end up split across doesn't matter, leaving
+// out short lines and PEM "-----BEGIN ...-----" style lines, which say nothing
+// secret.
+func (s Secrets) Values() []string {
+	values := make([]string, 0, len(s))
+	for _, value := range s {
+		// A trailing newline doesn't make a value multi-line.
+		value = strings.TrimRight(value, "\r\n")
+		if !strings.Contains(value, "\n") {
+			if value != "" {
+				values = append(values, value)
+			}
+			continue
+		}
+
+		for _, line := range strings.Split(value, "\n") {
+			line = strings.TrimSpace(line)
+			if len(line) >= MinSecretLineLength && !strings.HasPrefix(line, "-----") {
+				values = append(values, line)
+			}
+		}
+	}
+	return values
+}
+
+// What secrets are replaced with in logs.
+const RedactedSecret = "[REDACTED]"
+
+// A Redactor is an io.Writer that masks secrets in what's written to it before
+// passing it on to another Writer.
+//
+// A secret may be split across writes, so the end of a write that could be
+// the start of one is held back until the next write shows whether it is.
+// Secrets don't contain newlines (see Secrets.Values), so nothing is held back
+// past the end of a line.  Call Flush once finished to write anything still
+// held back.
+type Redactor struct {
+	w       io.Writer
+	secrets [][]byte
+	pending []byte
+}
+
+func NewRedactor(w io.Writer, secrets []string) *Redactor {
+	redactor := &Redactor{w: w}
+	for _, secret := range secrets {
+		if secret != "" {
+			redactor.secrets = append(redactor.secrets, []byte(secret))
+		}
+	}
+	// Longest first, so a secret containing another is masked whole.
+	sort.Slice(redactor.secrets, func(i, j int) bool {
+		return len(redactor.secrets[i]) > len(redactor.secrets[j])
+	})
+	return redactor
+}
+
+func (r *Redactor) Write(p []byte) (int, error) {
+	if len(r.secrets) == 0 {
+		return r.w.Write(p)
+	}
+
+	r.pending = append(r.pending, p...)
+
+	out, held := r.redact(r.pending, false)
+	if len(out) > 0 {
+		if _, err := r.w.Write(out); err != nil {
+			return 0, err
+		}
+	}
+	r.pending = append(r.pending[:0], held...)
+
+	return len(p), nil
+}
+
+// Write out anything held back.
+func (r *Redactor) Flush() error {
+	if len(r.pending) == 0 {
+		return nil
+	}
+	out, _ := r.redact(r.pending, true)
+	r.pending = nil
+	_, err := r.w.Write(out)
+	return err
+}
+
+// Mask the secrets in p, returning the result and, unless final, the end of p
+// that might be the start of a secret.
+func (r *Redactor) redact(p []byte, final bool) ([]byte, []byte) {
+	var out bytes.Buffer
+
+	for i := 0; i < len(p); {
+		rest := p[i:]
+
+		if !final && r.mightStartSecret(rest) {
+			return out.Bytes(), rest
+		}
+
+		matched := false
+		for _, secret := range r.secrets {
+			if bytes.HasPrefix(rest, secret) {
+				out.WriteString(RedactedSecret)
+				i += len(secret)
+				matched = true
+				break
+			}
+		}
+		if !matched {
+			out.WriteByte(p[i])
+			i++
+		}
+	}
+
+	return out.Bytes(), nil
+}
+
+// Whether rest is the start of a secret longer than it.
+func (r *Redactor) mightStartSecret(rest []byte) bool {
+	for _, secret := range r.secrets {
+		if len(secret) > len(rest) && bytes.HasPrefix(secret, rest) {
+			return true
+		}
+	}
+	return false
+}
@@ -0,0 +1,153 @@
+package main
+
+import (
+	"bytes"
+	"io/ioutil"
+	"os"
+	"reflect"
+	"sort"
+	"strings"
+	"testing"
+)
+
+func TestLoadSecretsFile(t *testing.T) {
+	secrets, err := LoadSecretsFile("testfiles/good_secrets.json")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	expected := []string{"DEPLOY_TOKEN=hunter2", "SIGNING_KEY=-----BEGIN KEY-----\nMIIBVgIBADANBgkq\n-----END KEY-----"}
+	if env := secrets.Env(); !reflect.DeepEqual(env, expected) {
+		t.Errorf("Secrets env was %q not %q", env, expected)
+	}
+
+	values := secrets.Values()
+	sort.Strings(values)
+	if expected := []string{"MIIBVgIBADANBgkq", "hunter2"}; !reflect.DeepEqual(values, expected) {
+		t.Errorf("Secret values were %q not %q", values, expected)
+	}
+
+	for _, path := range []string{
+		"testfiles/secrets_with_kerouac_var.json",
+		"testfiles/secrets_with_bad_name.json",
+		"testfiles/bad_json_config.json",
+		"testfiles/no_such_secrets.json",
+	} {
+		if secrets, err := LoadSecretsFile(path); err == nil {
+			t.Errorf("No error for %s, returned %v", path, secrets)
+		}
+	}
+}
+
+func TestRedactor(t *testing.T) {
+	secrets := []string{"hunter2", "hunter22", "abc"}
+
+	for _, test := range []struct {
+		input    string
+		expected string
+	}{
+		{"password is hunter2\n", "password is [REDACTED]\n"},
+		{"hunter22 hunter2 hunter\n", "[REDACTED] [REDACTED] hunter\n"},
+		{"abcabc ab hhunter2\n", "[REDACTED][REDACTED] ab h[REDACTED]\n"},
+		{"no secrets here\n", "no secrets here\n"},
+		{"ends with hunt", "ends with hunt"},
+	} {
+		// Every way of splitting the input into two writes, so secrets
+		// straddle the boundary.
+		for split := 0; split <= len(test.input); split++ {
+			var buf bytes.Buffer
+			redactor := NewRedactor(&buf, secrets)
+			for _, part := range []string{test.input[:split], test.input[split:]} {
+				if n, err := redactor.Write([]byte(part)); err != nil || n != len(part) {
+					t.Fatalf("Write returned %d, %v", n, err)
+				}
+			}
+			if err := redactor.Flush(); err != nil {
+				t.Fatal(err)
+			}
+			if buf.String() != test.expected {
+				t.Errorf("Split at %d, %q was redacted to %q not %q", split, test.input, buf.String(), test.expected)
+			}
+		}
+
+		// And a byte at a time.
+		var buf bytes.Buffer
+		redactor := NewRedactor(&buf, secrets)
+		for i := range test.input {
+			redactor.Write([]byte{test.input[i]})
+		}
+		redactor.Flush()
+		if buf.String() != test.expected {
+			t.Errorf("A byte at a time, %q was redacted to %q not %q", test.input, buf.String(), test.expected)
+		}
+	}
+}
+
+func TestMultiLineSecretsLeaveStructureUnredacted(t *testing.T) {
+	secrets := Secrets{"CREDENTIALS": "{\n  \"type\": \"service_account\",\n  \"private_key\": \"s3cr3t-k3y-data\"\n}\n", "PIN": "1234\n"}
+
+	var buf bytes.Buffer
+	redactor := NewRedactor(&buf, secrets.Values())
+	redactor.Write([]byte("config: {\"retries\": 3}\nkey \"private_key\": \"s3cr3t-k3y-data\"\npin 1234\n"))
+	redactor.Flush()
+
+	if expected := "config: {\"retries\": 3}\nkey [REDACTED]\npin [REDACTED]\n"; buf.String() != expected {
+		t.Errorf("Redacted to %q not %q", buf.String(), expected)
+	}
+}
+
+func TestRedactorHoldsBackPossibleSecrets(t *testing.T) {
+	var buf bytes.Buffer
+	redactor := NewRedactor(&buf, []string{"hunter2"})
+
+	redactor.Write([]byte("line one\nthe password is hun"))
+	if buf.String() != "line one\nthe password is " {
+		t.Errorf("Wrote %q before knowing whether the secret followed", buf.String())
+	}
+
+	redactor.Write([]byte("ter2 ok\n"))
+	if buf.String() != "line one\nthe password is [REDACTED] ok\n" {
+		t.Errorf("Wrote %q", buf.String())
+	}
+}
+
+func TestRunBuildScriptRedactsSecrets(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "kerouac_secrets_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	// The secret is written in two parts, with a pause between, so it
+	// straddles two writes to the logs.
+	script := "#!/bin/sh\nprintf 'token hun'\nsleep 0.2\nprintf 'ter2\\n'\necho \"$DEPLOY_TOKEN\" >&2\n"
+	srcDir, buildId := makeScriptBuild(t, tmpDir, script)
+
+	secrets := Secrets{"DEPLOY_TOKEN": "hunter2"}
+	env := append(os.Environ(), secrets.Env()...)
+
+	if _, err = RunBuildScript(srcDir, "./build.sh", nil, env, secrets.Values(), 10, 1, nil, buildId); err != nil {
+		t.Fatal(err)
+	}
+
+	for path, expected := range map[string]string{
+		buildId.FmtStdoutLogPath(): "token [REDACTED]\n",
+		buildId.FmtStderrLogPath(): "[REDACTED]\n",
+	} {
+		contents, err := ioutil.ReadFile(path)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if string(contents) != expected {
+			t.Errorf("%s was %q not %q", path, contents, expected)
+		}
+	}
+
+	combined, err := ioutil.ReadFile(buildId.FmtCombinedLogPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if strings.Contains(string(combined), "hunter2") || strings.Count(string(combined), RedactedSecret) != 2 {
+		t.Errorf("Combined log not redacted: %q", combined)
+	}
+}
@@ -0,0 +1,40 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"net/http"
+	"os"
+)
+
+var serveAddr = flag.String("addr", ":8080", "The address for kerouac serve to listen on.")
+
+func DoServeCommand() {
+	flag.Usage = func() {
+		fmt.Printf("Usage: kerouac serve [options] <kerouacRootDir>\n\n")
+		fmt.Printf("Serves the build report, logs and tarballs for the kerouac root over HTTP.\n\n")
+		fmt.Printf("Example: 'kerouac serve --addr localhost:9000 /var/kerouac'\n")
+	}
+
+	flag.Parse()
+
+	if len(flag.Args()) != 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	kerouacRoot := flag.Arg(0)
+
+	store, err := OpenBuildStore(kerouacRoot)
+	if err != nil {
+		log.Fatalf("Error opening build db: %s", err)
+	}
+	defer store.Close()
+
+	log.Printf("Serving %s on %s", kerouacRoot, *serveAddr)
+
+	if err = http.ListenAndServe(*serveAddr, NewServer(kerouacRoot, store)); err != nil {
+		log.Fatalf("Error serving: %s", err)
+	}
+}
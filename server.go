@@ -0,0 +1,199 @@
+package main
+
+import (
+	"bytes"
+	"fmt"
+	"log"
+	"net/http"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// How often the served report reloads itself while builds are running.
+const ServerRefreshSecs = 10
+
+// Server serves the build report for a kerouac root, rendered fresh on each
+// request, along with the logs and tarballs of the builds it lists.
+//
+// The report is at /, and each build's files are at their path relative to
+// the kerouac root (e.g. /builds/project/tag/datetag/logs/stdout), which is
+// what the report links to.  Only the files named by the BuildId.Fmt*Path
+// methods for recorded builds are served, never anything else in the root.
+//
+// There is also a JSON API under APIPrefix (see api.go).
+type Server struct {
+	rootDir string
+	store   BuildStore
+	mux     *http.ServeMux
+}
+
+func NewServer(rootDir string, store BuildStore) *Server {
+	server := &Server{rootDir: rootDir, store: store, mux: http.NewServeMux()}
+	server.mux.HandleFunc("/", server.serveReport)
+	server.mux.HandleFunc("/"+BuildCSSName, server.serveCSS)
+	server.mux.HandleFunc("/"+BuildsDir+"/", server.serveBuildFile)
+	server.mux.HandleFunc(APIPrefix, server.serveAPI)
+	return server
+}
+
+func (s *Server) ServeHTTP(w http.ResponseWriter, r *http.Request) {
+	s.mux.ServeHTTP(w, r)
+}
+
+func (s *Server) serveReport(w http.ResponseWriter, r *http.Request) {
+	if r.URL.Path != "/" {
+		http.NotFound(w, r)
+		return
+	}
+
+	builds, err := s.store.FindMatchingBuilds("", "", "")
+	if err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	refreshSecs := 0
+	for _, build := range builds {
+		if build.Status == RUNNING {
+			refreshSecs = ServerRefreshSecs
+			break
+		}
+	}
+
+	// Render to a buffer first, so a template error doesn't leave the
+	// client with half a page.
+	var report bytes.Buffer
+	if err = WriteHTMLReport(&report, s.rootDir, builds, refreshSecs); err != nil {
+		s.serverError(w, r, err)
+		return
+	}
+
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.Write(report.Bytes())
+}
+
+func (s *Server) serveCSS(w http.ResponseWriter, r *http.Request) {
+	http.ServeFile(w, r, FmtBuildCSSPath(s.rootDir))
+}
+
+func (s *Server) serveBuildFile(w http.ResponseWriter, r *http.Request) {
+	filePath, err := s.findBuildFile(r.URL.Path)
+	if err != nil {
+		log.Printf("Refusing %s: %s", r.URL.Path, err)
+		http.NotFound(w, r)
+		return
+	}
+
+	http.ServeFile(w, r, filePath)
+}
+
+// Map urlPath (like /builds/project/tag/datetag/logs/stdout) to one of the
+// files of a recorded build, or return an error if it isn't one.
+func (s *Server) findBuildFile(urlPath string) (string, error) {
+	filePath, err := resolveUnderRoot(s.rootDir, urlPath)
+	if err != nil {
+		return "", err
+	}
+
+	// builds / project / tag / datetag / file...
+	segments := strings.SplitN(strings.TrimPrefix(path.Clean(urlPath), "/"), "/", 5)
+	if len(segments) < 5 || segments[0] != BuildsDir {
+		return "", fmt.Errorf("not a build file path")
+	}
+
+	dateTime, err := time.Parse(DateTagFormat, segments[3])
+	if err != nil {
+		return "", fmt.Errorf("bad datetag: %s", err)
+	}
+
+	recordedBuild, err := FindLatestBuild(s.store, segments[1], segments[2], dateTime.Format(DateFormat))
+	if err != nil {
+		return "", err
+	}
+	if recordedBuild == nil {
+		return "", fmt.Errorf("no such build")
+	}
+
+	for _, buildFile := range servedBuildFiles(*recordedBuild) {
+		if filepath.Clean(buildFile) == filePath {
+			return filePath, nil
+		}
+	}
+
+	return "", fmt.Errorf("not a served build file")
+}
+
+// The files of a build that may be served.
+func servedBuildFiles(recordedBuild RecordedBuild) []string {
+	files := []string{
+		recordedBuild.FmtStdoutLogPath(),
+		recordedBuild.FmtStderrLogPath(),
+		recordedBuild.FmtKerouacLogPath(),
+		recordedBuild.FmtCombinedLogPath(),
+		recordedBuild.FmtTarballPath(),
+		recordedBuild.FmtConfigSnapshotPath(),
+	}
+
+	for _, step := range recordedBuild.Steps {
+		files = append(files,
+			recordedBuild.FmtStepStdoutLogPath(step.Name),
+			recordedBuild.FmtStepStderrLogPath(step.Name),
+			recordedBuild.FmtStepCombinedLogPath(step.Name),
+		)
+	}
+
+	if manifest, err := ReadArtifactManifest(*recordedBuild.BuildId); err != nil {
+		log.Printf("Could not read artifacts of %s: %s", recordedBuild.FmtBuildDir(), err)
+	} else {
+		files = append(files, recordedBuild.FmtArtifactsManifestPath())
+		for _, artifact := range manifest.Artifacts {
+			files = append(files, recordedBuild.FmtArtifactPath(artifact.Path))
+		}
+	}
+
+	return files
+}
+
+// Join urlPath onto rootDir, returning an error if the result would be
+// outside rootDir (including via symlinks).
+func resolveUnderRoot(rootDir string, urlPath string) (string, error) {
+	if strings.Contains(urlPath, "\x00") {
+		return "", fmt.Errorf("path contains NUL")
+	}
+
+	for _, segment := range strings.Split(urlPath, "/") {
+		if segment == ".." {
+			return "", fmt.Errorf("path contains ..")
+		}
+	}
+
+	filePath := filepath.Join(rootDir, filepath.FromSlash(path.Clean("/"+urlPath)))
+	if !isUnder(rootDir, filePath) {
+		return "", fmt.Errorf("path is outside the kerouac root")
+	}
+
+	// If the file exists, make sure no symlink along the way leads out.
+	realRoot, rootErr := filepath.EvalSymlinks(rootDir)
+	realPath, pathErr := filepath.EvalSymlinks(filePath)
+	if rootErr == nil && pathErr == nil && !isUnder(realRoot, realPath) {
+		return "", fmt.Errorf("path links outside the kerouac root")
+	}
+
+	return filePath, nil
+}
+
+func isUnder(dir string, filePath string) bool {
+	rel, err := filepath.Rel(dir, filePath)
+	return err == nil && rel != ".." && !strings.HasPrefix(rel, ".."+string(filepath.Separator))
+}
+
+func (s *Server) serverError(w http.ResponseWriter, r *http.Request, err error) {
+	s.logError(r, err)
+	http.Error(w, "Internal server error", http.StatusInternalServerError)
+}
+
+func (s *Server) logError(r *http.Request, err error) {
+	log.Printf("Error serving %s: %s", r.URL.Path, err)
+}
@@ -0,0 +1,174 @@
+package main
+
+import (
+	"io/ioutil"
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// Set up a kerouac root with one recorded build with a stdout log, plus a
+// file that shouldn't be served, and a Server for it.
+func makeTestServer(t *testing.T) (*Server, BuildId, string) {
+	rootDir, err := ioutil.TempDir("", "kerouac_server_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	store := NewMemoryBuildStore(rootDir)
+	buildId := BuildIdAt(rootDir, KnownProject, KnownTag, KnownDateTime)
+	if err = store.CreateBuildRecord(buildId); err != nil {
+		t.Fatal(err)
+	}
+
+	os.MkdirAll(buildId.FmtLogsDir(), 0700)
+	if err = ioutil.WriteFile(buildId.FmtStdoutLogPath(), []byte("build output"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err = ioutil.WriteFile(filepath.Join(buildId.FmtLogsDir(), "secret"), []byte("secret"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	return NewServer(rootDir, store), buildId, rootDir
+}
+
+func serveTestRequest(server *Server, urlPath string) *httptest.ResponseRecorder {
+	recorder := httptest.NewRecorder()
+	request, _ := http.NewRequest("GET", "http://kerouac"+urlPath, nil)
+	server.ServeHTTP(recorder, request)
+	return recorder
+}
+
+func TestServerServesReport(t *testing.T) {
+	server, _, rootDir := makeTestServer(t)
+	defer os.RemoveAll(rootDir)
+
+	response := serveTestRequest(server, "/")
+	if response.Code != http.StatusOK {
+		t.Fatalf("Report returned %d", response.Code)
+	}
+
+	body := response.Body.String()
+	if !strings.Contains(body, KnownProject) {
+		t.Errorf("Report did not include the build: %s", body)
+	}
+	if !strings.Contains(body, `http-equiv="refresh"`) {
+		t.Errorf("Report of a running build does not refresh: %s", body)
+	}
+}
+
+func TestServerServesBuildFiles(t *testing.T) {
+	server, buildId, rootDir := makeTestServer(t)
+	defer os.RemoveAll(rootDir)
+
+	stdoutPath, _ := filepath.Rel(rootDir, buildId.FmtStdoutLogPath())
+	response := serveTestRequest(server, "/"+filepath.ToSlash(stdoutPath))
+	if response.Code != http.StatusOK || response.Body.String() != "build output" {
+		t.Errorf("Stdout log returned %d: %s", response.Code, response.Body.String())
+	}
+
+	if err := server.store.RecordBuildStep(buildId, RecordedStep{Name: KnownStepName, Status: RUNNING, StartTime: KnownDateTime}); err != nil {
+		t.Fatal(err)
+	}
+	os.MkdirAll(buildId.FmtStepLogsDir(KnownStepName), 0700)
+	if err := ioutil.WriteFile(buildId.FmtStepStdoutLogPath(KnownStepName), []byte("step output"), 0600); err != nil {
+		t.Fatal(err)
+	}
+
+	stepStdoutPath, _ := filepath.Rel(rootDir, buildId.FmtStepStdoutLogPath(KnownStepName))
+	response = serveTestRequest(server, "/"+filepath.ToSlash(stepStdoutPath))
+	if response.Code != http.StatusOK || response.Body.String() != "step output" {
+		t.Errorf("Step stdout log returned %d: %s", response.Code, response.Body.String())
+	}
+
+	response = serveTestRequest(server, "/")
+	if !strings.Contains(response.Body.String(), filepath.ToSlash(stepStdoutPath)) {
+		t.Errorf("Report does not link to step stdout log: %s", response.Body.String())
+	}
+	if !strings.Contains(response.Body.String(), "margin-left: 0.0%; width: 100.0%") {
+		t.Errorf("Report does not show running step on timeline: %s", response.Body.String())
+	}
+}
+
+func TestServerServesArtifacts(t *testing.T) {
+	server, buildId, rootDir := makeTestServer(t)
+	defer os.RemoveAll(rootDir)
+
+	os.MkdirAll(filepath.Join(buildId.FmtArtifactsDir(), "dist"), 0700)
+	if err := ioutil.WriteFile(buildId.FmtArtifactPath("dist/app.deb"), []byte("package"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if err := ioutil.WriteFile(buildId.FmtArtifactPath("unlisted"), []byte("unlisted"), 0600); err != nil {
+		t.Fatal(err)
+	}
+	manifest := &ArtifactManifest{Artifacts: []Artifact{{Path: "dist/app.deb", Size: 7, SHA256: "abc"}}}
+	if err := writeArtifactManifest(buildId.FmtArtifactsManifestPath(), manifest); err != nil {
+		t.Fatal(err)
+	}
+
+	artifactPath, _ := filepath.Rel(rootDir, buildId.FmtArtifactPath("dist/app.deb"))
+	response := serveTestRequest(server, "/"+filepath.ToSlash(artifactPath))
+	if response.Code != http.StatusOK || response.Body.String() != "package" {
+		t.Errorf("Artifact returned %d: %s", response.Code, response.Body.String())
+	}
+
+	unlistedPath, _ := filepath.Rel(rootDir, buildId.FmtArtifactPath("unlisted"))
+	if response = serveTestRequest(server, "/"+filepath.ToSlash(unlistedPath)); response.Code != http.StatusNotFound {
+		t.Errorf("Artifact not in the manifest returned %d", response.Code)
+	}
+
+	response = serveTestRequest(server, "/")
+	if !strings.Contains(response.Body.String(), filepath.ToSlash(artifactPath)) {
+		t.Errorf("Report does not link to artifact: %s", response.Body.String())
+	}
+}
+
+func TestServerRefusesOtherFiles(t *testing.T) {
+	server, buildId, rootDir := makeTestServer(t)
+	defer os.RemoveAll(rootDir)
+
+	buildDir, _ := filepath.Rel(rootDir, buildId.FmtBuildDir())
+	buildDir = "/" + filepath.ToSlash(buildDir)
+
+	for _, urlPath := range []string{
+		buildDir + "/logs/secret",
+		buildDir + "/logs",
+		buildDir + "/../../../../" + BuildDbName,
+		"/builds/" + KnownProject + "/" + KnownTag + "/2001_01_01_00_00_00/logs/stdout",
+		"/builds/../../etc/passwd",
+	} {
+		// Paths with .. get redirected to their clean form, which is fine as
+		// long as that isn't served either.
+		response := serveTestRequest(server, urlPath)
+		if response.Code >= 300 && response.Code < 400 {
+			location, err := url.Parse("http://kerouac" + urlPath)
+			if err == nil {
+				location, err = location.Parse(response.Header().Get("Location"))
+			}
+			if err != nil {
+				t.Errorf("%s redirected to bad location %q: %s", urlPath, response.Header().Get("Location"), err)
+				continue
+			}
+			response = serveTestRequest(server, location.RequestURI())
+		}
+		if response.Code != http.StatusNotFound {
+			t.Errorf("%s returned %d", urlPath, response.Code)
+		}
+	}
+}
+
+func TestResolveUnderRoot(t *testing.T) {
+	if _, err := resolveUnderRoot("root", "/builds/a/b"); err != nil {
+		t.Errorf("Path under root refused: %s", err)
+	}
+
+	for _, urlPath := range []string{"/../etc/passwd", "/builds/../../x", "/a\x00b"} {
+		if _, err := resolveUnderRoot("root", urlPath); err == nil {
+			t.Errorf("Path %q escaping root accepted", urlPath)
+		}
+	}
+}
@@ -0,0 +1,16 @@
+package main
+
+import (
+	_ "github.com/mattn/go-sqlite3"
+)
+
+// The database/sql driver used for builds.db.  To use a different sqlite
+// driver, change the import above and these.
+
+const BuildDbDriver = "sqlite3"
+
+func buildDbDataSource(buildDbPath string) string {
+	// Wait for other kerouacs to release the db rather than failing with
+	// "database is locked".
+	return buildDbPath + "?_busy_timeout=10000"
+}
@@ -0,0 +1,388 @@
+package main
+
+import (
+	"database/sql"
+	"encoding/json"
+	"fmt"
+	"os"
+	"path/filepath"
+	"syscall"
+	"time"
+)
+
+// SQLBuildStore keeps build records in a database/sql db, normally the sqlite
+// builds.db in the kerouac root (see sqlite.go for the driver).
+type SQLBuildStore struct {
+	db      *sql.DB
+	rootDir string
+}
+
+// Open the sqlite builds db under rootDir, creating it and applying any
+// pending migrations as needed.
+func OpenSQLiteBuildStore(rootDir string) (*SQLBuildStore, error) {
+	db, err := openBuildDb(rootDir)
+	if err != nil {
+		return nil, err
+	}
+
+	store, err := NewSQLBuildStore(db, rootDir)
+	if err != nil {
+		db.Close()
+		return nil, err
+	}
+
+	return store, nil
+}
+
+// Keep the records for builds under the kerouac root rootDir in db, applying
+// any pending migrations to it first.
+func NewSQLBuildStore(db *sql.DB, rootDir string) (*SQLBuildStore, error) {
+	if _, err := applyMigrations(db); err != nil {
+		return nil, err
+	}
+	return &SQLBuildStore{db: db, rootDir: rootDir}, nil
+}
+
+func (s *SQLBuildStore) CreateBuildRecord(buildId BuildId) error {
+	_, err := s.db.Exec("INSERT INTO builds (project, tag, started_at, status) VALUES (?, ?, ?, ?)", buildId.Project, buildId.Tag, buildId.DateTime.Format(DateFormat), string(RUNNING))
+	return err
+}
+
+func (s *SQLBuildStore) CreateMatrixBuildRecord(buildId BuildId, parent BuildId, matrixKey string) error {
+	_, err := s.db.Exec("INSERT INTO builds (project, tag, started_at, status, parent_tag, matrix_key) VALUES (?, ?, ?, ?, ?, ?)", buildId.Project, buildId.Tag, buildId.DateTime.Format(DateFormat), string(RUNNING), parent.Tag, matrixKey)
+	return err
+}
+
+func (s *SQLBuildStore) CreateRerunBuildRecord(buildId BuildId, original BuildId) error {
+	_, err := s.db.Exec("INSERT INTO builds (project, tag, started_at, status, rerun_of_tag, rerun_of_started_at) VALUES (?, ?, ?, ?, ?, ?)", buildId.Project, buildId.Tag, buildId.DateTime.Format(DateFormat), string(RUNNING), original.Tag, original.DateTime.Format(DateFormat))
+	return err
+}
+
+func (s *SQLBuildStore) CreateQueuedBuildRecord(queued QueuedBuild) error {
+	buildFlags, err := json.Marshal(queued.BuildFlags)
+	if err != nil {
+		return err
+	}
+
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	buildId := queued.BuildId
+	if _, err = tx.Exec("INSERT INTO builds (project, tag, started_at, status) VALUES (?, ?, ?, ?)", buildId.Project, buildId.Tag, buildId.DateTime.Format(DateFormat), string(QUEUED)); err != nil {
+		return err
+	}
+	if _, err = tx.Exec("INSERT INTO queued_builds (build_id, src_dir, config_file, build_flags) SELECT id, ?, ?, ? FROM builds WHERE project = ? AND tag = ? AND started_at = ?", queued.SrcDir, queued.ConfigFile, string(buildFlags), buildId.Project, buildId.Tag, buildId.DateTime.Format(DateFormat)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLBuildStore) StartQueuedBuild(buildId BuildId) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE builds SET status = ? WHERE project = ? AND tag = ? AND started_at = ? AND status = ?", string(RUNNING), buildId.Project, buildId.Tag, buildId.DateTime.Format(DateFormat), string(QUEUED))
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated != 1 {
+		return fmt.Errorf("Build of %s with tag %s at %s is not queued", buildId.Project, buildId.Tag, buildId.DateTime.Format(DateFormat))
+	}
+
+	if _, err = tx.Exec("DELETE FROM queued_builds WHERE build_id IN (SELECT id FROM builds WHERE project = ? AND tag = ? AND started_at = ?)", buildId.Project, buildId.Tag, buildId.DateTime.Format(DateFormat)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLBuildStore) SupersedeQueuedBuild(buildId BuildId, supersededBy BuildId) error {
+	tx, err := s.db.Begin()
+	if err != nil {
+		return err
+	}
+	defer tx.Rollback()
+
+	result, err := tx.Exec("UPDATE builds SET status = ?, finished_at = ?, superseded_by_tag = ?, superseded_by_started_at = ? WHERE project = ? AND tag = ? AND started_at = ? AND status = ?", string(SUPERSEDED), time.Now().UTC().Format(DateFormat), supersededBy.Tag, supersededBy.DateTime.Format(DateFormat), buildId.Project, buildId.Tag, buildId.DateTime.Format(DateFormat), string(QUEUED))
+	if err != nil {
+		return err
+	}
+	if updated, err := result.RowsAffected(); err != nil {
+		return err
+	} else if updated != 1 {
+		return fmt.Errorf("Build of %s with tag %s at %s is not queued", buildId.Project, buildId.Tag, buildId.DateTime.Format(DateFormat))
+	}
+
+	if _, err = tx.Exec("DELETE FROM queued_builds WHERE build_id IN (SELECT id FROM builds WHERE project = ? AND tag = ? AND started_at = ?)", buildId.Project, buildId.Tag, buildId.DateTime.Format(DateFormat)); err != nil {
+		return err
+	}
+
+	return tx.Commit()
+}
+
+func (s *SQLBuildStore) FindQueuedBuilds() ([]QueuedBuild, error) {
+	rows, err := s.db.Query("SELECT b.project, b.tag, b.started_at, q.src_dir, q.config_file, q.build_flags FROM queued_builds q JOIN builds b ON b.id = q.build_id WHERE b.status = ? ORDER BY b.started_at, b.id", string(QUEUED))
+	if err != nil {
+		return nil, err
+	}
+	defer rows.Close()
+
+	queuedBuilds := make([]QueuedBuild, 0)
+	for rows.Next() {
+		var project, tag, startedAt, buildFlags string
+		var queued QueuedBuild
+		if err = rows.Scan(&project, &tag, &startedAt, &queued.SrcDir, &queued.ConfigFile, &buildFlags); err != nil {
+			return nil, err
+		}
+
+		dateTime, err := time.Parse(DateFormat, startedAt)
+		if err != nil {
+			return nil, err
+		}
+		buildId := BuildIdAt(s.rootDir, project, tag, dateTime)
+		queued.BuildId = &buildId
+
+		if err = json.Unmarshal([]byte(buildFlags), &queued.BuildFlags); err != nil {
+			return nil, err
+		}
+		queuedBuilds = append(queuedBuilds, queued)
+	}
+
+	return queuedBuilds, rows.Err()
+}
+
+func (s *SQLBuildStore) UpdateBuildStatus(buildId BuildId, status BuildStatus) error {
+	_, err := s.db.Exec("UPDATE builds SET status = ?, finished_at = ? WHERE project = ? AND tag = ? AND started_at = ?", string(status), time.Now().UTC().Format(DateFormat), buildId.Project, buildId.Tag, buildId.DateTime.Format(DateFormat))
+	return err
+}
+
+func (s *SQLBuildStore) RecordConfigHash(buildId BuildId, configHash string) error {
+	_, err := s.db.Exec("UPDATE builds SET config_hash = ? WHERE project = ? AND tag = ? AND started_at = ?", configHash, buildId.Project, buildId.Tag, buildId.DateTime.Format(DateFormat))
+	return err
+}
+
+func (s *SQLBuildStore) RecordBuildUsage(buildId BuildId, usage *ProcessUsage) error {
+	_, err := s.db.Exec("UPDATE builds SET exit_code = ?, signal = ?, user_time_ms = ?, system_time_ms = ?, max_rss_kb = ? WHERE project = ? AND tag = ? AND started_at = ?", usage.ExitCode, int(usage.Signal), durationToMs(usage.UserTime), durationToMs(usage.SystemTime), usage.MaxRSSKB, buildId.Project, buildId.Tag, buildId.DateTime.Format(DateFormat))
+	return err
+}
+
+func (s *SQLBuildStore) RecordBuildStep(buildId BuildId, step RecordedStep) error {
+	var startedAt sql.NullString
+	if !step.StartTime.IsZero() {
+		startedAt = sql.NullString{String: step.StartTime.UTC().Format(StepTimeFormat), Valid: true}
+	}
+
+	var exitCode, signal, userTimeMs, systemTimeMs, maxRSSKB sql.NullInt64
+	if step.Usage != nil {
+		exitCode = sql.NullInt64{Int64: int64(step.Usage.ExitCode), Valid: true}
+		signal = sql.NullInt64{Int64: int64(step.Usage.Signal), Valid: true}
+		userTimeMs = sql.NullInt64{Int64: durationToMs(step.Usage.UserTime), Valid: true}
+		systemTimeMs = sql.NullInt64{Int64: durationToMs(step.Usage.SystemTime), Valid: true}
+		maxRSSKB = sql.NullInt64{Int64: step.Usage.MaxRSSKB, Valid: true}
+	}
+
+	_, err := s.db.Exec("INSERT OR REPLACE INTO build_steps (build_id, position, name, status, started_at, duration_ms, exit_code, signal, user_time_ms, system_time_ms, max_rss_kb) SELECT id, ?, ?, ?, ?, ?, ?, ?, ?, ?, ? FROM builds WHERE project = ? AND tag = ? AND started_at = ?", step.Position, step.Name, string(step.Status), startedAt, durationToMs(step.Duration), exitCode, signal, userTimeMs, systemTimeMs, maxRSSKB, buildId.Project, buildId.Tag, buildId.DateTime.Format(DateFormat))
+	return err
+}
+
+func (s *SQLBuildStore) FindMatchingBuilds(project string, tag string, datetime string) ([]RecordedBuild, error) {
+	where, args := matchingBuildsWhere(project, tag, datetime)
+
+	recordedBuilds, buildIds, err := s.findBuilds(where, args)
+	if err != nil {
+		return nil, err
+	}
+
+	// Only look for steps once we're done with the builds rows, as we only
+	// have the one connection.
+	if err = s.findSteps(where, args, recordedBuilds, buildIds); err != nil {
+		return nil, err
+	}
+
+	return recordedBuilds, nil
+}
+
+func matchingBuildsWhere(project string, tag string, datetime string) (string, []interface{}) {
+	where := "1 = 1"
+
+	args := make([]interface{}, 0, 0)
+
+	if project != "" {
+		where = where + " AND project = ?"
+		args = append(args, project)
+	}
+
+	if tag != "" {
+		where = where + " AND tag = ?"
+		args = append(args, tag)
+	}
+
+	if datetime != "" {
+		where = where + " AND started_at = ?"
+		args = append(args, datetime)
+	}
+
+	return where, args
+}
+
+// Find the builds matching where, and their ids in the db.
+func (s *SQLBuildStore) findBuilds(where string, args []interface{}) ([]RecordedBuild, []int64, error) {
+	rows, err := s.db.Query("SELECT id, project, tag, started_at, finished_at, status, exit_code, signal, user_time_ms, system_time_ms, max_rss_kb, parent_tag, matrix_key, rerun_of_tag, rerun_of_started_at, config_hash, superseded_by_tag, superseded_by_started_at FROM builds WHERE "+where+" ORDER BY started_at DESC;", args...)
+	if err != nil {
+		return nil, nil, err
+	}
+	defer rows.Close()
+
+	recordedBuilds := make([]RecordedBuild, 0, 0)
+	buildIds := make([]int64, 0, 0)
+
+	for rows.Next() {
+		var id int64
+		recordedBuild, err := scanBuild(s.rootDir, rows, &id)
+		if err != nil {
+			return nil, nil, err
+		}
+		recordedBuilds = append(recordedBuilds, recordedBuild)
+		buildIds = append(buildIds, id)
+	}
+
+	return recordedBuilds, buildIds, rows.Err()
+}
+
+// Fill in the steps of recordedBuilds (with the ids buildIds, and found by
+// where).
+func (s *SQLBuildStore) findSteps(where string, args []interface{}, recordedBuilds []RecordedBuild, buildIds []int64) error {
+	builds := make(map[int64]*RecordedBuild)
+	for i, id := range buildIds {
+		builds[id] = &recordedBuilds[i]
+	}
+
+	rows, err := s.db.Query("SELECT build_id, position, name, status, started_at, duration_ms, exit_code, signal, user_time_ms, system_time_ms, max_rss_kb FROM build_steps WHERE build_id IN (SELECT id FROM builds WHERE "+where+") ORDER BY build_id, position;", args...)
+	if err != nil {
+		return err
+	}
+	defer rows.Close()
+
+	for rows.Next() {
+		var buildId int64
+		var step RecordedStep
+		var rowStartedAt sql.NullString
+		var rowDurationMs, rowExitCode, rowSignal, rowUserTimeMs, rowSystemTimeMs, rowMaxRSSKB sql.NullInt64
+		err := rows.Scan(&buildId, &step.Position, &step.Name, &step.Status, &rowStartedAt, &rowDurationMs, &rowExitCode, &rowSignal, &rowUserTimeMs, &rowSystemTimeMs, &rowMaxRSSKB)
+		if err != nil {
+			return err
+		}
+
+		if rowStartedAt.Valid && rowStartedAt.String != "" {
+			if step.StartTime, err = time.Parse(StepTimeFormat, rowStartedAt.String); err != nil {
+				return err
+			}
+		}
+		step.Duration = msToDuration(rowDurationMs.Int64)
+		step.Usage = scanUsage(rowExitCode, rowSignal, rowUserTimeMs, rowSystemTimeMs, rowMaxRSSKB)
+
+		if recordedBuild := builds[buildId]; recordedBuild != nil {
+			recordedBuild.Steps = append(recordedBuild.Steps, step)
+		}
+	}
+
+	return rows.Err()
+}
+
+func (s *SQLBuildStore) Close() error {
+	return s.db.Close()
+}
+
+// Scan a build row, and its id into id.
+func scanBuild(rootDir string, rows *sql.Rows, id *int64) (RecordedBuild, error) {
+	var rowProject, rowTag, rowDatetime, rowStatus string
+	var rowEndTime, rowParentTag, rowMatrixKey, rowRerunOfTag, rowRerunOfStartedAt, rowConfigHash, rowSupersededByTag, rowSupersededByStartedAt sql.NullString
+	var rowExitCode, rowSignal, rowUserTimeMs, rowSystemTimeMs, rowMaxRSSKB sql.NullInt64
+	err := rows.Scan(id, &rowProject, &rowTag, &rowDatetime, &rowEndTime, &rowStatus, &rowExitCode, &rowSignal, &rowUserTimeMs, &rowSystemTimeMs, &rowMaxRSSKB, &rowParentTag, &rowMatrixKey, &rowRerunOfTag, &rowRerunOfStartedAt, &rowConfigHash, &rowSupersededByTag, &rowSupersededByStartedAt)
+	if err != nil {
+		return RecordedBuild{}, err
+	}
+
+	dateTime, err := time.Parse(DateFormat, rowDatetime)
+	if err != nil {
+		return RecordedBuild{}, err
+	}
+
+	var endTime time.Time
+	if rowEndTime.Valid && rowEndTime.String != "" {
+		if endTime, err = time.Parse(DateFormat, rowEndTime.String); err != nil {
+			return RecordedBuild{}, err
+		}
+	}
+
+	usage := scanUsage(rowExitCode, rowSignal, rowUserTimeMs, rowSystemTimeMs, rowMaxRSSKB)
+
+	buildId := BuildIdAt(rootDir, rowProject, rowTag, dateTime)
+	recordedBuild := RecordedBuild{BuildId: &buildId, EndTime: endTime, Status: BuildStatus(rowStatus), Usage: usage, ConfigHash: rowConfigHash.String}
+
+	if rowParentTag.Valid {
+		parentId := BuildIdAt(rootDir, rowProject, rowParentTag.String, dateTime)
+		recordedBuild.Parent = &parentId
+		recordedBuild.MatrixKey = rowMatrixKey.String
+	}
+
+	if rowRerunOfTag.Valid {
+		originalDateTime, err := time.Parse(DateFormat, rowRerunOfStartedAt.String)
+		if err != nil {
+			return RecordedBuild{}, err
+		}
+		originalId := BuildIdAt(rootDir, rowProject, rowRerunOfTag.String, originalDateTime)
+		recordedBuild.RerunOf = &originalId
+	}
+
+	if rowSupersededByTag.Valid {
+		supersededByDateTime, err := time.Parse(DateFormat, rowSupersededByStartedAt.String)
+		if err != nil {
+			return RecordedBuild{}, err
+		}
+		supersededById := BuildIdAt(rootDir, rowProject, rowSupersededByTag.String, supersededByDateTime)
+		recordedBuild.SupersededBy = &supersededById
+	}
+
+	return recordedBuild, nil
+}
+
+// Usage is recorded if and only if there's an exit code.
+func scanUsage(exitCode sql.NullInt64, signal sql.NullInt64, userTimeMs sql.NullInt64, systemTimeMs sql.NullInt64, maxRSSKB sql.NullInt64) *ProcessUsage {
+	if !exitCode.Valid {
+		return nil
+	}
+	return &ProcessUsage{
+		ExitCode:   int(exitCode.Int64),
+		Signal:     syscall.Signal(signal.Int64),
+		UserTime:   msToDuration(userTimeMs.Int64),
+		SystemTime: msToDuration(systemTimeMs.Int64),
+		MaxRSSKB:   maxRSSKB.Int64,
+	}
+}
+
+// Open the builds db under rootDir as is, without migrating it.
+func openBuildDb(rootDir string) (*sql.DB, error) {
+	buildDbPath := FmtBuildDbPath(rootDir)
+	os.MkdirAll(filepath.Dir(buildDbPath), 0700)
+
+	db, err := sql.Open(BuildDbDriver, buildDbDataSource(buildDbPath))
+	if err != nil {
+		return nil, err
+	}
+
+	// sqlite only allows one writer at a time anyway, and with a single
+	// connection our own connections can't lock each other out.
+	db.SetMaxOpenConns(1)
+
+	return db, nil
+}
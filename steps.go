@@ -0,0 +1,392 @@
+package main
+
+import (
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+// Called with the record of each step as it starts, finishes, or is skipped.
+type StepFunc func(step RecordedStep)
+
+// Run steps in dependency order (see Step.DependsOn), each in its WorkingDir
+// under buildDir and with env and redact as for RunBuildScript, with up to
+// maxParallelSteps (0 for one per CPU) running at once.  Of the steps ready to
+// run, those first in steps go first.
+//
+// Each step's output goes to its own logs under the build's logs dir (see
+// FmtStepLogsDir), and to the build's stdout, stderr and combined logs.  Steps
+// are run, and can be killed, like RunBuildScript's build script.
+//
+// A step that fails or times out, unless it has ContinueOnError, fails the
+// build, and the steps that depend on it (directly or not) are SKIPPED.
+// Steps that don't depend on it carry on.  The first such step's error is
+// returned, as for RunBuildScript.
+//
+// If the whole build runs longer than timeoutInSecs (unless 0), or anything
+// arrives on cancel, the running steps are killed, the rest are SKIPPED, and
+// the error is a *BuildTimedOutError or *BuildCancelledError.
+//
+// The returned BuildOutput has the usage of the last step to finish.
+func RunBuildSteps(buildDir string, steps []Step, env []string, redact []string, maxParallelSteps int, timeoutInSecs int, killGracePeriodInSecs int, cancel <-chan os.Signal, buildId BuildId, onStep StepFunc) (*BuildOutput, error) {
+	dependencies, err := stepDependencies(steps)
+	if err != nil {
+		return nil, err
+	}
+
+	if maxParallelSteps == 0 {
+		maxParallelSteps = runtime.NumCPU()
+	}
+
+	buildLogs, err := createSharedOutputLogs(buildId.FmtStdoutLogPath(), buildId.FmtStderrLogPath(), buildId.FmtCombinedLogPath())
+	if err != nil {
+		return nil, err
+	}
+	defer buildLogs.close()
+
+	scheduler := &stepScheduler{
+		buildDir:              buildDir,
+		env:                   env,
+		redact:                redact,
+		steps:                 steps,
+		dependencies:          dependencies,
+		killGracePeriodInSecs: killGracePeriodInSecs,
+		buildId:               buildId,
+		buildLogs:             buildLogs,
+		onStep:                onStep,
+		records:               make([]*RecordedStep, len(steps)),
+		cancels:               make(map[int]chan os.Signal),
+		results:               make(chan stepResult),
+	}
+
+	var deadline <-chan time.Time
+	if timeoutInSecs > 0 {
+		deadline = time.After(time.Second * time.Duration(timeoutInSecs))
+	}
+
+	buildOutput := &BuildOutput{StdoutPath: buildId.FmtStdoutLogPath(), StderrPath: buildId.FmtStderrLogPath()}
+
+	for {
+		scheduler.startReadySteps(maxParallelSteps)
+		if len(scheduler.cancels) == 0 {
+			break
+		}
+
+		select {
+		case result := <-scheduler.results:
+			if result.usage != nil {
+				buildOutput.Usage = result.usage
+			}
+			scheduler.finishStep(result)
+		case sig := <-cancel:
+			log.Printf("Received %s, stopping build.", sig)
+			scheduler.stop(&BuildCancelledError{Signal: sig}, sig)
+			cancel = nil
+		case <-deadline:
+			log.Printf("Build ran past its %d second timeout, stopping it.", timeoutInSecs)
+			scheduler.stop(&BuildTimedOutError{TimeoutInSecs: timeoutInSecs}, syscall.SIGTERM)
+			deadline = nil
+		}
+	}
+
+	return buildOutput, scheduler.buildErr
+}
+
+// For each step, the indexes of the steps it depends on.
+//
+// Returns an error for unknown step names or dependency cycles.
+func stepDependencies(steps []Step) ([][]int, error) {
+	indexes := make(map[string]int)
+	explicit := false
+	for i, step := range steps {
+		indexes[step.Name] = i
+		if len(step.DependsOn) > 0 {
+			explicit = true
+		}
+	}
+
+	dependencies := make([][]int, len(steps))
+	for i, step := range steps {
+		if !explicit {
+			if i > 0 {
+				dependencies[i] = []int{i - 1}
+			}
+			continue
+		}
+
+		for _, name := range step.DependsOn {
+			dependency, ok := indexes[name]
+			if !ok {
+				return nil, fmt.Errorf("Step %s depends on unknown step %s.", step.Name, name)
+			}
+			dependencies[i] = append(dependencies[i], dependency)
+		}
+	}
+
+	if cycle := findStepCycle(dependencies); cycle != nil {
+		names := make([]string, 0, len(cycle))
+		for _, i := range cycle {
+			names = append(names, steps[i].Name)
+		}
+		return nil, fmt.Errorf("Steps depend on each other in a cycle: %v", names)
+	}
+
+	return dependencies, nil
+}
+
+// Return the indexes of the steps in a dependency cycle, or nil if there isn't
+// one.
+func findStepCycle(dependencies [][]int) []int {
+	const (
+		unvisited = iota
+		visiting
+		visited
+	)
+	state := make([]int, len(dependencies))
+	path := make([]int, 0, len(dependencies))
+
+	var visit func(i int) []int
+	visit = func(i int) []int {
+		state[i] = visiting
+		path = append(path, i)
+
+		for _, dependency := range dependencies[i] {
+			switch state[dependency] {
+			case visiting:
+				for start, j := range path {
+					if j == dependency {
+						return append([]int{}, path[start:]...)
+					}
+				}
+			case unvisited:
+				if cycle := visit(dependency); cycle != nil {
+					return cycle
+				}
+			}
+		}
+
+		path = path[:len(path)-1]
+		state[i] = visited
+		return nil
+	}
+
+	for i := range dependencies {
+		if state[i] == unvisited {
+			if cycle := visit(i); cycle != nil {
+				return cycle
+			}
+		}
+	}
+	return nil
+}
+
+// Keeps track of the steps of a build as RunBuildSteps runs them.  Only used
+// from RunBuildSteps's goroutine; the steps themselves report back on results.
+type stepScheduler struct {
+	buildDir              string
+	env                   []string
+	redact                []string
+	steps                 []Step
+	dependencies          [][]int
+	killGracePeriodInSecs int
+	buildId               BuildId
+	buildLogs             *sharedOutputLogs
+	onStep                StepFunc
+
+	// The latest record of each step, nil until it starts or is skipped.
+	records []*RecordedStep
+	// The cancel channel of each running step.
+	cancels map[int]chan os.Signal
+	results chan stepResult
+	// Set by stop, after which no more steps are started.
+	stopErr  error
+	buildErr error
+}
+
+type stepResult struct {
+	position int
+	usage    *ProcessUsage
+	duration time.Duration
+	err      error
+}
+
+// Start as many of the steps whose dependencies have finished as we're
+// allowed, and skip those whose dependencies failed.
+func (s *stepScheduler) startReadySteps(maxParallelSteps int) {
+	// Skipping a step can make the steps after it ready to skip, so go round
+	// until nothing changes.
+	for changed := true; changed; {
+		changed = false
+
+		for i, step := range s.steps {
+			if s.records[i] != nil {
+				continue
+			}
+
+			ready, ok := s.dependenciesDone(i)
+			if !ready {
+				continue
+			}
+
+			if !ok || s.stopErr != nil {
+				s.record(RecordedStep{Position: i, Name: step.Name, Status: SKIPPED})
+				changed = true
+			} else if len(s.cancels) < maxParallelSteps {
+				s.startStep(i)
+				changed = true
+			}
+		}
+	}
+}
+
+// Whether all of step i's dependencies have finished, and if so whether they
+// finished in a way that lets i run.
+func (s *stepScheduler) dependenciesDone(i int) (bool, bool) {
+	ready, ok := true, true
+
+	for _, dependency := range s.dependencies[i] {
+		record := s.records[dependency]
+		switch {
+		case record == nil || record.Status == RUNNING:
+			ready = false
+		case record.Status == SUCCEEDED:
+		case (record.Status == FAILED || record.Status == TIMED_OUT) && s.steps[dependency].ContinueOnError:
+		default:
+			ok = false
+		}
+	}
+
+	return ready, ok
+}
+
+func (s *stepScheduler) startStep(i int) {
+	step := s.steps[i]
+
+	// UTC() would lose the monotonic clock reading we time the step with.
+	start := time.Now()
+	s.record(RecordedStep{Position: i, Name: step.Name, Status: RUNNING, StartTime: start.UTC()})
+
+	cancel := make(chan os.Signal, 1)
+	s.cancels[i] = cancel
+
+	log.Printf("Running step %s: %s %s in %s", step.Name, step.Command, step.Args, step.WorkingDir)
+
+	go func() {
+		usage, err := runStepCommand(s.buildDir, step, s.env, s.redact, s.killGracePeriodInSecs, cancel, s.buildId, s.buildLogs)
+		s.results <- stepResult{position: i, usage: usage, duration: time.Since(start), err: err}
+	}()
+}
+
+func (s *stepScheduler) finishStep(result stepResult) {
+	delete(s.cancels, result.position)
+	step := s.steps[result.position]
+
+	err := result.err
+	// Steps killed because the whole build timed out timed out too.
+	if _, cancelled := err.(*BuildCancelledError); cancelled {
+		if timeoutErr, timedOut := s.stopErr.(*BuildTimedOutError); timedOut {
+			err = timeoutErr
+		}
+	}
+
+	record := *s.records[result.position]
+	record.Status = statusForBuildError(err)
+	record.Duration = result.duration
+	record.Usage = result.usage
+	s.record(record)
+
+	if err == nil {
+		return
+	}
+
+	log.Printf("Step %s completed with error: %s", step.Name, err)
+
+	if step.ContinueOnError && s.stopErr == nil {
+		log.Printf("Carrying on as step %s has ContinueOnError.", step.Name)
+	} else if s.buildErr == nil {
+		s.buildErr = err
+	}
+}
+
+// Kill the running steps and start no more, failing the build with err.
+func (s *stepScheduler) stop(err error, sig os.Signal) {
+	s.stopErr = err
+	s.buildErr = err
+
+	for _, cancel := range s.cancels {
+		// One signal is all it takes, and there may already be one.
+		select {
+		case cancel <- sig:
+		default:
+		}
+	}
+}
+
+func (s *stepScheduler) record(step RecordedStep) {
+	s.records[step.Position] = &step
+	s.onStep(step)
+}
+
+// Run step's command, writing its output to its own logs as well as buildLogs.
+func runStepCommand(buildDir string, step Step, env []string, redact []string, killGracePeriodInSecs int, cancel <-chan os.Signal, buildId BuildId, buildLogs *sharedOutputLogs) (*ProcessUsage, error) {
+	if err := os.MkdirAll(buildId.FmtStepLogsDir(step.Name), 0700); err != nil {
+		return nil, err
+	}
+
+	stepLogs, err := createOutputLogs(buildId.FmtStepStdoutLogPath(step.Name), buildId.FmtStepStderrLogPath(step.Name), buildId.FmtStepCombinedLogPath(step.Name))
+	if err != nil {
+		return nil, err
+	}
+	defer stepLogs.close()
+
+	return runCommand(filepath.Join(buildDir, step.WorkingDir), step.Command, step.Args, env, redact, step.TimeoutInSecs, killGracePeriodInSecs, cancel, stepLogs, buildLogs.forStep(step.Name))
+}
+
+// The build's stdout, stderr and combined logs, which steps running at the
+// same time write to a line at a time.
+type sharedOutputLogs struct {
+	stdout   *CombinedLog
+	stderr   *CombinedLog
+	combined *CombinedLog
+	files    []*os.File
+}
+
+func createSharedOutputLogs(stdoutPath string, stderrPath string, combinedPath string) (*sharedOutputLogs, error) {
+	files, err := createFiles(stdoutPath, stderrPath, combinedPath)
+	if err != nil {
+		return nil, err
+	}
+
+	return &sharedOutputLogs{
+		stdout:   NewInterleavedLog(files[0]),
+		stderr:   NewInterleavedLog(files[1]),
+		combined: NewCombinedLog(files[2], time.Now()),
+		files:    files,
+	}, nil
+}
+
+// Where the output of one step goes.  In the combined log, its lines are
+// marked with the step's name, e.g. "lint/stdout".
+func (l *sharedOutputLogs) forStep(stepName string) *outputLogs {
+	stdout := l.stdout.Stream(StdoutStream)
+	stderr := l.stderr.Stream(StderrStream)
+	combinedStdout := l.combined.Stream(stepName + "/" + StdoutStream)
+	combinedStderr := l.combined.Stream(stepName + "/" + StderrStream)
+
+	return &outputLogs{
+		stdoutWriter: io.MultiWriter(stdout, combinedStdout),
+		stderrWriter: io.MultiWriter(stderr, combinedStderr),
+		streams:      []*CombinedLogStream{stdout, stderr, combinedStdout, combinedStderr},
+	}
+}
+
+func (l *sharedOutputLogs) close() {
+	for _, file := range l.files {
+		file.Close()
+	}
+}
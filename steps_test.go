@@ -0,0 +1,267 @@
+package main
+
+import (
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+// Run steps, with build.sh (which echoes its args and exits with the first)
+// in the source dir, in a build under tmpDir.
+func runTestSteps(t *testing.T, tmpDir string, steps []Step) ([]RecordedStep, *BuildOutput, BuildId, error) {
+	return runTestStepsWith(t, tmpDir, steps, 2, 10)
+}
+
+func runTestStepsWith(t *testing.T, tmpDir string, steps []Step, maxParallelSteps int, timeoutInSecs int) ([]RecordedStep, *BuildOutput, BuildId, error) {
+	srcDir, buildId := makeScriptBuild(t, tmpDir, "#!/bin/sh\necho \"$@\"\nexit $1\n")
+	os.MkdirAll(filepath.Join(srcDir, "sub"), 0700)
+
+	// Keep only the last record of each step.
+	recorded := make([]RecordedStep, len(steps))
+	buildOutput, err := RunBuildSteps(srcDir, steps, nil, nil, maxParallelSteps, timeoutInSecs, 1, nil, buildId, func(step RecordedStep) {
+		recorded[step.Position] = step
+	})
+
+	return recorded, buildOutput, buildId, err
+}
+
+func makeStepsTmpDir(t *testing.T) string {
+	tmpDir, err := ioutil.TempDir("", "kerouac_steps_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	return tmpDir
+}
+
+func TestRunBuildSteps(t *testing.T) {
+	steps := []Step{
+		{Name: "one", Command: "./build.sh", Args: []string{"0", "first"}, TimeoutInSecs: 10},
+		{Name: "two", Command: "../build.sh", Args: []string{"0", "second"}, TimeoutInSecs: 10, WorkingDir: "sub"},
+	}
+
+	tmpDir := makeStepsTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	recorded, buildOutput, buildId, err := runTestSteps(t, tmpDir, steps)
+
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, step := range recorded {
+		if step.Status != SUCCEEDED || step.StartTime.IsZero() || step.Duration == 0 || step.Usage == nil {
+			t.Errorf("Step recorded as %+v", step)
+		}
+	}
+	if buildOutput.Usage == nil || buildOutput.Usage.ExitCode != 0 {
+		t.Errorf("Build output was %+v", buildOutput)
+	}
+
+	stepStdout, err := ioutil.ReadFile(buildId.FmtStepStdoutLogPath("two"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(stepStdout) != "0 second\n" {
+		t.Errorf("Step stdout was %q", stepStdout)
+	}
+
+	buildStdout, err := ioutil.ReadFile(buildId.FmtStdoutLogPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if string(buildStdout) != "0 first\n0 second\n" {
+		t.Errorf("Build stdout was %q", buildStdout)
+	}
+}
+
+func TestRunBuildStepsStopsOnFailure(t *testing.T) {
+	steps := []Step{
+		{Name: "lint", Command: "./build.sh", Args: []string{"1"}, TimeoutInSecs: 10, ContinueOnError: true},
+		{Name: "test", Command: "./build.sh", Args: []string{"2"}, TimeoutInSecs: 10},
+		{Name: "package", Command: "./build.sh", Args: []string{"0"}, TimeoutInSecs: 10},
+	}
+
+	tmpDir := makeStepsTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	recorded, buildOutput, _, err := runTestSteps(t, tmpDir, steps)
+
+	if err == nil {
+		t.Errorf("Failed step did not fail the build")
+	}
+
+	expected := []BuildStatus{FAILED, FAILED, SKIPPED}
+	for i, step := range recorded {
+		if step.Name != steps[i].Name || step.Status != expected[i] {
+			t.Errorf("Step %d recorded as %+v not %s", i, step, expected[i])
+		}
+	}
+	if !recorded[2].StartTime.IsZero() {
+		t.Errorf("Skipped step has a start time: %+v", recorded[2])
+	}
+
+	if buildOutput.Usage == nil || buildOutput.Usage.ExitCode != 2 {
+		t.Errorf("Build output did not have the failed step's usage: %+v", buildOutput.Usage)
+	}
+}
+
+func TestRunBuildStepsTimesOutStep(t *testing.T) {
+	steps := []Step{
+		{Name: "slow", Command: "sleep", Args: []string{"10"}, TimeoutInSecs: 1},
+	}
+
+	tmpDir := makeStepsTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	recorded, _, _, err := runTestSteps(t, tmpDir, steps)
+
+	if _, ok := err.(*BuildTimedOutError); !ok {
+		t.Errorf("RunBuildSteps returned %v not a timeout", err)
+	}
+	if recorded[0].Status != TIMED_OUT {
+		t.Errorf("Step recorded as %+v", recorded[0])
+	}
+}
+
+func TestRunBuildStepsInParallel(t *testing.T) {
+	steps := []Step{
+		{Name: "lint", Command: "sleep", Args: []string{"1"}, TimeoutInSecs: 10},
+		{Name: "test", Command: "sleep", Args: []string{"1"}, TimeoutInSecs: 10},
+		{Name: "package", Command: "./build.sh", Args: []string{"0"}, TimeoutInSecs: 10, DependsOn: []string{"lint", "test"}},
+	}
+
+	tmpDir := makeStepsTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	recorded, _, _, err := runTestSteps(t, tmpDir, steps)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	lint, test, pkg := recorded[0], recorded[1], recorded[2]
+	if lint.StartTime.After(test.EndTime()) || test.StartTime.After(lint.EndTime()) {
+		t.Errorf("lint and test did not run at the same time: %+v, %+v", lint, test)
+	}
+	// Leave a little room for the wall clock to disagree with the monotonic
+	// one the durations come from.
+	slack := 50 * time.Millisecond
+	if pkg.StartTime.Before(lint.EndTime().Add(-slack)) || pkg.StartTime.Before(test.EndTime().Add(-slack)) {
+		t.Errorf("package started before its dependencies finished: %+v", recorded)
+	}
+}
+
+func TestRunBuildStepsMaxParallelSteps(t *testing.T) {
+	steps := []Step{
+		{Name: "lint", Command: "sleep", Args: []string{"0.5"}, TimeoutInSecs: 10},
+		{Name: "test", Command: "sleep", Args: []string{"0.5"}, TimeoutInSecs: 10},
+		{Name: "package", Command: "./build.sh", Args: []string{"0"}, TimeoutInSecs: 10, DependsOn: []string{"lint"}},
+	}
+
+	tmpDir := makeStepsTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	recorded, _, _, err := runTestStepsWith(t, tmpDir, steps, 1, 10)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	// With one at a time, steps run in order, and so one after the other.
+	lint, test := recorded[0], recorded[1]
+	if !test.StartTime.After(lint.StartTime.Add(400 * time.Millisecond)) {
+		t.Errorf("test started while lint was running: %+v, %+v", lint, test)
+	}
+}
+
+func TestRunBuildStepsSkipsDependentsOfFailures(t *testing.T) {
+	steps := []Step{
+		{Name: "setup", Command: "./build.sh", Args: []string{"1"}, TimeoutInSecs: 10},
+		{Name: "docs", Command: "./build.sh", Args: []string{"0"}, TimeoutInSecs: 10},
+		{Name: "test", Command: "./build.sh", Args: []string{"0"}, TimeoutInSecs: 10, DependsOn: []string{"setup"}},
+		{Name: "package", Command: "./build.sh", Args: []string{"0"}, TimeoutInSecs: 10, DependsOn: []string{"docs", "test"}},
+	}
+
+	tmpDir := makeStepsTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	recorded, _, _, err := runTestSteps(t, tmpDir, steps)
+	if err == nil {
+		t.Errorf("Failed step did not fail the build")
+	}
+
+	expected := []BuildStatus{FAILED, SUCCEEDED, SKIPPED, SKIPPED}
+	for i, step := range recorded {
+		if step.Status != expected[i] {
+			t.Errorf("Step %s recorded as %s not %s", step.Name, step.Status, expected[i])
+		}
+	}
+}
+
+func TestRunBuildStepsTimesOutBuild(t *testing.T) {
+	steps := []Step{
+		{Name: "slow", Command: "sleep", Args: []string{"10"}, TimeoutInSecs: 10},
+		{Name: "after", Command: "./build.sh", Args: []string{"0"}, TimeoutInSecs: 10},
+	}
+
+	tmpDir := makeStepsTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	start := time.Now()
+	recorded, _, _, err := runTestStepsWith(t, tmpDir, steps, 2, 1)
+	if _, ok := err.(*BuildTimedOutError); !ok {
+		t.Errorf("RunBuildSteps returned %v not a timeout", err)
+	}
+	if elapsed := time.Since(start); elapsed > 5*time.Second {
+		t.Errorf("RunBuildSteps took %s to time out", elapsed)
+	}
+	if recorded[0].Status != TIMED_OUT || recorded[1].Status != SKIPPED {
+		t.Errorf("Steps recorded as %+v", recorded)
+	}
+}
+
+func TestRunBuildStepsWithoutTimeout(t *testing.T) {
+	config, err := parseConfigJSON([]byte(`{"Steps": [{"Name": "nap", "Command": "sleep", "Args": ["0.2"]}], "TimeoutInSecs": 0}`))
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tmpDir := makeStepsTmpDir(t)
+	defer os.RemoveAll(tmpDir)
+
+	recorded, _, _, err := runTestStepsWith(t, tmpDir, config.Steps, 2, config.TimeoutInSecs)
+	if err != nil {
+		t.Errorf("RunBuildSteps returned %v", err)
+	}
+	if recorded[0].Status != SUCCEEDED {
+		t.Errorf("Step recorded as %+v", recorded[0])
+	}
+}
+
+func TestStepDependencies(t *testing.T) {
+	dependencies, err := stepDependencies([]Step{{Name: "a"}, {Name: "b"}, {Name: "c"}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := [][]int{nil, {0}, {1}}; !reflect.DeepEqual(dependencies, expected) {
+		t.Errorf("Steps without DependsOn depend on %v not %v", dependencies, expected)
+	}
+
+	dependencies, err = stepDependencies([]Step{{Name: "a"}, {Name: "b"}, {Name: "c", DependsOn: []string{"a", "b"}}})
+	if err != nil {
+		t.Fatal(err)
+	}
+	if expected := [][]int{nil, nil, {0, 1}}; !reflect.DeepEqual(dependencies, expected) {
+		t.Errorf("Steps with DependsOn depend on %v not %v", dependencies, expected)
+	}
+
+	for _, steps := range [][]Step{
+		{{Name: "a", DependsOn: []string{"nope"}}},
+		{{Name: "a", DependsOn: []string{"a"}}},
+		{{Name: "a", DependsOn: []string{"c"}}, {Name: "b", DependsOn: []string{"a"}}, {Name: "c", DependsOn: []string{"b"}}},
+	} {
+		if _, err := stepDependencies(steps); err == nil {
+			t.Errorf("No error for dependencies of %+v", steps)
+		}
+	}
+}
@@ -1,21 +1,213 @@
 package main
 
 import (
-	"os/exec"
+	"archive/tar"
+	"bufio"
+	"compress/gzip"
+	"fmt"
+	"io"
+	"log"
+	"os"
+	"path"
+	"path/filepath"
+	"strings"
+	"time"
 )
 
+// A file in the top of the source dir listing more TarballExcludes, one per
+// line.  Blank lines and lines starting with # are ignored.
+const KerouacIgnoreName = ".kerouacignore"
+
+// Every entry in a tarball has this modification time, so tarballs of the same
+// files are identical whenever they're made.
+var TarballModTime = time.Unix(0, 0)
+
 // Create a tarball of srcDir, writing it to the location indicated by
 // layout.FmtTarballPath.
 //
-// Currently this uses the external tar exe, which must be in the path, and
-// changes directory to the srcDir before tarring the current directory (".").
+// Files and dirs matching excludes, or the patterns in srcDir's
+// .kerouacignore, are left out (see TarballExcluder).  Entries are written in
+// lexical order, with TarballModTime and no owners, so the tarball depends
+// only on the contents of srcDir.  Symlinks are kept as symlinks; anything
+// else that isn't a regular file or dir is left out.
 //
-// Returns nil on success, or an error if something goes wrong.
-//
-// At some point it might make sense to write this using go's tar and gzip
-// utilities, so it could run on systems without tar / be more self contained.
-func CreateTarball(srcDir string, buildId BuildId) error {
+// Returns nil on success, or an error if something goes wrong, in which case
+// no tarball is left behind.
+func CreateTarball(srcDir string, excludes []string, buildId BuildId) error {
+	ignored, err := readKerouacIgnore(srcDir)
+	if err != nil {
+		return err
+	}
+	excluder := NewTarballExcluder(append(append([]string{}, excludes...), ignored...))
+
 	tarballPath := buildId.FmtTarballPath()
-	cmd := exec.Command("tar", "-c", "-z", "-C", srcDir, "-f", tarballPath, ".")
-	return cmd.Run()
+	file, err := os.Create(tarballPath)
+	if err != nil {
+		return err
+	}
+
+	err = writeTarball(file, srcDir, excluder)
+	if cerr := file.Close(); err == nil {
+		err = cerr
+	}
+	if err != nil {
+		os.Remove(tarballPath)
+	}
+	return err
+}
+
+func writeTarball(w io.Writer, srcDir string, excluder *TarballExcluder) error {
+	gzipWriter := gzip.NewWriter(w)
+	tarWriter := tar.NewWriter(gzipWriter)
+
+	err := filepath.Walk(srcDir, func(filePath string, info os.FileInfo, err error) error {
+		if err != nil {
+			return err
+		}
+
+		rel, err := filepath.Rel(srcDir, filePath)
+		if err != nil || rel == "." {
+			return err
+		}
+		rel = filepath.ToSlash(rel)
+
+		if excluder.Excludes(rel, info.IsDir()) {
+			if info.IsDir() {
+				return filepath.SkipDir
+			}
+			return nil
+		}
+
+		return writeTarballEntry(tarWriter, filePath, rel, info)
+	})
+	if err != nil {
+		return err
+	}
+
+	if err = tarWriter.Close(); err != nil {
+		return err
+	}
+	return gzipWriter.Close()
+}
+
+func writeTarballEntry(tarWriter *tar.Writer, filePath string, name string, info os.FileInfo) error {
+	header := &tar.Header{Name: name, Mode: int64(info.Mode().Perm()), ModTime: TarballModTime}
+
+	switch {
+	case info.IsDir():
+		header.Typeflag = tar.TypeDir
+		header.Name += "/"
+	case info.Mode()&os.ModeSymlink != 0:
+		target, err := os.Readlink(filePath)
+		if err != nil {
+			return err
+		}
+		header.Typeflag = tar.TypeSymlink
+		header.Linkname = target
+	case info.Mode().IsRegular():
+		header.Typeflag = tar.TypeReg
+		header.Size = info.Size()
+	default:
+		log.Printf("Not tarballing %s, it is not a regular file, dir or symlink", filePath)
+		return nil
+	}
+
+	if err := tarWriter.WriteHeader(header); err != nil {
+		return err
+	}
+	if header.Typeflag != tar.TypeReg {
+		return nil
+	}
+
+	file, err := os.Open(filePath)
+	if err != nil {
+		return err
+	}
+	defer file.Close()
+
+	if _, err = io.CopyN(tarWriter, file, header.Size); err != nil {
+		return fmt.Errorf("Could not tarball %s: %s", filePath, err)
+	}
+	return nil
+}
+
+// The patterns in srcDir's .kerouacignore, if it has one.
+func readKerouacIgnore(srcDir string) ([]string, error) {
+	file, err := os.Open(filepath.Join(srcDir, KerouacIgnoreName))
+	if os.IsNotExist(err) {
+		return nil, nil
+	} else if err != nil {
+		return nil, err
+	}
+	defer file.Close()
+
+	var patterns []string
+	scanner := bufio.NewScanner(file)
+	for scanner.Scan() {
+		line := strings.TrimSpace(scanner.Text())
+		if line != "" && !strings.HasPrefix(line, "#") {
+			patterns = append(patterns, line)
+		}
+	}
+	return patterns, scanner.Err()
+}
+
+// Decides which files to leave out of a tarball, given patterns like those of
+// .gitignore (though without negation or **):
+//
+//   - a pattern without a / matches the name of a file or dir at any depth,
+//     e.g. "node_modules" or "*.o"
+//   - a pattern with a / matches the path from the top of the source dir, e.g.
+//     "build/tmp"; a leading / just anchors it there
+//   - a trailing / matches only dirs, e.g. "vendor/"
+//
+// Patterns are as for path.Match.  Everything under an excluded dir is
+// excluded too.
+type TarballExcluder struct {
+	patterns []tarballExclude
+}
+
+type tarballExclude struct {
+	pattern  string
+	anchored bool
+	dirOnly  bool
+}
+
+func NewTarballExcluder(patterns []string) *TarballExcluder {
+	excluder := &TarballExcluder{}
+	for _, pattern := range patterns {
+		exclude := tarballExclude{}
+		if strings.HasSuffix(pattern, "/") {
+			exclude.dirOnly = true
+			pattern = strings.TrimRight(pattern, "/")
+		}
+		if strings.Contains(pattern, "/") {
+			exclude.anchored = true
+			pattern = strings.TrimPrefix(pattern, "/")
+		}
+		if pattern != "" {
+			exclude.pattern = pattern
+			excluder.patterns = append(excluder.patterns, exclude)
+		}
+	}
+	return excluder
+}
+
+// Whether to leave out the file or dir at rel, a /-separated path relative to
+// the source dir.
+func (e *TarballExcluder) Excludes(rel string, isDir bool) bool {
+	for _, exclude := range e.patterns {
+		if exclude.dirOnly && !isDir {
+			continue
+		}
+
+		name := rel
+		if !exclude.anchored {
+			name = path.Base(rel)
+		}
+		if matched, _ := path.Match(exclude.pattern, name); matched {
+			return true
+		}
+	}
+	return false
 }
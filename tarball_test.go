@@ -0,0 +1,163 @@
+package main
+
+import (
+	"archive/tar"
+	"bytes"
+	"compress/gzip"
+	"io"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestTarballExcluder(t *testing.T) {
+	excluder := NewTarballExcluder([]string{".git", "*.o", "vendor/", "/build/tmp", "docs/*.pdf"})
+
+	for _, test := range []struct {
+		rel      string
+		isDir    bool
+		expected bool
+	}{
+		{".git", true, true},
+		{"sub/.git", true, true},
+		{"main.o", false, true},
+		{"lib/util.o", false, true},
+		{"main.c", false, false},
+		{"vendor", true, true},
+		{"vendor", false, false},
+		{"src/vendor", true, true},
+		{"build/tmp", true, true},
+		{"src/build/tmp", true, false},
+		{"docs/manual.pdf", false, true},
+		{"docs/sub/manual.pdf", false, false},
+	} {
+		if excluded := excluder.Excludes(test.rel, test.isDir); excluded != test.expected {
+			t.Errorf("Excludes(%s, %t) was %t not %t", test.rel, test.isDir, excluded, test.expected)
+		}
+	}
+}
+
+// Read the names and contents (or link targets) of the entries in a tarball,
+// in order, checking they all have TarballModTime.
+func readTestTarball(t *testing.T, tarballPath string) ([]string, map[string]string) {
+	file, err := os.Open(tarballPath)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer file.Close()
+
+	gzipReader, err := gzip.NewReader(file)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tarReader := tar.NewReader(gzipReader)
+
+	var names []string
+	contents := make(map[string]string)
+	for {
+		header, err := tarReader.Next()
+		if err == io.EOF {
+			break
+		} else if err != nil {
+			t.Fatal(err)
+		}
+
+		if !header.ModTime.Equal(TarballModTime) {
+			t.Errorf("%s has mod time %s", header.Name, header.ModTime)
+		}
+
+		names = append(names, header.Name)
+		if header.Typeflag == tar.TypeSymlink {
+			contents[header.Name] = "-> " + header.Linkname
+		} else {
+			data, _ := ioutil.ReadAll(tarReader)
+			contents[header.Name] = string(data)
+		}
+	}
+	return names, contents
+}
+
+func TestCreateTarball(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "kerouac_tarball_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	srcDir := filepath.Join(tmpDir, "src")
+	for path, contents := range map[string]string{
+		"main.go":                 "package main",
+		"b/z.txt":                 "z",
+		"b/a.txt":                 "a",
+		".git/HEAD":               "ref",
+		"node_modules/big.js":     "big",
+		"web/node_modules/big.js": "big",
+		"main.o":                  "object",
+		KerouacIgnoreName:         "# Built files\n*.o\n\nnode_modules/\n",
+	} {
+		path = filepath.Join(srcDir, path)
+		os.MkdirAll(filepath.Dir(path), 0700)
+		if err = ioutil.WriteFile(path, []byte(contents), 0600); err != nil {
+			t.Fatal(err)
+		}
+	}
+	if err = os.Symlink("main.go", filepath.Join(srcDir, "link.go")); err != nil {
+		t.Fatal(err)
+	}
+
+	buildId := BuildIdAt(filepath.Join(tmpDir, "root"), KnownProject, KnownTag, KnownDateTime)
+	os.MkdirAll(buildId.FmtBuildDir(), 0700)
+
+	if err = CreateTarball(srcDir, []string{".git"}, buildId); err != nil {
+		t.Fatal(err)
+	}
+
+	names, contents := readTestTarball(t, buildId.FmtTarballPath())
+	expected := []string{KerouacIgnoreName, "b/", "b/a.txt", "b/z.txt", "link.go", "main.go", "web/"}
+	if !reflect.DeepEqual(names, expected) {
+		t.Errorf("Tarball has %v not %v", names, expected)
+	}
+	if contents["b/a.txt"] != "a" || contents["link.go"] != "-> main.go" {
+		t.Errorf("Tarball contents were %v", contents)
+	}
+
+	// The same files with different mod times give the same tarball.
+	first, err := ioutil.ReadFile(buildId.FmtTarballPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	later := time.Now().Add(time.Hour)
+	os.Chtimes(filepath.Join(srcDir, "main.go"), later, later)
+
+	if err = CreateTarball(srcDir, []string{".git"}, buildId); err != nil {
+		t.Fatal(err)
+	}
+	second, err := ioutil.ReadFile(buildId.FmtTarballPath())
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !bytes.Equal(first, second) {
+		t.Errorf("Tarballs of the same files differ")
+	}
+}
+
+func TestCreateTarballLeavesNothingOnError(t *testing.T) {
+	tmpDir, err := ioutil.TempDir("", "kerouac_tarball_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.RemoveAll(tmpDir)
+
+	buildId := BuildIdAt(filepath.Join(tmpDir, "root"), KnownProject, KnownTag, KnownDateTime)
+	os.MkdirAll(buildId.FmtBuildDir(), 0700)
+
+	if err = CreateTarball(filepath.Join(tmpDir, "no_such_src"), nil, buildId); err == nil {
+		t.Errorf("No error tarballing a missing dir")
+	}
+	if _, err = os.Stat(buildId.FmtTarballPath()); !os.IsNotExist(err) {
+		t.Errorf("Tarball left behind after error: %v", err)
+	}
+}
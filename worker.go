@@ -0,0 +1,262 @@
+package main
+
+import (
+	"log"
+	"os"
+	"sync"
+	"time"
+)
+
+// Worker runs the QUEUED builds of a kerouac root, oldest first, at most
+// maxBuilds at once and at most each project's MaxConcurrentBuilds of a
+// project at once.
+type Worker struct {
+	store     BuildStore
+	rootDir   string
+	maxBuilds int
+	// Runs a build that's been marked RUNNING, returning once it's finished.
+	// An error means it couldn't be run at all.  If it's still RUNNING once
+	// run returns, it's marked ERRORED.
+	run func(QueuedBuild) error
+	// The parsed configs of queued builds by FmtBuildDir, nil for those that
+	// couldn't be, so each is only parsed once while it waits.  Only used by
+	// StartQueuedBuilds, so not guarded by mutex.
+	configs map[string]*Config
+
+	mutex            sync.Mutex
+	running          int
+	runningByProject map[string]int
+	// Sent to, without blocking, when a build finishes.
+	finished chan struct{}
+	wg       sync.WaitGroup
+}
+
+func NewWorker(store BuildStore, rootDir string, maxBuilds int, run func(QueuedBuild) error) *Worker {
+	return &Worker{
+		store:            store,
+		rootDir:          rootDir,
+		maxBuilds:        maxBuilds,
+		run:              run,
+		configs:          make(map[string]*Config),
+		runningByProject: make(map[string]int),
+		finished:         make(chan struct{}, 1),
+	}
+}
+
+// Start as many queued builds as there's room for, oldest first, returning
+// how many are left waiting.  A project's builds start in the order they
+// were queued, so once one of them has to wait, so do the rest.  Builds the
+// newest queued build of their branch supersedes (see SupersedeQueued) are
+// marked SUPERSEDED instead.
+func (w *Worker) StartQueuedBuilds() (int, error) {
+	queuedBuilds, err := w.store.FindQueuedBuilds()
+	if err != nil {
+		return 0, err
+	}
+
+	w.forgetConfigs(queuedBuilds)
+	newest := newestQueuedBuilds(queuedBuilds)
+
+	waiting := 0
+	blocked := make(map[string]bool)
+	for _, queued := range queuedBuilds {
+		if branch, ok := queuedBranch(queued); ok {
+			if newer := newest[branch]; !newer.SameBuild(*queued.BuildId) && w.supersedes(newer) {
+				w.supersede(queued, newer)
+				continue
+			}
+		}
+
+		if blocked[queued.Project] || !w.hasRoom(queued) {
+			blocked[queued.Project] = true
+			waiting++
+			continue
+		}
+
+		// Another worker may have got there first.
+		if err := w.store.StartQueuedBuild(*queued.BuildId); err != nil {
+			log.Printf("Not starting %s: %s", queued.FmtBuildDir(), err)
+			continue
+		}
+
+		w.mutex.Lock()
+		w.running++
+		w.runningByProject[queued.Project]++
+		w.mutex.Unlock()
+
+		log.Printf("Starting %s", queued.FmtBuildDir())
+		w.wg.Add(1)
+		go w.runBuild(queued)
+	}
+
+	return waiting, nil
+}
+
+// Run builds until stop is closed, then wait for the running ones to finish.
+// Checks the queue every pollInterval, and whenever a build finishes.  If
+// drain, returns once nothing is queued or running.
+func (w *Worker) Run(pollInterval time.Duration, drain bool, stop <-chan struct{}) {
+	for {
+		waiting, err := w.StartQueuedBuilds()
+		if err != nil {
+			log.Printf("Error finding queued builds: %s", err)
+		} else if drain && waiting == 0 && w.Running() == 0 {
+			log.Printf("Queue drained.")
+			return
+		}
+
+		select {
+		case <-stop:
+			log.Printf("Not starting any more builds, waiting for %d running.", w.Running())
+			w.wg.Wait()
+			return
+		case <-w.finished:
+		case <-time.After(pollInterval):
+		}
+	}
+}
+
+// Wait for the running builds to finish.
+func (w *Worker) Wait() {
+	w.wg.Wait()
+}
+
+// How many builds are running.
+func (w *Worker) Running() int {
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+	return w.running
+}
+
+func (w *Worker) hasRoom(queued QueuedBuild) bool {
+	limit := w.projectLimit(queued)
+
+	w.mutex.Lock()
+	defer w.mutex.Unlock()
+
+	return w.running < w.maxBuilds && w.runningByProject[queued.Project] < limit
+}
+
+// The MaxConcurrentBuilds of queued's config, or 1 if it can't be parsed.
+func (w *Worker) projectLimit(queued QueuedBuild) int {
+	config := w.parseConfig(queued)
+	if config == nil || config.MaxConcurrentBuilds < 1 {
+		return 1
+	}
+	return config.MaxConcurrentBuilds
+}
+
+// Whether queued's config has it supersede older builds of its branch.
+func (w *Worker) supersedes(queued QueuedBuild) bool {
+	config := w.parseConfig(queued)
+	return config != nil && config.SupersedeQueued
+}
+
+// The config queued will be built with, or nil if it can't be parsed, as
+// parsed when queued was first seen.
+func (w *Worker) parseConfig(queued QueuedBuild) *Config {
+	buildDir := queued.FmtBuildDir()
+	if config, ok := w.configs[buildDir]; ok {
+		return config
+	}
+
+	config, _, err := ParseLayeredConfig(w.rootDir, queued.Project, queued.Tag, queued.ConfigFile)
+	if err != nil {
+		log.Printf("Error parsing config for %s: %s", buildDir, err)
+		config = nil
+	}
+	w.configs[buildDir] = config
+	return config
+}
+
+// Drop the configs of builds that are no longer among queuedBuilds.
+func (w *Worker) forgetConfigs(queuedBuilds []QueuedBuild) {
+	queued := make(map[string]bool, len(queuedBuilds))
+	for _, queuedBuild := range queuedBuilds {
+		queued[queuedBuild.FmtBuildDir()] = true
+	}
+	for buildDir := range w.configs {
+		if !queued[buildDir] {
+			delete(w.configs, buildDir)
+		}
+	}
+}
+
+// Mark queued SUPERSEDED by newer, removing its source dir if it would have
+// been once built.
+func (w *Worker) supersede(queued QueuedBuild, newer QueuedBuild) {
+	// Another worker may have started it.
+	if err := w.store.SupersedeQueuedBuild(*queued.BuildId, *newer.BuildId); err != nil {
+		log.Printf("Not superseding %s: %s", queued.FmtBuildDir(), err)
+		return
+	}
+	log.Printf("Superseded %s with %s", queued.FmtBuildDir(), newer.FmtBuildDir())
+
+	for _, buildFlag := range queued.BuildFlags {
+		if buildFlag == "--remove-src" || buildFlag == "--remove-src=true" {
+			log.Printf("Removing source dir %s", queued.SrcDir)
+			if err := os.RemoveAll(queued.SrcDir); err != nil {
+				log.Printf("Could not remove source dir %s: %s", queued.SrcDir, err)
+			}
+		}
+	}
+}
+
+// The project and branch of queued's tag (see TagBranch), if it names one.
+func queuedBranch(queued QueuedBuild) ([2]string, bool) {
+	branch, ok := TagBranch(queued.Tag)
+	return [2]string{queued.Project, branch}, ok
+}
+
+// Mark queued ERRORED if it's still RUNNING, e.g. as kerouac build died
+// before it could record how the build went.
+func (w *Worker) checkBuildFinished(queued QueuedBuild) {
+	recordedBuild, err := FindLatestBuild(w.store, queued.Project, queued.Tag, queued.DateTime.Format(DateFormat))
+	if err != nil {
+		log.Printf("Could not check %s finished: %s", queued.FmtBuildDir(), err)
+		return
+	}
+	if recordedBuild == nil || recordedBuild.Status != RUNNING {
+		return
+	}
+
+	log.Printf("%s is still RUNNING, marking it ERRORED", queued.FmtBuildDir())
+	if err = MarkBuildErrored(w.store, *queued.BuildId); err != nil {
+		log.Printf("Could not mark %s errored: %s", queued.FmtBuildDir(), err)
+	}
+}
+
+// The newest of queuedBuilds, which are oldest first, of each branch.
+func newestQueuedBuilds(queuedBuilds []QueuedBuild) map[[2]string]QueuedBuild {
+	newest := make(map[[2]string]QueuedBuild)
+	for _, queued := range queuedBuilds {
+		if branch, ok := queuedBranch(queued); ok {
+			newest[branch] = queued
+		}
+	}
+	return newest
+}
+
+func (w *Worker) runBuild(queued QueuedBuild) {
+	defer w.wg.Done()
+
+	if err := w.run(queued); err != nil {
+		log.Printf("Could not run %s: %s", queued.FmtBuildDir(), err)
+		if err = MarkBuildErrored(w.store, *queued.BuildId); err != nil {
+			log.Printf("Could not mark %s errored: %s", queued.FmtBuildDir(), err)
+		}
+	} else {
+		log.Printf("Finished %s", queued.FmtBuildDir())
+		w.checkBuildFinished(queued)
+	}
+
+	w.mutex.Lock()
+	w.running--
+	w.runningByProject[queued.Project]--
+	w.mutex.Unlock()
+
+	select {
+	case w.finished <- struct{}{}:
+	default:
+	}
+}
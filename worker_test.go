@@ -0,0 +1,258 @@
+package main
+
+import (
+	"fmt"
+	"io/ioutil"
+	"os"
+	"path/filepath"
+	"reflect"
+	"sort"
+	"sync"
+	"testing"
+	"time"
+)
+
+// A root dir with a config for each project, with the given fields as well as
+// those required, which the returned func queues builds with.
+func makeWorkerRoot(t *testing.T, store BuildStore, fields map[string]string) (string, func(project string, tag string)) {
+	rootDir, err := ioutil.TempDir("", "kerouac_worker_test")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	queuedAt := KnownDateTime
+	return rootDir, func(project string, tag string) {
+		configFile := filepath.Join(rootDir, project+".json")
+		config := fmt.Sprintf(`{"BuildScript": "./build.sh", "TimeoutInSecs": 10%s}`, fields[project])
+		if err := ioutil.WriteFile(configFile, []byte(config), 0600); err != nil {
+			t.Fatal(err)
+		}
+
+		queuedAt = queuedAt.Add(time.Second)
+		buildId := BuildIdAt(rootDir, project, tag, queuedAt)
+		if err := store.CreateQueuedBuildRecord(QueuedBuild{BuildId: &buildId, SrcDir: rootDir, ConfigFile: configFile}); err != nil {
+			t.Fatal(err)
+		}
+	}
+}
+
+func TestWorkerKeepsToLimits(t *testing.T) {
+	store := NewMemoryBuildStore(KnownRootDir)
+	rootDir, enqueue := makeWorkerRoot(t, store, map[string]string{"a": `, "MaxConcurrentBuilds": 1`, "b": `, "MaxConcurrentBuilds": 2`})
+	defer os.RemoveAll(rootDir)
+
+	for _, build := range [][]string{{"a", "a1"}, {"a", "a2"}, {"b", "b1"}, {"b", "b2"}, {"b", "b3"}} {
+		enqueue(build[0], build[1])
+	}
+
+	var mutex sync.Mutex
+	release := make(map[string]chan struct{})
+	var started []string
+	worker := NewWorker(store, rootDir, 4, func(queued QueuedBuild) error {
+		mutex.Lock()
+		started = append(started, queued.Tag)
+		done := make(chan struct{})
+		release[queued.Tag] = done
+		mutex.Unlock()
+		<-done
+		return nil
+	})
+	defer worker.Wait()
+
+	// Builds are started in goroutines, so wait for the expected number to
+	// get going (and a little longer, in case of more).
+	startedTags := func(expected int) []string {
+		for i := 0; i < 100; i++ {
+			mutex.Lock()
+			numStarted := len(started)
+			mutex.Unlock()
+			if numStarted >= expected {
+				break
+			}
+			time.Sleep(10 * time.Millisecond)
+		}
+		time.Sleep(10 * time.Millisecond)
+		mutex.Lock()
+		defer mutex.Unlock()
+		tags := append([]string{}, started...)
+		sort.Strings(tags)
+		return tags
+	}
+
+	waiting, err := worker.StartQueuedBuilds()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if tags := startedTags(3); waiting != 2 || !reflect.DeepEqual(tags, []string{"a1", "b1", "b2"}) {
+		t.Errorf("Started %v with %d waiting, not a1, b1 and b2 with 2", tags, waiting)
+	}
+
+	mutex.Lock()
+	close(release["a1"])
+	mutex.Unlock()
+	<-worker.finished
+
+	if waiting, err = worker.StartQueuedBuilds(); err != nil {
+		t.Fatal(err)
+	}
+	if tags := startedTags(4); waiting != 1 || !reflect.DeepEqual(tags, []string{"a1", "a2", "b1", "b2"}) {
+		t.Errorf("Started %v with %d waiting, not a2 as well with 1", tags, waiting)
+	}
+
+	recordedBuilds, err := store.FindMatchingBuilds("b", "b3", "")
+	if err != nil || len(recordedBuilds) != 1 || recordedBuilds[0].Status != QUEUED {
+		t.Errorf("Waiting build recorded as %+v, %v", recordedBuilds, err)
+	}
+
+	mutex.Lock()
+	for _, done := range release {
+		select {
+		case <-done:
+		default:
+			close(done)
+		}
+	}
+	mutex.Unlock()
+}
+
+func TestWorkerDrainsQueueInOrder(t *testing.T) {
+	store := NewMemoryBuildStore(KnownRootDir)
+	rootDir, enqueue := makeWorkerRoot(t, store, map[string]string{"b": `, "MaxConcurrentBuilds": 1`})
+	defer os.RemoveAll(rootDir)
+
+	for _, build := range [][]string{{"b", "b1"}, {"a", "a1"}, {"b", "b2"}, {"a", "a2"}} {
+		enqueue(build[0], build[1])
+	}
+
+	var started []string
+	worker := NewWorker(store, rootDir, 1, func(queued QueuedBuild) error {
+		started = append(started, queued.Tag)
+		if queued.Tag == "a2" {
+			return fmt.Errorf("could not start")
+		}
+		return nil
+	})
+	worker.Run(10*time.Millisecond, true, nil)
+
+	if expected := []string{"b1", "a1", "b2", "a2"}; !reflect.DeepEqual(started, expected) {
+		t.Errorf("Builds ran in the order %v not %v", started, expected)
+	}
+
+	if queuedBuilds, err := store.FindQueuedBuilds(); err != nil || len(queuedBuilds) != 0 {
+		t.Errorf("Builds %+v, %v still queued after draining", queuedBuilds, err)
+	}
+
+	recordedBuild, err := FindLatestBuild(store, "a", "a2", "")
+	if err != nil || recordedBuild.Status != ERRORED {
+		t.Errorf("Build that could not be run recorded as %+v, %v", recordedBuild, err)
+	}
+}
+
+func TestWorkerSupersedesQueuedBuilds(t *testing.T) {
+	store := NewMemoryBuildStore(KnownRootDir)
+	rootDir, enqueue := makeWorkerRoot(t, store, map[string]string{"a": `, "SupersedeQueued": true`})
+	defer os.RemoveAll(rootDir)
+
+	for _, build := range [][]string{{"a", "main@1"}, {"a", "dev@2"}, {"b", "main@3"}, {"a", "main@4"}, {"b", "main@5"}, {"a", "main@6"}, {"a", "v1.0"}, {"a", "v1.0"}} {
+		enqueue(build[0], build[1])
+	}
+
+	var started []string
+	worker := NewWorker(store, rootDir, 1, func(queued QueuedBuild) error {
+		started = append(started, queued.Tag)
+		return nil
+	})
+	worker.Run(10*time.Millisecond, true, nil)
+
+	// b doesn't SupersedeQueued, and v1.0 isn't a branch.
+	if expected := []string{"dev@2", "main@3", "main@5", "main@6", "v1.0", "v1.0"}; !reflect.DeepEqual(started, expected) {
+		t.Errorf("Builds ran in the order %v not %v", started, expected)
+	}
+
+	newest, err := FindLatestBuild(store, "a", "main@6", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	for _, tag := range []string{"main@1", "main@4"} {
+		recordedBuild, err := FindLatestBuild(store, "a", tag, "")
+		if err != nil || recordedBuild.Status != SUPERSEDED || !reflect.DeepEqual(recordedBuild.SupersededBy, newest.BuildId) {
+			t.Errorf("Build %s recorded as %+v superseded by %+v, %v", tag, recordedBuild, recordedBuild.SupersededBy, err)
+		}
+	}
+}
+
+func TestWorkerMarksUnfinishedBuildsErrored(t *testing.T) {
+	store := NewMemoryBuildStore(KnownRootDir)
+	rootDir, enqueue := makeWorkerRoot(t, store, nil)
+	defer os.RemoveAll(rootDir)
+
+	// Stands in for a kerouac build that dies before recording anything.
+	executable := filepath.Join(rootDir, "kerouac")
+	if err := ioutil.WriteFile(executable, []byte("#!/bin/sh\nexit 1\n"), 0700); err != nil {
+		t.Fatal(err)
+	}
+
+	enqueue("a", "died")
+	enqueue("a", "finished")
+
+	worker := NewWorker(store, rootDir, 1, func(queued QueuedBuild) error {
+		if queued.Tag == "finished" {
+			return MarkBuildSucceeded(store, *queued.BuildId)
+		}
+		return runQueuedBuild(executable, queued)
+	})
+	worker.Run(10*time.Millisecond, true, nil)
+
+	for tag, status := range map[string]BuildStatus{"died": ERRORED, "finished": SUCCEEDED} {
+		recordedBuild, err := FindLatestBuild(store, "a", tag, "")
+		if err != nil || recordedBuild.Status != status {
+			t.Errorf("Build %s recorded as %+v, %v, not %s", tag, recordedBuild, err, status)
+		}
+	}
+}
+
+func TestSameBuild(t *testing.T) {
+	buildId := knownBuildId()
+	found := BuildIdAt("elsewhere", KnownProject, KnownTag, KnownDateTime.In(time.FixedZone("UTC+1", 3600)))
+	if !buildId.SameBuild(found) {
+		t.Errorf("%+v is not the same build as %+v", found, buildId)
+	}
+
+	found.Tag = "other_tag"
+	if buildId.SameBuild(found) {
+		t.Errorf("%+v is the same build as %+v", found, buildId)
+	}
+}
+
+func TestWorkerParsesConfigsOnce(t *testing.T) {
+	store := NewMemoryBuildStore(KnownRootDir)
+	rootDir, enqueue := makeWorkerRoot(t, store, map[string]string{"a": `, "MaxConcurrentBuilds": 1`})
+	defer os.RemoveAll(rootDir)
+
+	enqueue("a", "a1")
+	enqueue("a", "a2")
+
+	release := make(chan struct{})
+	worker := NewWorker(store, rootDir, 2, func(queued QueuedBuild) error {
+		<-release
+		return nil
+	})
+	defer worker.Wait()
+	defer close(release)
+
+	if waiting, err := worker.StartQueuedBuilds(); err != nil || waiting != 1 {
+		t.Fatalf("Started with %d waiting, %v, not 1", waiting, err)
+	}
+
+	// a2 still waits for a1, as its config was parsed while it did.
+	config := `{"BuildScript": "./build.sh", "TimeoutInSecs": 10, "MaxConcurrentBuilds": 2}`
+	if err := ioutil.WriteFile(filepath.Join(rootDir, "a.json"), []byte(config), 0600); err != nil {
+		t.Fatal(err)
+	}
+	if waiting, err := worker.StartQueuedBuilds(); err != nil || waiting != 1 {
+		t.Errorf("Started with %d waiting, %v, not 1", waiting, err)
+	}
+	if len(worker.configs) != 1 {
+		t.Errorf("Configs of builds no longer queued kept: %v", worker.configs)
+	}
+}
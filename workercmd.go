@@ -0,0 +1,94 @@
+package main
+
+import (
+	"flag"
+	"fmt"
+	"log"
+	"os"
+	"os/exec"
+	"os/signal"
+	"runtime"
+	"syscall"
+	"time"
+)
+
+var maxBuilds = flag.Int("max-builds", 0, "For kerouac worker, how many builds to run at once; 0 means one per CPU.")
+
+var pollSecs = flag.Int("poll-secs", 5, "For kerouac worker, how often to check the queue for new builds.")
+
+var drainQueue = flag.Bool("drain", false, "For kerouac worker, exit once nothing is queued or running.")
+
+func DoWorkerCommand() {
+	flag.Usage = func() {
+		fmt.Printf("Usage: kerouac worker [options] <kerouacRootDir>\n\n")
+		fmt.Printf("Runs the builds queued by kerouac enqueue, oldest first, each as kerouac build would.\n")
+		fmt.Printf("Each project's builds run at most its config's MaxConcurrentBuilds (default 1) at once.\n")
+		fmt.Printf("Limits are per worker: two workers on the same root may each run that many.\n\n")
+		fmt.Printf("On SIGINT or SIGTERM, starts no more builds, and exits once the running ones finish.\n\n")
+		flag.PrintDefaults()
+	}
+
+	flag.Parse()
+
+	if len(flag.Args()) != 1 || *maxBuilds < 0 || *pollSecs < 1 {
+		flag.Usage()
+		os.Exit(1)
+	}
+
+	kerouacRoot := flag.Arg(0)
+
+	executable, err := os.Executable()
+	if err != nil {
+		log.Fatalf("Can't find the kerouac executable: %s", err)
+	}
+
+	store, err := OpenBuildStore(kerouacRoot)
+	if err != nil {
+		log.Fatalf("Error opening build db: %s", err)
+	}
+	defer store.Close()
+
+	numBuilds := *maxBuilds
+	if numBuilds == 0 {
+		numBuilds = runtime.NumCPU()
+	}
+
+	worker := NewWorker(store, kerouacRoot, numBuilds, func(queued QueuedBuild) error {
+		return runQueuedBuild(executable, queued)
+	})
+
+	stop := make(chan struct{})
+	signals := make(chan os.Signal, 1)
+	signal.Notify(signals, os.Interrupt, syscall.SIGTERM)
+	go func() {
+		sig := <-signals
+		log.Printf("Received %s.", sig)
+		close(stop)
+	}()
+
+	log.Printf("Running queued builds of %s, %d at once.", kerouacRoot, numBuilds)
+	worker.Run(time.Duration(*pollSecs)*time.Second, *drainQueue, stop)
+}
+
+// Run queued with kerouac build, returning an error only if it couldn't be
+// started.  How the build went is its own record's business.
+func runQueuedBuild(executable string, queued QueuedBuild) error {
+	cmd := exec.Command(executable, queuedBuildArgs(queued)...)
+	cmd.Stdout = os.Stdout
+	cmd.Stderr = os.Stderr
+	// Signals to the worker shouldn't cancel the builds it's waiting for.
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true}
+
+	if err := cmd.Start(); err != nil {
+		return err
+	}
+	cmd.Wait()
+	return nil
+}
+
+// The kerouac arguments to run queued.
+func queuedBuildArgs(queued QueuedBuild) []string {
+	args := []string{"build", "--queued-build=" + queued.DateTime.Format(DateFormat)}
+	args = append(args, queued.BuildFlags...)
+	return append(args, queued.SrcDir, queued.ConfigFile, queued.RootDir, queued.Project, queued.Tag)
+}